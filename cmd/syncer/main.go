@@ -5,16 +5,124 @@ import (
 	"github.com/initialed85/syncer/internal/utils"
 	"github.com/initialed85/syncer/pkg/syncer"
 	"log"
+	"os"
 )
 
+func restore(rawArgs []string) {
+	restoreArgs := args.ParseRestoreArgs(rawArgs)
+
+	description, err := syncer.Restore(restoreArgs.Path, restoreArgs.At, restoreArgs.To)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print(description)
+}
+
+func keygen(rawArgs []string) {
+	keygenArgs := args.ParseKeygenArgs(rawArgs)
+
+	certPath := keygenArgs.Out + ".crt"
+	keyPath := keygenArgs.Out + ".key"
+
+	fingerprint, err := syncer.GenerateKeyPair(certPath, keyPath, keygenArgs.CommonName, keygenArgs.ValidFor)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote %v and %v; the certificate's fingerprint (for the other side's -tlsPeerFingerprint) is %v", certPath, keyPath, fingerprint)
+
+	if !keygenArgs.PSK {
+		return
+	}
+
+	pskPath := keygenArgs.Out + ".psk"
+
+	err = syncer.GeneratePSK(pskPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("wrote %v (copy it to the other side for -pskFile)", pskPath)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		restore(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		keygen(os.Args[2:])
+		return
+	}
+
 	runArgs := args.ValidateArgs(args.ParseArgs())
 
-	stopFn, err := syncer.Run(
-		runArgs.LocalPath,
-		runArgs.Rate,
-		runArgs.Debounce,
-	)
+	var stopFn func()
+	var err error
+
+	config := syncer.Config{
+		LocalPath:             runArgs.LocalPath,
+		RemotePath:            runArgs.RemotePath,
+		RemoteHost:            runArgs.RemoteHost,
+		ListenAddr:            runArgs.ListenAddr,
+		RemoteCommand:         runArgs.RemoteCommand,
+		RemoteSyncer:          runArgs.RemoteSyncer,
+		Stdio:                 runArgs.Stdio,
+		Rate:                  runArgs.Rate,
+		Debounce:              runArgs.Debounce,
+		HashAlgorithm:         syncer.HashAlgorithm(runArgs.HashAlgorithm),
+		HashWorkers:           runArgs.HashWorkers,
+		WatchBackend:          syncer.WatchBackendName(runArgs.WatchBackend),
+		PollInterval:          runArgs.PollInterval,
+		ReconcileInterval:     runArgs.ReconcileInterval,
+		ReconcileRate:         runArgs.ReconcileRate,
+		FoldersToIgnore:       runArgs.FoldersToIgnore,
+		FilesToIgnore:         runArgs.FilesToIgnore,
+		Compression:           syncer.Compression(runArgs.Compression),
+		DeltaThreshold:        runArgs.DeltaThreshold,
+		Chunking:              runArgs.Chunking,
+		ChunkThreshold:        runArgs.ChunkThreshold,
+		ChunkStoreSize:        runArgs.ChunkStoreSize,
+		ArchiveThreshold:      runArgs.ArchiveThreshold,
+		StreamThreshold:       runArgs.StreamThreshold,
+		TransferWorkers:       runArgs.TransferWorkers,
+		HotPaths:              runArgs.ParsedHotPaths,
+		ColdPaths:             runArgs.ParsedColdPaths,
+		Fsync:                 runArgs.Fsync,
+		RefuseOutsideSymlinks: runArgs.RefuseOutsideSymlinks,
+		Bidirectional:         runArgs.Bidirectional,
+		ConflictPolicy:        syncer.ConflictPolicy(runArgs.ConflictPolicy),
+		VerifyInterval:        runArgs.VerifyInterval,
+		DeleteThreshold:       runArgs.ParsedDeleteThreshold,
+		DeletePrompt:          runArgs.DeletePrompt,
+		ControlAddr:           runArgs.ControlAddr,
+		ControlTokenFile:      runArgs.ControlTokenFile,
+		Trash:                 runArgs.Trash,
+		TrashMaxAge:           runArgs.TrashMaxAge,
+		TrashMaxSize:          runArgs.TrashMaxSize,
+		TLSCert:               runArgs.TLSCert,
+		TLSKey:                runArgs.TLSKey,
+		TLSCA:                 runArgs.TLSCA,
+		TLSPeerFingerprints:   runArgs.TLSPeerFingerprints,
+		PSKFile:               runArgs.PSKFile,
+	}
+
+	if runArgs.Stdio {
+		err = syncer.RunStdioReceiver(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	if runArgs.Receive {
+		stopFn, err = syncer.RunReceiver(config)
+	} else {
+		stopFn, err = syncer.Run(config)
+	}
 
 	if err != nil {
 		log.Fatal(err)
@@ -1,16 +1,18 @@
 module github.com/initialed85/syncer
 
-go 1.18
+go 1.22
 
 require (
 	github.com/MichaelTJones/walk v0.0.0-20161122175330-4748e29d5718
 	github.com/ansiwen/gctx v0.0.0-20220223175607-0c57ec76481f
+	github.com/cespare/xxhash/v2 v2.3.0
 	github.com/kalafut/imohash v1.0.2
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.31
 	github.com/rjeczalik/notify v0.9.2
-	github.com/sabhiram/go-gitignore v0.0.0-20210923224102-525f6e181f06
+	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad
 )
 
 require (
 	github.com/twmb/murmur3 v1.1.5 // indirect
-	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 )
@@ -2,21 +2,72 @@ package args
 
 import (
 	"flag"
+	"fmt"
+	"github.com/initialed85/syncer/pkg/syncer"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"time"
 )
 
 type Args struct {
-	Send       bool
-	Receive    bool
-	LocalPath  string
-	RemotePath string
-	RemoteHost string
-	Rate       time.Duration
-	Debounce   time.Duration
+	Send                  bool
+	Receive               bool
+	LocalPath             string
+	RemotePath            string
+	RemoteHost            string
+	ListenAddr            string
+	SSH                   bool
+	RemoteCommand         string
+	RemoteSyncer          string
+	Stdio                 bool
+	Rate                  time.Duration
+	Debounce              time.Duration
+	HashAlgorithm         string
+	HashWorkers           int
+	WatchBackend          string
+	PollInterval          time.Duration
+	ReconcileInterval     time.Duration
+	ReconcileRate         int
+	IgnoreFolders         string
+	IgnoreFiles           string
+	IgnoreConfig          string
+	FoldersToIgnore       []string
+	FilesToIgnore         []string
+	Compression           string
+	DeltaThreshold        int64
+	Chunking              bool
+	ChunkThreshold        int64
+	ChunkStoreSize        int64
+	ArchiveThreshold      int64
+	StreamThreshold       int64
+	TransferWorkers       int
+	HotPaths              string
+	ColdPaths             string
+	ParsedHotPaths        []string
+	ParsedColdPaths       []string
+	Fsync                 bool
+	RefuseOutsideSymlinks bool
+	Bidirectional         bool
+	ConflictPolicy        string
+	VerifyInterval        time.Duration
+	DeleteThreshold       string
+	ParsedDeleteThreshold syncer.DeleteThreshold
+	DeletePrompt          bool
+	ControlAddr           string
+	ControlTokenFile      string
+	Trash                 bool
+	TrashMaxAge           time.Duration
+	TrashMaxSize          int64
+	TLSCert               string
+	TLSKey                string
+	TLSCA                 string
+	TLSPeerFingerprint    string
+	TLSPeerFingerprints   []string
+	PSKFile               string
 }
 
 func ParseArgs() Args {
@@ -26,11 +77,68 @@ func ParseArgs() Args {
 	flag.BoolVar(&args.Receive, "receive", false, "Should this node receive")
 	flag.StringVar(&args.LocalPath, "localPath", "", "Local path to sync")
 	flag.StringVar(&args.RemotePath, "remotePath", "", "Remote path to sync")
-	flag.StringVar(&args.RemoteHost, "remoteHost", "", "Remote host to sync with")
+	flag.StringVar(&args.RemoteHost, "remoteHost", "", "Remote host (and optional port) to sync with")
+	flag.StringVar(&args.ListenAddr, "listenAddr", fmt.Sprintf(":%v", syncer.DefaultPort), "Address to listen on (when receiving)")
+
+	flag.BoolVar(&args.SSH, "ssh", false, fmt.Sprintf("Start the receiver on -remoteHost over ssh rather than connecting to one that's listening (same as -remoteCommand %#+v)", syncer.DefaultRemoteCommand))
+	flag.StringVar(&args.RemoteCommand, "remoteCommand", "", "Command to start the receiver with and talk to it over the stdin / stdout of ({host} is -remoteHost and {command} is the syncer command line to run)")
+	flag.StringVar(&args.RemoteSyncer, "remoteSyncer", syncer.DefaultRemoteSyncer, "Path to syncer on the other side (with -ssh or -remoteCommand)")
+	flag.BoolVar(&args.Stdio, "stdio", false, "Receive over stdin / stdout rather than listening (this is how -ssh and -remoteCommand start the receiver)")
 
 	flag.DurationVar(&args.Rate, "rate", time.Millisecond*100, "Rate to update at")
 	flag.DurationVar(&args.Debounce, "debounce", time.Millisecond*2000, "Duration to wait for filesystem to settle")
 
+	flag.StringVar(&args.HashAlgorithm, "hashAlgorithm", string(syncer.HashAlgorithmImoHash), fmt.Sprintf("Algorithm to detect content changes with (one of %v)", syncer.HashAlgorithms))
+	flag.IntVar(&args.HashWorkers, "hashWorkers", runtime.NumCPU(), "Number of files to hash concurrently")
+
+	flag.StringVar(&args.WatchBackend, "watchBackend", string(syncer.WatchBackendNotify), fmt.Sprintf("Source of filesystem events (one of %v)", syncer.WatchBackendNames))
+	flag.DurationVar(&args.PollInterval, "pollInterval", time.Second*1, "Rate to walk at (for the polling watch backend)")
+
+	flag.DurationVar(&args.ReconcileInterval, "reconcileInterval", time.Duration(0), "Rate to walk everything at to catch missed events (0 to disable)")
+	flag.IntVar(&args.ReconcileRate, "reconcileRate", syncer.DefaultReconcileRate, "Maximum entries per second to walk at when reconciling")
+
+	flag.StringVar(&args.IgnoreFolders, "ignoreFolders", strings.Join(syncer.DefaultFoldersToIgnore, ","), "Comma-separated folder names to ignore anywhere (.git, .syncer and .syncer-trash are always ignored)")
+	flag.StringVar(&args.IgnoreFiles, "ignoreFiles", strings.Join(syncer.DefaultFilesToIgnore, ","), "Comma-separated file name suffixes to ignore")
+	flag.StringVar(&args.IgnoreConfig, "ignoreConfig", "", "Path to a JSON file with more ignoreFolders / ignoreFiles (added to the flags)")
+
+	flag.StringVar(&args.Compression, "compression", string(syncer.CompressionAuto), fmt.Sprintf("Codec to compress what's sent with, if the other side has it too (one of %v; already compressed files are sent as they are)", syncer.Compressions))
+
+	flag.Int64Var(&args.DeltaThreshold, "deltaThreshold", syncer.DefaultDeltaThreshold, "Size in bytes from which changed files are sent as deltas against the remote copy (0 to disable)")
+
+	flag.BoolVar(&args.Chunking, "chunking", false, "Send changed files as content-defined chunks, skipping chunks the receiver has seen before")
+	flag.Int64Var(&args.ChunkThreshold, "chunkThreshold", syncer.DefaultChunkThreshold, "Size in bytes from which changed files are chunked (with -chunking)")
+	flag.Int64Var(&args.ChunkStoreSize, "chunkStoreSize", syncer.DefaultChunkStoreSize, "Size in bytes to keep the chunk store under (when receiving; 0 to disable)")
+
+	flag.Int64Var(&args.ArchiveThreshold, "archiveThreshold", syncer.DefaultArchiveThreshold, "Size in bytes under which files are packed into one archive per batch rather than sent one by one (0 to disable)")
+	flag.Int64Var(&args.StreamThreshold, "streamThreshold", syncer.DefaultStreamThreshold, "Size in bytes from which files are sent in parts as they're read rather than all at once (0 to disable)")
+
+	flag.IntVar(&args.TransferWorkers, "transferWorkers", syncer.DefaultTransferWorkers, "Number of files to send at once (each over its own connection to -remoteHost)")
+	flag.StringVar(&args.HotPaths, "hotPaths", "", "Comma-separated folders (e.g. src) whose files are sent before anything else")
+	flag.StringVar(&args.ColdPaths, "coldPaths", "", "Comma-separated folders (e.g. vendor) whose files are sent after everything else")
+
+	flag.BoolVar(&args.Fsync, "fsync", false, "Flush each received file to disk before moving it into place (slower, but nothing half-written survives a crash)")
+
+	flag.BoolVar(&args.RefuseOutsideSymlinks, "refuseOutsideSymlinks", false, "Refuse received symlinks that point outside the tree being received into")
+
+	flag.BoolVar(&args.Bidirectional, "bidirectional", false, "Sync changes both ways (both sides need it; the -receive side watches -remotePath too)")
+	flag.StringVar(&args.ConflictPolicy, "conflictPolicy", string(syncer.ConflictPolicyBoth), fmt.Sprintf("How to resolve a path changed on both sides (with -bidirectional; one of %v)", syncer.ConflictPolicies))
+
+	flag.DurationVar(&args.VerifyInterval, "verifyInterval", time.Duration(0), "Rate to compare the local and remote trees at, fixing any differences (0 to only compare on connect)")
+
+	flag.StringVar(&args.DeleteThreshold, "deleteThreshold", "", "Number of files (e.g. 500) or percentage of files (e.g. 25%) that can be deleted at once before asking to confirm it (empty to never ask)")
+	flag.StringVar(&args.ControlAddr, "controlAddr", "", "Address to serve the control API on, e.g. for confirming deletions (empty to disable; only loopback without -controlTokenFile)")
+	flag.StringVar(&args.ControlTokenFile, "controlTokenFile", "", "Path to a token that requests to the control API need (as \"Authorization: Bearer <token>\")")
+
+	flag.BoolVar(&args.Trash, "trash", true, "Move received deletions and overwritten files into .syncer-trash rather than destroying them (see syncer restore)")
+	flag.DurationVar(&args.TrashMaxAge, "trashMaxAge", syncer.DefaultTrashMaxAge, "Age to keep things in .syncer-trash for (0 to keep them regardless)")
+	flag.Int64Var(&args.TrashMaxSize, "trashMaxSize", syncer.DefaultTrashMaxSize, "Size in bytes to keep .syncer-trash under (0 to not limit it)")
+
+	flag.StringVar(&args.TLSCert, "tlsCert", "", "Path to this side's TLS certificate (see syncer keygen); the other side has to have one too")
+	flag.StringVar(&args.TLSKey, "tlsKey", "", "Path to the key for -tlsCert")
+	flag.StringVar(&args.TLSCA, "tlsCA", "", "Path to the CA certificate(s) the other side's certificate has to be signed by")
+	flag.StringVar(&args.TLSPeerFingerprint, "tlsPeerFingerprint", "", "Comma-separated SHA-256 fingerprints the other side's certificate has to have (as printed by syncer keygen)")
+	flag.StringVar(&args.PSKFile, "pskFile", "", "Path to a pre-shared key the other side has to have too (see syncer keygen -psk); with no -tlsCert it's all that's checked")
+
 	flag.Parse()
 
 	return args
@@ -47,23 +155,63 @@ func ValidateArgs(args Args) Args {
 		log.Fatal("-send and -receive cannot be set")
 	}
 
-	args.LocalPath = strings.TrimSpace(args.LocalPath)
-	if args.LocalPath == "" {
-		log.Fatal("-localPath must be set")
-	}
+	if args.Send {
+		args.LocalPath = strings.TrimSpace(args.LocalPath)
+		if args.LocalPath == "" {
+			log.Fatal("-localPath must be set")
+		}
 
-	args.LocalPath, err = filepath.Abs(args.LocalPath)
-	if err != nil {
-		log.Fatalf("-localPath %#+v could not be converted to an absolute path (stating %v)", args.LocalPath, err)
-	}
+		args.LocalPath, err = filepath.Abs(args.LocalPath)
+		if err != nil {
+			log.Fatalf("-localPath %#+v could not be converted to an absolute path (stating %v)", args.LocalPath, err)
+		}
 
-	stat, err := os.Stat(args.LocalPath)
-	if err != nil {
-		log.Fatalf("-localPath %#+v failed os.Stat (stating %v)", args.LocalPath, err)
+		stat, err := os.Stat(args.LocalPath)
+		if err != nil {
+			log.Fatalf("-localPath %#+v failed os.Stat (stating %v)", args.LocalPath, err)
+		}
+
+		if !stat.IsDir() {
+			log.Fatalf("-localPath %#+v is not a directory", args.LocalPath)
+		}
+
+		args.RemoteHost = strings.TrimSpace(args.RemoteHost)
+		if args.RemoteHost == "" {
+			log.Fatal("-remoteHost must be set")
+		}
+
+		args.RemoteCommand = strings.TrimSpace(args.RemoteCommand)
+		if args.SSH && args.RemoteCommand == "" {
+			args.RemoteCommand = syncer.DefaultRemoteCommand
+		}
+
+		if args.RemoteCommand != "" {
+			if !strings.Contains(args.RemoteCommand, "{command}") {
+				log.Fatalf("-remoteCommand %#+v must have {command} in it", args.RemoteCommand)
+			}
+
+			args.RemoteSyncer = strings.TrimSpace(args.RemoteSyncer)
+			if args.RemoteSyncer == "" {
+				log.Fatal("-remoteSyncer must be set")
+			}
+
+			if args.Bidirectional {
+				log.Fatal("-ssh and -remoteCommand can't be used with -bidirectional (the changes coming back need a conn of their own)")
+			}
+
+			if args.TLSCert != "" || args.TLSCA != "" || args.TLSPeerFingerprint != "" || args.PSKFile != "" {
+				log.Fatal("-tlsCert, -tlsCA, -tlsPeerFingerprint and -pskFile are for connecting to -remoteHost, not -ssh or -remoteCommand")
+			}
+		} else {
+			_, _, err = net.SplitHostPort(args.RemoteHost)
+			if err != nil { // assume no port was given
+				args.RemoteHost = net.JoinHostPort(args.RemoteHost, fmt.Sprintf("%v", syncer.DefaultPort))
+			}
+		}
 	}
 
-	if !stat.IsDir() {
-		log.Fatalf("-localPath %#+v is not a directory", args.LocalPath)
+	if args.Stdio && (!args.Receive || args.Bidirectional) {
+		log.Fatal("-stdio is only for -receive (and not with -bidirectional)")
 	}
 
 	args.RemotePath = strings.TrimSpace(args.RemotePath)
@@ -71,9 +219,25 @@ func ValidateArgs(args Args) Args {
 		log.Fatal("-remotePath must be set")
 	}
 
-	args.RemoteHost = strings.TrimSpace(args.RemoteHost)
-	if args.RemotePath == "" {
-		log.Fatal("-remoteHost must be set")
+	if args.Receive {
+		args.RemotePath, err = filepath.Abs(args.RemotePath)
+		if err != nil {
+			log.Fatalf("-remotePath %#+v could not be converted to an absolute path (stating %v)", args.RemotePath, err)
+		}
+
+		stat, err := os.Stat(args.RemotePath)
+		if err != nil {
+			log.Fatalf("-remotePath %#+v failed os.Stat (stating %v)", args.RemotePath, err)
+		}
+
+		if !stat.IsDir() {
+			log.Fatalf("-remotePath %#+v is not a directory", args.RemotePath)
+		}
+
+		args.ListenAddr = strings.TrimSpace(args.ListenAddr)
+		if args.ListenAddr == "" {
+			log.Fatal("-listenAddr must be set")
+		}
 	}
 
 	if args.Rate < time.Duration(0) {
@@ -84,9 +248,294 @@ func ValidateArgs(args Args) Args {
 		log.Fatal("-debounce cannot be negative")
 	}
 
+	supported := false
+	for _, hashAlgorithm := range syncer.HashAlgorithms {
+		if syncer.HashAlgorithm(args.HashAlgorithm) == hashAlgorithm {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		log.Fatalf("-hashAlgorithm must be one of %v", syncer.HashAlgorithms)
+	}
+
+	if args.HashWorkers < 1 {
+		log.Fatal("-hashWorkers must be at least 1")
+	}
+
+	supported = false
+	for _, watchBackendName := range syncer.WatchBackendNames {
+		if syncer.WatchBackendName(args.WatchBackend) == watchBackendName {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		log.Fatalf("-watchBackend must be one of %v", syncer.WatchBackendNames)
+	}
+
+	if args.PollInterval <= time.Duration(0) {
+		log.Fatal("-pollInterval must be positive")
+	}
+
+	if args.ReconcileInterval < time.Duration(0) {
+		log.Fatal("-reconcileInterval cannot be negative")
+	}
+
+	if args.ReconcileRate < 1 {
+		log.Fatal("-reconcileRate must be at least 1")
+	}
+
+	if args.VerifyInterval < time.Duration(0) {
+		log.Fatal("-verifyInterval cannot be negative")
+	}
+
+	if args.DeltaThreshold < 0 {
+		log.Fatal("-deltaThreshold cannot be negative")
+	}
+
+	if args.ChunkThreshold < 0 {
+		log.Fatal("-chunkThreshold cannot be negative")
+	}
+
+	if args.ChunkStoreSize < 0 {
+		log.Fatal("-chunkStoreSize cannot be negative")
+	}
+
+	if args.ArchiveThreshold < 0 {
+		log.Fatal("-archiveThreshold cannot be negative")
+	}
+
+	if args.StreamThreshold < 0 {
+		log.Fatal("-streamThreshold cannot be negative")
+	}
+
+	if args.TransferWorkers < 1 {
+		log.Fatal("-transferWorkers must be at least 1")
+	}
+
+	if args.TrashMaxAge < time.Duration(0) {
+		log.Fatal("-trashMaxAge cannot be negative")
+	}
+
+	if args.TrashMaxSize < 0 {
+		log.Fatal("-trashMaxSize cannot be negative")
+	}
+
+	supported = false
+	for _, compression := range syncer.Compressions {
+		if syncer.Compression(args.Compression) == compression {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		log.Fatalf("-compression must be one of %v", syncer.Compressions)
+	}
+
+	supported = false
+	for _, conflictPolicy := range syncer.ConflictPolicies {
+		if syncer.ConflictPolicy(args.ConflictPolicy) == conflictPolicy {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		log.Fatalf("-conflictPolicy must be one of %v", syncer.ConflictPolicies)
+	}
+
+	args.TLSCert = strings.TrimSpace(args.TLSCert)
+	args.TLSKey = strings.TrimSpace(args.TLSKey)
+	if (args.TLSCert == "") != (args.TLSKey == "") {
+		log.Fatal("-tlsCert and -tlsKey have to be set together")
+	}
+
+	args.TLSCA = strings.TrimSpace(args.TLSCA)
+	args.TLSPeerFingerprints = splitList(args.TLSPeerFingerprint)
+	args.PSKFile = strings.TrimSpace(args.PSKFile)
+
+	if args.TLSCert != "" && args.TLSCA == "" && len(args.TLSPeerFingerprints) == 0 && args.PSKFile == "" {
+		log.Fatal("-tlsCert needs -tlsCA or -tlsPeerFingerprint (or -pskFile) to check the other side with")
+	}
+
+	args.ParsedDeleteThreshold, err = syncer.ParseDeleteThreshold(args.DeleteThreshold)
+	if err != nil {
+		log.Fatalf("-deleteThreshold %#+v could not be parsed (stating %v)", args.DeleteThreshold, err)
+	}
+
+	args.ControlTokenFile = strings.TrimSpace(args.ControlTokenFile)
+
+	if args.ControlTokenFile != "" && args.ControlAddr == "" {
+		log.Fatal("-controlTokenFile is for -controlAddr")
+	}
+
+	if args.Receive && !args.Bidirectional && (args.DeleteThreshold != "" || args.ControlAddr != "") {
+		log.Fatal("-deleteThreshold and -controlAddr are only for the side that sends changes (or -bidirectional)")
+	}
+
+	// note: only ask on stdin if there's somebody there to answer (/dev/null is a char device too)
+	stdinInfo, err := os.Stdin.Stat()
+	if err == nil && stdinInfo.Mode()&os.ModeCharDevice != 0 {
+		devNullInfo, err := os.Stat(os.DevNull)
+		args.DeletePrompt = err != nil || !os.SameFile(stdinInfo, devNullInfo)
+	}
+
+	args.FoldersToIgnore = splitList(args.IgnoreFolders)
+	args.FilesToIgnore = splitList(args.IgnoreFiles)
+
+	args.ParsedHotPaths = splitList(args.HotPaths)
+	args.ParsedColdPaths = splitList(args.ColdPaths)
+
+	args.IgnoreConfig = strings.TrimSpace(args.IgnoreConfig)
+	if args.IgnoreConfig != "" {
+		ignoreConfig, err := syncer.LoadIgnoreConfig(args.IgnoreConfig)
+		if err != nil {
+			log.Fatalf("-ignoreConfig %#+v could not be loaded (stating %v)", args.IgnoreConfig, err)
+		}
+
+		args.FoldersToIgnore = append(args.FoldersToIgnore, ignoreConfig.IgnoreFolders...)
+		args.FilesToIgnore = append(args.FilesToIgnore, ignoreConfig.IgnoreFiles...)
+	}
+
 	if args.Debounce <= args.Rate {
 		log.Printf("warning: debounce <= rate; every update will result in handling")
 	}
 
 	return args
 }
+
+func splitList(rawList string) []string {
+	list := make([]string, 0)
+
+	for _, item := range strings.Split(rawList, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		list = append(list, item)
+	}
+
+	return list
+}
+
+type RestoreArgs struct {
+	Path string
+	At   time.Time
+	To   string
+}
+
+// restoreTimeFormats are the ways -at can be given (as well as a duration, meaning that long ago); all but the first
+// are in local time
+var restoreTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+func parseRestoreTime(rawTime string) (time.Time, error) {
+	duration, err := time.ParseDuration(rawTime)
+	if err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	for _, format := range restoreTimeFormats {
+		at, err := time.ParseInLocation(format, rawTime, time.Local)
+		if err == nil {
+			return at, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("expected a duration (e.g. 2h) or a time like %v", restoreTimeFormats)
+}
+
+// ParseRestoreArgs is for "syncer restore <path> [-at time] [-to path]" (the flags can go either side of the path)
+func ParseRestoreArgs(rawArgs []string) RestoreArgs {
+	args := RestoreArgs{}
+
+	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
+	flagSet.Usage = func() {
+		_, _ = fmt.Fprintf(flagSet.Output(), "usage: syncer restore <path> [-at time] [-to path]\n")
+		flagSet.PrintDefaults()
+	}
+
+	rawAt := flagSet.String("at", "", "Time to restore the version from, e.g. \"2006-01-02 15:04\" or 2h (ago); empty for the last version trashed")
+	flagSet.StringVar(&args.To, "to", "", "Path to restore to (empty for where it was)")
+
+	paths := make([]string, 0)
+
+	_ = flagSet.Parse(rawArgs)
+	for flagSet.NArg() > 0 {
+		paths = append(paths, flagSet.Arg(0))
+		_ = flagSet.Parse(flagSet.Args()[1:])
+	}
+
+	if len(paths) != 1 {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+
+	args.Path = strings.TrimSpace(paths[0])
+
+	*rawAt = strings.TrimSpace(*rawAt)
+	if *rawAt != "" {
+		var err error
+
+		args.At, err = parseRestoreTime(*rawAt)
+		if err != nil {
+			log.Fatalf("-at %#+v could not be parsed (%v)", *rawAt, err)
+		}
+	}
+
+	args.To = strings.TrimSpace(args.To)
+
+	return args
+}
+
+type KeygenArgs struct {
+	Out        string
+	CommonName string
+	ValidFor   time.Duration
+	PSK        bool
+}
+
+// ParseKeygenArgs is for "syncer keygen [-out name] [-commonName name] [-validFor duration] [-psk]"
+func ParseKeygenArgs(rawArgs []string) KeygenArgs {
+	args := KeygenArgs{}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "syncer"
+	}
+
+	flagSet := flag.NewFlagSet("keygen", flag.ExitOnError)
+
+	flagSet.StringVar(&args.Out, "out", "syncer", "Name to write the files as (<out>.crt and <out>.key, and <out>.psk with -psk)")
+	flagSet.StringVar(&args.CommonName, "commonName", hostname, "Name to put in the certificate")
+	flagSet.DurationVar(&args.ValidFor, "validFor", syncer.DefaultKeyPairValidFor, "Duration the certificate is valid for")
+	flagSet.BoolVar(&args.PSK, "psk", false, "Write a pre-shared key (for -pskFile) as well")
+
+	_ = flagSet.Parse(rawArgs)
+
+	if flagSet.NArg() > 0 {
+		flagSet.Usage()
+		os.Exit(2)
+	}
+
+	args.Out = strings.TrimSpace(args.Out)
+	if args.Out == "" {
+		log.Fatal("-out must be set")
+	}
+
+	if args.ValidFor <= time.Duration(0) {
+		log.Fatal("-validFor must be positive")
+	}
+
+	return args
+}
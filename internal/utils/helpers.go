@@ -18,7 +18,7 @@ func init() {
 }
 
 func WaitForSigInt() {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGINT)
 	<-c
 }
@@ -0,0 +1,183 @@
+package syncer
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+const (
+	DefaultArchiveThreshold = 64 * 1024
+	// maxArchiveSize is how big an archive gets before it's sent and another is started
+	maxArchiveSize = 4 * 1024 * 1024
+	// archiveBaseSumRecord is the PAX record for a Message's BaseSum (for bidirectional syncs)
+	archiveBaseSumRecord = "SYNCER.basesum"
+)
+
+// archive packs the mkdirs, writes and symlinks for lots of small files into a single MessageTypeArchive (a tar
+// stream, as it's as good a format as any), rather than a message each
+type archive struct {
+	buf    bytes.Buffer
+	writer *tar.Writer
+	count  int
+}
+
+func isArchivable(message *Message) bool {
+	switch message.Type {
+	case MessageTypeMkdir, MessageTypeWrite, MessageTypeSymlink:
+		return !message.Modified.IsZero() // note: i.e. it was there to stat
+	}
+
+	return false
+}
+
+func (a *archive) add(message *Message) error {
+	if a.writer == nil {
+		a.writer = tar.NewWriter(&a.buf)
+	}
+
+	header := tar.Header{
+		Name:    message.Path,
+		Mode:    int64(message.Mode.Perm()),
+		ModTime: message.Modified,
+		Format:  tar.FormatPAX, // note: for the nanoseconds of ModTime
+	}
+
+	switch message.Type {
+	case MessageTypeMkdir:
+		header.Typeflag = tar.TypeDir
+	case MessageTypeSymlink:
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = message.Target
+	default:
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(len(message.Data))
+	}
+
+	if message.HasBase {
+		header.PAXRecords = map[string]string{archiveBaseSumRecord: hex.EncodeToString(message.BaseSum[:])}
+	}
+
+	err := a.writer.WriteHeader(&header)
+	if err != nil {
+		return err
+	}
+
+	if header.Typeflag == tar.TypeReg {
+		_, err = a.writer.Write(message.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.count++
+
+	return nil
+}
+
+func (a *archive) isFull() bool {
+	return a.buf.Len() >= maxArchiveSize
+}
+
+// getMessage returns the archive so far as a message (and starts a new one)
+func (a *archive) getMessage() (*Message, error) {
+	err := a.writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	message := Message{
+		Type: MessageTypeArchive,
+		Data: append([]byte(nil), a.buf.Bytes()...),
+	}
+
+	a.buf.Reset()
+	a.writer = nil
+	a.count = 0
+
+	return &message, nil
+}
+
+// readArchive unpacks a MessageTypeArchive into the messages that went into it
+func readArchive(data []byte) ([]*Message, error) {
+	messages := make([]*Message, 0)
+
+	reader := tar.NewReader(bytes.NewReader(data))
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return messages, nil
+		}
+
+		if err != nil {
+			return messages, err
+		}
+
+		message := Message{
+			Path:     strings.TrimSuffix(header.Name, "/"),
+			Mode:     fs.FileMode(header.Mode).Perm(),
+			Modified: header.ModTime,
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			message.Type = MessageTypeMkdir
+		case tar.TypeSymlink:
+			message.Type = MessageTypeSymlink
+			message.Target = header.Linkname
+		case tar.TypeReg:
+			// note: the size is from the other side, so it's checked against what's actually there
+			if header.Size < 0 || header.Size > int64(len(data)) {
+				return messages, fmt.Errorf("%v claims to be %v bytes", header.Name, header.Size)
+			}
+
+			message.Type = MessageTypeWrite
+			message.Data, err = io.ReadAll(reader)
+			if err != nil {
+				return messages, err
+			}
+		default:
+			return messages, fmt.Errorf("%v is of an unsupported type %v", header.Name, header.Typeflag)
+		}
+
+		rawBaseSum, ok := header.PAXRecords[archiveBaseSumRecord]
+		if ok {
+			baseSum, err := hex.DecodeString(rawBaseSum)
+			if err != nil || len(baseSum) != len(message.BaseSum) {
+				return messages, fmt.Errorf("%v has a bad base sum %#+v", header.Name, rawBaseSum)
+			}
+
+			message.HasBase = true
+			copy(message.BaseSum[:], baseSum)
+		}
+
+		messages = append(messages, &message)
+	}
+}
+
+// stageArchive stages each of the messages in an archive as if it had been sent on its own
+func (r *Receiver) stageArchive(b *batch, message *Message) error {
+	messages, err := readArchive(message.Data)
+
+	message.Data = nil
+
+	for _, archivedMessage := range messages {
+		checkErr := r.checkMessage(archivedMessage)
+		if checkErr != nil {
+			b.addRejection(archivedMessage, checkErr)
+			continue
+		}
+
+		stageErr := r.stage(b, archivedMessage)
+		if stageErr != nil {
+			b.addError(archivedMessage, stageErr)
+		}
+	}
+
+	return err
+}
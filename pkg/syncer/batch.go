@@ -0,0 +1,485 @@
+package syncer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// tempFileSuffix is on the temp files that incoming content is staged in (they're always ignored)
+	tempFileSuffix = ".syncer-tmp"
+	// stagingFolderName is the folder (in the index folder) for temp files that can't go in the folder they're going to
+	// until the commit (see Receiver.getTempFolderPath)
+	stagingFolderName = "staging"
+)
+
+// stagedChange is a change that's been received but not applied yet; for anything with content, the content is already
+// in a temp file in the folder it's going to (so applying it is just a rename)
+type stagedChange struct {
+	message  *Message
+	path     string
+	tempPath string
+	sum      [16]byte
+	replaces bool // a mkdir where there's something other than a folder now
+	// trashName is the folder in the trash that anything this deletes or replaces goes to (see Trash)
+	trashName string
+	// renames are what applying it renamed (from, to), for the tree to follow (see Receiver.updateTree)
+	renames [][2]string
+}
+
+// folderTime is the modified time a folder should end up with once a batch is applied; relativePath is only set if
+// the time came from the other side (rather than being what the folder had before the batch got to it)
+type folderTime struct {
+	relativePath string
+	modified     time.Time
+}
+
+// batch is everything received up to a commit (i.e. one debounce window's worth of changes from the other side); it's
+// all applied at the commit so that anything watching this side never sees a half-written file or half a change
+type batch struct {
+	changes          []*stagedChange
+	stream           *stagedStream
+	folderTimeByPath map[string]*folderTime
+	errs             []string
+	failed           []string
+	conflicts        []string
+}
+
+func (b *batch) addError(message *Message, err error) {
+	log.Printf("warning: attempt to apply %v %v caused %v", message.Type, message.Path, err)
+	b.errs = append(b.errs, fmt.Sprintf("%v %v: %v", message.Type, message.Path, err))
+	b.failed = append(b.failed, message.Path)
+}
+
+// addRejection is for a message that would have touched something outside the tree (see Receiver.checkMessage)
+func (b *batch) addRejection(message *Message, err error) {
+	log.Printf("warning: rejected %v %#+v from the other side as %v", message.Type, message.Path, err)
+	b.errs = append(b.errs, fmt.Sprintf("%v %v: rejected as %v", message.Type, message.Path, err))
+	b.failed = append(b.failed, message.Path)
+}
+
+func (b *batch) addConflict(conflict string) {
+	log.Printf("warning: conflict: %v", conflict)
+	b.conflicts = append(b.conflicts, conflict)
+}
+
+// affects is true if path is at or under something that a staged move, delete or mkdir (of something that isn't a
+// folder yet) is going to change, in which case the folder path is in isn't where it'll be until the commit
+func (b *batch) affects(path string, getPath func(string) string) bool {
+	for _, change := range b.changes {
+		switch change.message.Type {
+		case MessageTypeDelete:
+			if isUnderAnyPath(path, []string{change.path}) {
+				return true
+			}
+		case MessageTypeMove:
+			if isUnderAnyPath(path, []string{change.path, getPath(change.message.FromPath)}) {
+				return true
+			}
+		case MessageTypeMkdir:
+			if change.replaces && isUnderAnyPath(path, []string{change.path}) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// getBasePath is where whatever will be at path once b is committed is now (going back through the staged moves, or to
+// the temp file of a staged write to path), or "" if there won't be anything there; it's what a delta to path has to be
+// made against, as that's only applied at the commit
+func (b *batch) getBasePath(path string, getPath func(string) string) string {
+	for i := len(b.changes) - 1; i >= 0; i-- {
+		change := b.changes[i]
+
+		switch change.message.Type {
+		case MessageTypeDelete:
+			if isUnderAnyPath(path, []string{change.path}) {
+				return ""
+			}
+		case MessageTypeMove:
+			fromPath := getPath(change.message.FromPath)
+			if isUnderAnyPath(path, []string{change.path}) {
+				path = fromPath + strings.TrimPrefix(path, change.path)
+			} else if isUnderAnyPath(path, []string{fromPath}) {
+				return ""
+			}
+		case MessageTypeMkdir:
+			if change.replaces && isUnderAnyPath(path, []string{change.path}) {
+				return ""
+			}
+		default:
+			if path == change.path && change.tempPath != "" {
+				return change.tempPath
+			}
+
+			if isUnderAnyPath(path, []string{change.path}) && path != change.path { // a folder replaced by a file
+				return ""
+			}
+		}
+	}
+
+	return path
+}
+
+func (b *batch) setFolderTime(path string, relativePath string, modified time.Time) {
+	if b.folderTimeByPath == nil {
+		b.folderTimeByPath = make(map[string]*folderTime)
+	}
+
+	b.folderTimeByPath[path] = &folderTime{relativePath: relativePath, modified: modified}
+}
+
+// keepFolderTime notes the modified time of the folder that path is in (unless it's already noted), so that it can be
+// put back once the batch has been applied; otherwise the temp files and so on would change it; if that folder isn't
+// there yet, it's the nearest one up that is (as that's what making it changes)
+func (b *batch) keepFolderTime(path string) {
+	folderPath := filepath.Dir(path)
+
+	info, err := os.Lstat(folderPath)
+	for os.IsNotExist(err) && filepath.Dir(folderPath) != folderPath {
+		folderPath = filepath.Dir(folderPath)
+		info, err = os.Lstat(folderPath)
+	}
+
+	if err != nil || !info.IsDir() {
+		return
+	}
+
+	_, ok := b.folderTimeByPath[folderPath]
+	if ok {
+		return
+	}
+
+	b.setFolderTime(folderPath, "", info.ModTime())
+}
+
+// merge adds the changes of other (staged on another conn, to be applied with b) after b's own
+func (b *batch) merge(other *batch) {
+	if other.stream != nil {
+		other.stream.discard()
+		b.addError(other.stream.change.message, fmt.Errorf("it was cut short by a hand off"))
+		other.stream = nil
+	}
+
+	b.changes = append(b.changes, other.changes...)
+
+	// note: the batches were staged at the same time, so a folder's time may have already been changed by one by the
+	// time another noted it; the earliest is the one it had before any of them (unless it came from the other side)
+	for folderPath, t := range other.folderTimeByPath {
+		existing, ok := b.folderTimeByPath[folderPath]
+		if ok && (existing.relativePath != "" || t.relativePath == "" && !t.modified.Before(existing.modified)) {
+			continue
+		}
+
+		b.setFolderTime(folderPath, t.relativePath, t.modified)
+	}
+
+	b.errs = append(b.errs, other.errs...)
+	b.failed = append(b.failed, other.failed...)
+	b.conflicts = append(b.conflicts, other.conflicts...)
+}
+
+// discard removes any temp files that weren't used
+func (b *batch) discard() {
+	if b.stream != nil {
+		b.stream.discard()
+		b.stream = nil
+	}
+
+	for _, change := range b.changes {
+		if change.tempPath == "" {
+			continue
+		}
+
+		_ = os.Remove(change.tempPath)
+		change.tempPath = ""
+	}
+}
+
+// getTempFolderPath is the folder that the temp file for the content path is going to have goes in; that's the folder
+// path is in (so that applying it is a rename in the same folder), unless something staged in b is going to change that
+// folder first (e.g. it's being moved, deleted or made where there's a file now), in which case it's the staging folder
+func (r *Receiver) getTempFolderPath(b *batch, path string) string {
+	if b.affects(path, r.getPath) {
+		return filepath.Join(r.remotePath, indexFolderName, stagingFolderName)
+	}
+
+	return filepath.Dir(path)
+}
+
+// createTempFile creates a temp file in folderPath (for the content path is going to have)
+func createTempFile(folderPath string, path string) (*os.File, error) {
+	err := os.MkdirAll(folderPath, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(folderPath, "."+filepath.Base(path)+".*"+tempFileSuffix)
+}
+
+// finishTempFile closes f (made by createTempFile) and gives it the mode and modified time the file should end up with
+// (so that once it's renamed into place there's nothing left to do); f is removed if that doesn't work out
+func (r *Receiver) finishTempFile(f *os.File, message *Message) (string, error) {
+	var err error
+
+	if r.fsync {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	mode := message.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+
+	err = os.Chmod(f.Name(), mode)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	if !message.Modified.IsZero() {
+		err = os.Chtimes(f.Name(), message.Modified, message.Modified)
+		if err != nil {
+			_ = os.Remove(f.Name())
+			return "", err
+		}
+	}
+
+	return f.Name(), nil
+}
+
+// writeTempFile writes data to a temp file in folderPath (see finishTempFile)
+func (r *Receiver) writeTempFile(folderPath string, path string, message *Message, data []byte) (string, error) {
+	f, err := createTempFile(folderPath, path)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+
+	return r.finishTempFile(f, message)
+}
+
+// makeTempSymlink makes a symlink to message.Target with a temp name in folderPath (symlinks keep the modified time they
+// were made with, as setting it would follow them)
+func (r *Receiver) makeTempSymlink(folderPath string, path string, message *Message) (string, error) {
+	// note: the temp file is only to get a name that's free
+	f, err := createTempFile(folderPath, path)
+	if err != nil {
+		return "", err
+	}
+
+	_ = f.Close()
+
+	err = os.Remove(f.Name())
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Symlink(message.Target, f.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// stage keeps message to be applied at the commit; anything with content has the content worked out and written to a
+// temp file now (which also means a delta is applied to the same copy its signatures came from); nothing is applied
+// until the commit, so that's worked out against what'll be there once everything staged before it has been applied
+func (r *Receiver) stage(b *batch, message *Message) error {
+	change := stagedChange{
+		message: message,
+		path:    r.getPath(message.Path),
+	}
+
+	switch message.Type {
+
+	case MessageTypeWrite, MessageTypeDelta, MessageTypeChunkedWrite, MessageTypeSymlink:
+
+	case MessageTypeMkdir:
+		info, err := os.Lstat(change.path)
+		change.replaces = err == nil && !info.IsDir()
+
+		b.keepFolderTime(change.path)
+
+		if !message.Modified.IsZero() {
+			b.setFolderTime(change.path, message.Path, message.Modified)
+		}
+
+		b.changes = append(b.changes, &change)
+		return nil
+
+	default:
+		b.keepFolderTime(change.path)
+		if message.Type == MessageTypeMove {
+			b.keepFolderTime(r.getPath(message.FromPath))
+		}
+
+		b.changes = append(b.changes, &change)
+		return nil
+
+	}
+
+	b.keepFolderTime(change.path)
+
+	var data []byte
+	var err error
+
+	switch message.Type {
+	case MessageTypeWrite:
+		data = message.Data
+	case MessageTypeDelta:
+		basePath := b.getBasePath(change.path, r.getPath)
+		if basePath == "" {
+			return fmt.Errorf("there's nothing for it to be applied to once the changes before it are")
+		}
+
+		var base []byte
+
+		base, err = os.ReadFile(basePath)
+		if err != nil {
+			return err
+		}
+
+		data, err = applyDelta(base, message.BlockSize, message.Ops)
+		if err != nil {
+			return err
+		}
+
+		// note: the copy it was made against may have changed since the signatures were sent
+		if getStrongChecksum(data) != message.Sum {
+			return fmt.Errorf("it didn't come out as expected (the copy it was made against must have changed)")
+		}
+	case MessageTypeChunkedWrite:
+		data, err = r.getChunkedData(message)
+		if err != nil {
+			return err
+		}
+	}
+
+	tempFolderPath := r.getTempFolderPath(b, change.path)
+
+	if message.Type == MessageTypeSymlink {
+		change.sum = getStrongChecksum([]byte(message.Target))
+		change.tempPath, err = r.makeTempSymlink(tempFolderPath, change.path, message)
+	} else {
+		change.sum = getStrongChecksum(data)
+		change.tempPath, err = r.writeTempFile(tempFolderPath, change.path, message, data)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// note: the content is in the temp file now
+	message.Data = nil
+	message.Ops = nil
+	message.Chunks = nil
+
+	b.changes = append(b.changes, &change)
+
+	return nil
+}
+
+// commit applies everything staged so far, in the order it was received
+func (r *Receiver) commit(b *batch) {
+	folderPaths := make(map[string]bool)
+
+	trashName := getTrashName(time.Now())
+
+	for _, change := range b.changes {
+		staged := change.tempPath != ""
+
+		change.trashName = trashName
+
+		conflict, err := r.apply(change)
+		if conflict != "" {
+			b.addConflict(conflict)
+		}
+
+		r.updateTree(change)
+
+		if err != nil {
+			b.addError(change.message, err)
+		}
+
+		if staged && change.tempPath == "" {
+			folderPaths[filepath.Dir(change.path)] = true
+		}
+	}
+
+	b.discard()
+	b.changes = nil
+
+	// note: this goes last, as everything else changes the modified times of the folders it happens in
+	for folderPath, t := range b.folderTimeByPath {
+		info, err := os.Lstat(folderPath)
+		if err != nil || !info.IsDir() { // e.g. it's been deleted
+			continue
+		}
+
+		err = os.Chtimes(folderPath, t.modified, t.modified)
+		if err != nil {
+			log.Printf("warning: attempt to set the modified time of %v caused %v", folderPath, err)
+			continue
+		}
+
+		if r.syncState != nil && t.relativePath != "" {
+			info, err = os.Lstat(folderPath)
+			if err == nil {
+				r.syncState.set(t.relativePath, getSyncRecord([16]byte{}, info))
+			}
+		}
+	}
+
+	b.folderTimeByPath = nil
+
+	if !r.fsync {
+		return
+	}
+
+	// note: the renames aren't durable until the folders they happened in are synced too
+	for folderPath := range folderPaths {
+		err := syncFolder(folderPath)
+		if err != nil {
+			log.Printf("warning: attempt to sync %v caused %v", folderPath, err)
+		}
+	}
+}
+
+func syncFolder(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return f.Sync()
+}
@@ -0,0 +1,92 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReceiverStagesAgainstWhatsStaged(t *testing.T) {
+	l := getLoopback(t, 1)
+
+	base := getTestData(8, 64*1024)
+	edited := join(base[:1000], []byte("changed"), base[2000:])
+
+	writeTestFile(t, filepath.Join(l.localPath, "old", "a.bin"), string(base))
+	writeTestFile(t, filepath.Join(l.localPath, "x", "y.txt"), "y")
+	writeTestFile(t, filepath.Join(l.localPath, "f"), "f")
+	l.sync(t)
+
+	conn, err := l.sender.getConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.send(&Message{Type: MessageTypeMove, Path: "new", FromPath: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// note: new/a.bin is still old/a.bin until the commit, so that's what the signatures have to be of
+	response, err := conn.request(&Message{Type: MessageTypeSignatures, Path: "new/a.bin", BlockSize: minDeltaBlockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Signatures) != len(getSignatures(base, minDeltaBlockSize)) {
+		t.Fatalf("got %v signatures; wanted those of old/a.bin", len(response.Signatures))
+	}
+
+	_, err = os.Lstat(filepath.Join(l.remotePath, "old", "a.bin"))
+	if err != nil {
+		t.Errorf("the move was applied before the commit (%v)", err)
+	}
+
+	ops, _ := getDelta(edited, minDeltaBlockSize, response.Signatures)
+
+	for _, message := range []*Message{
+		{Type: MessageTypeDelta, Path: "new/a.bin", BlockSize: minDeltaBlockSize, Ops: ops, Sum: getStrongChecksum(edited)},
+		{Type: MessageTypeDelete, Path: "x"},
+		{Type: MessageTypeWrite, Path: "x/z.txt", Data: []byte("z")},
+		{Type: MessageTypeMkdir, Path: "f"},
+		{Type: MessageTypeWrite, Path: "f/g.txt", Data: []byte("g")},
+	} {
+		err = conn.send(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	response, err = conn.request(&Message{Type: MessageTypeCommit})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Failed) != 0 {
+		t.Errorf("%v failed; wanted none", response.Failed)
+	}
+
+	tree := getTestTree(t, l.remotePath)
+
+	for relativePath, want := range map[string]string{
+		"new":       "/",
+		"new/a.bin": string(edited),
+		"x":         "/",
+		"x/z.txt":   "z",
+		"f":         "/",
+		"f/g.txt":   "g",
+	} {
+		if tree[relativePath] != want {
+			t.Errorf("%v is %v bytes on the remote; wanted %v", relativePath, len(tree[relativePath]), len(want))
+		}
+	}
+
+	if len(tree) != 6 {
+		t.Errorf("the remote has %v things; wanted 6", len(tree))
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(l.remotePath, indexFolderName, stagingFolderName))
+	if len(entries) != 0 {
+		t.Errorf("%v temp files were left in the staging folder", len(entries))
+	}
+}
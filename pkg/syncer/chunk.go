@@ -0,0 +1,274 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultChunkThreshold = 16 * 1024
+	DefaultChunkStoreSize = 1024 * 1024 * 1024
+	chunkFolderName       = "chunks"
+	minChunkSize          = 2 * 1024
+	avgChunkSize          = 8 * 1024
+	maxChunkSize          = 64 * 1024
+	// note: these are the FastCDC masks for an 8 KiB average; the harder one is used before the average size and the
+	// easier one after, which keeps the chunk sizes close to the average
+	chunkMaskHard = uint64(0x0003590703530000)
+	chunkMaskEasy = uint64(0x0000d90003530000)
+)
+
+type ChunkID [32]byte
+
+func (c ChunkID) String() string {
+	return hex.EncodeToString(c[:])
+}
+
+type ChunkData struct {
+	ID   ChunkID
+	Data []byte
+}
+
+var chunkGear [256]uint64
+
+func init() {
+	// note: the table just has to be random looking and the same every time (so the same content makes the same chunks)
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range chunkGear {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		chunkGear[i] = z ^ (z >> 31)
+	}
+}
+
+// getNextChunkSize is FastCDC; it finds the end of the chunk at the start of data going only by the content, so an
+// edit only changes the chunks around it
+func getNextChunkSize(data []byte) int {
+	size := len(data)
+	if size <= minChunkSize {
+		return size
+	}
+
+	if size > maxChunkSize {
+		size = maxChunkSize
+	}
+
+	normalSize := avgChunkSize
+	if size < normalSize {
+		normalSize = size
+	}
+
+	fingerprint := uint64(0)
+
+	i := minChunkSize
+	for ; i < normalSize; i++ {
+		fingerprint = (fingerprint << 1) + chunkGear[data[i]]
+		if fingerprint&chunkMaskHard == 0 {
+			return i + 1
+		}
+	}
+
+	for ; i < size; i++ {
+		fingerprint = (fingerprint << 1) + chunkGear[data[i]]
+		if fingerprint&chunkMaskEasy == 0 {
+			return i + 1
+		}
+	}
+
+	return size
+}
+
+func getChunks(data []byte) []ChunkData {
+	chunks := make([]ChunkData, 0, len(data)/avgChunkSize+1)
+
+	for offset := 0; offset < len(data); {
+		size := getNextChunkSize(data[offset:])
+
+		chunks = append(chunks, ChunkData{
+			ID:   sha256.Sum256(data[offset : offset+size]),
+			Data: data[offset : offset+size],
+		})
+
+		offset += size
+	}
+
+	return chunks
+}
+
+// ChunkStore keeps chunks by their hash so that content the receiver has seen before doesn't have to be sent again;
+// the least recently used chunks are thrown away once it gets bigger than maxSize
+type ChunkStore struct {
+	mu      sync.Mutex
+	path    string
+	size    int64
+	maxSize int64
+}
+
+func GetChunkStore(path string, maxSize int64) (*ChunkStore, error) {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	c := ChunkStore{
+		path:    path,
+		maxSize: maxSize,
+	}
+
+	for _, chunk := range c.getStoredChunks() {
+		c.size += chunk.size
+	}
+
+	return &c, nil
+}
+
+func (c *ChunkStore) getPath(id ChunkID) string {
+	name := id.String()
+	return filepath.Join(c.path, name[:2], name)
+}
+
+// has also counts as a use (as the sender is about to refer to it)
+func (c *ChunkStore) has(id ChunkID) bool {
+	now := time.Now()
+	err := os.Chtimes(c.getPath(id), now, now)
+	return err == nil
+}
+
+func (c *ChunkStore) put(id ChunkID, data []byte) error {
+	if sha256.Sum256(data) != id {
+		return fmt.Errorf("chunk %v doesn't match its data", id)
+	}
+
+	path := c.getPath(id)
+
+	_, err := os.Stat(path)
+	if err == nil {
+		return nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), id.String()+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	c.size += int64(len(data))
+	c.mu.Unlock()
+
+	return nil
+}
+
+func (c *ChunkStore) get(id ChunkID) ([]byte, error) {
+	path := c.getPath(id)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// note: the modified time is when it was last used, which is what prune goes by
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+
+	return data, nil
+}
+
+type storedChunk struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+func (c *ChunkStore) getStoredChunks() []*storedChunk {
+	storedChunks := make([]*storedChunk, 0)
+
+	_ = filepath.WalkDir(c.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		storedChunks = append(storedChunks, &storedChunk{path: path, size: info.Size(), modified: info.ModTime()})
+
+		return nil
+	})
+
+	return storedChunks
+}
+
+func (c *ChunkStore) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= c.maxSize {
+		return
+	}
+
+	storedChunks := c.getStoredChunks()
+
+	size := int64(0)
+	for _, chunk := range storedChunks {
+		size += chunk.size
+	}
+
+	sort.Slice(storedChunks, func(i, j int) bool {
+		return storedChunks[i].modified.Before(storedChunks[j].modified)
+	})
+
+	pruned := 0
+	for _, chunk := range storedChunks {
+		if size <= c.maxSize {
+			break
+		}
+
+		err := os.Remove(chunk.path)
+		if err != nil {
+			continue
+		}
+
+		size -= chunk.size
+		pruned++
+	}
+
+	c.size = size
+
+	log.Printf("pruned %v chunks from %v to get it under %v bytes", pruned, c.path, c.maxSize)
+}
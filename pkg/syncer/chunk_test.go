@@ -0,0 +1,190 @@
+package syncer
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetChunksRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, minChunkSize, minChunkSize + 1, avgChunkSize, maxChunkSize * 3, 1024*1024 + 7} {
+		data := getTestData(int64(size), size)
+
+		chunks := getChunks(data)
+
+		joined := make([]byte, 0, len(data))
+		for i, chunk := range chunks {
+			if len(chunk.Data) > maxChunkSize {
+				t.Errorf("%v bytes: chunk %v is %v bytes; wanted no more than %v", size, i, len(chunk.Data), maxChunkSize)
+			}
+
+			if len(chunk.Data) < minChunkSize && i < len(chunks)-1 {
+				t.Errorf("%v bytes: chunk %v is %v bytes; only the last can be under %v", size, i, len(chunk.Data), minChunkSize)
+			}
+
+			joined = append(joined, chunk.Data...)
+		}
+
+		if !bytes.Equal(joined, data) {
+			t.Errorf("%v bytes: the chunks came out as %v bytes that differ", size, len(joined))
+		}
+	}
+}
+
+func TestGetChunksAfterAnEdit(t *testing.T) {
+	data := getTestData(1, 1024*1024)
+
+	idsBefore := make(map[ChunkID]bool)
+	for _, chunk := range getChunks(data) {
+		idsBefore[chunk.ID] = true
+	}
+
+	// note: the chunks are cut by content, so an insert only changes the chunks around it (rather than all after it)
+	edited := join(data[:500000], []byte("an insert"), data[500000:])
+
+	newBytes := 0
+	for _, chunk := range getChunks(edited) {
+		if !idsBefore[chunk.ID] {
+			newBytes += len(chunk.Data)
+		}
+	}
+
+	if newBytes > 2*maxChunkSize {
+		t.Errorf("%v bytes were in new chunks; wanted no more than %v", newBytes, 2*maxChunkSize)
+	}
+}
+
+func TestChunkStoreRoundTrip(t *testing.T) {
+	c, err := GetChunkStore(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := getChunks(getTestData(2, 256*1024))
+
+	for _, chunk := range chunks {
+		if c.has(chunk.ID) {
+			t.Errorf("%v was there before it was put", chunk.ID)
+		}
+
+		err = c.put(chunk.ID, chunk.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = c.put(chunk.ID, chunk.Data) // note: again is fine
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, chunk := range chunks {
+		if !c.has(chunk.ID) {
+			t.Errorf("%v wasn't there after it was put", chunk.ID)
+		}
+
+		data, err := c.get(chunk.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(data, chunk.Data) {
+			t.Errorf("%v came back different", chunk.ID)
+		}
+	}
+
+	err = c.put(chunks[0].ID, chunks[1].Data)
+	if err == nil {
+		t.Errorf("a chunk that doesn't match its ID was put")
+	}
+}
+
+func TestChunkStorePrune(t *testing.T) {
+	path := t.TempDir()
+
+	chunks := getChunks(getTestData(3, 512*1024))
+
+	c, err := GetChunkStore(path, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, chunk := range chunks {
+		err = c.put(chunk.ID, chunk.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// note: the oldest are used first (so they go first)
+		used := time.Now().Add(-time.Hour).Add(time.Duration(i) * time.Second)
+		err = os.Chtimes(c.getPath(chunk.ID), used, used)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.maxSize = 256 * 1024
+	c.prune()
+
+	if c.size > c.maxSize {
+		t.Errorf("it was %v bytes after a prune; wanted no more than %v", c.size, c.maxSize)
+	}
+
+	if c.has(chunks[0].ID) {
+		t.Errorf("the least recently used chunk was kept")
+	}
+
+	if !c.has(chunks[len(chunks)-1].ID) {
+		t.Errorf("the most recently used chunk was pruned")
+	}
+
+	// note: the size is worked out again from what's there on the next start
+	c, err = GetChunkStore(path, 256*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.size > 256*1024 {
+		t.Errorf("it was %v bytes after a restart; wanted no more than %v", c.size, 256*1024)
+	}
+}
+
+func TestSenderToReceiverWithChunks(t *testing.T) {
+	l := getLoopback(t, 1)
+	l.sender.chunking = true
+	l.sender.chunkThreshold = DefaultChunkThreshold
+
+	var err error
+
+	l.receiver.chunkStore, err = GetChunkStore(filepath.Join(l.remotePath, indexFolderName, chunkFolderName), DefaultChunkStoreSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := getTestData(4, 1024*1024)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.bin"), string(data))
+
+	stats := l.syncWithStats(t)
+	if stats.chunkedFiles != 1 {
+		t.Errorf("sent %v files as chunks; wanted 1", stats.chunkedFiles)
+	}
+
+	requireSameTree(t, l.localPath, l.remotePath)
+
+	// note: a copy (and an edit) only has to send what the other side hasn't seen before
+	writeTestFile(t, filepath.Join(l.localPath, "copy", "b.bin"), string(join(data[:500000], []byte("an insert"), data[500000:])))
+
+	stats = l.syncWithStats(t)
+	if stats.chunkedFiles != 1 {
+		t.Errorf("sent %v files as chunks; wanted 1", stats.chunkedFiles)
+	}
+
+	if stats.newChunkedBytes > 2*maxChunkSize {
+		t.Errorf("sent %v bytes of new chunks; wanted no more than %v", stats.newChunkedBytes, 2*maxChunkSize)
+	}
+
+	requireSameTree(t, l.localPath, l.remotePath)
+}
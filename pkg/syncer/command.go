@@ -0,0 +1,222 @@
+package syncer
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRemoteCommand is how the receiver is started on the other side when there's no port to connect to;
+	// {host} is -remoteHost and {command} is the syncer command line to run there (as one word, quoted for a shell)
+	DefaultRemoteCommand = "ssh {host} {command}"
+	DefaultRemoteSyncer  = "syncer"
+	commandCloseTimeout  = time.Second * 5
+)
+
+var safeShellWord = regexp.MustCompile(`^[A-Za-z0-9_./:=,@%+-]+$`)
+
+// shellQuote quotes word for a POSIX shell (which is what ssh hands the command to on the other side)
+func shellQuote(word string) string {
+	if safeShellWord.MatchString(word) {
+		return word
+	}
+
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// GetRemoteCommand returns the command line that runs syncerPath with args on host, going by template (see
+// DefaultRemoteCommand); the words of template are split on whitespace
+func GetRemoteCommand(template string, host string, syncerPath string, args []string) ([]string, error) {
+	quotedWords := []string{syncerPath}
+	for _, arg := range args {
+		quotedWords = append(quotedWords, shellQuote(arg))
+	}
+
+	command := strings.Join(quotedWords, " ")
+
+	remoteCommand := make([]string, 0)
+	hasCommand := false
+
+	for _, word := range strings.Fields(template) {
+		if word == "{command}" {
+			remoteCommand = append(remoteCommand, command)
+			hasCommand = true
+			continue
+		}
+
+		remoteCommand = append(remoteCommand, strings.ReplaceAll(word, "{host}", host))
+	}
+
+	if !hasCommand {
+		return nil, fmt.Errorf("%#+v has no {command} in it", template)
+	}
+
+	return remoteCommand, nil
+}
+
+// getRemoteReceiverArgs are the args for a syncer -receive -stdio on the other side that receives the way config says
+func getRemoteReceiverArgs(config Config) []string {
+	return []string{
+		"-receive",
+		"-stdio",
+		"-remotePath", config.RemotePath,
+		"-compression", string(config.Compression),
+		"-chunkStoreSize", fmt.Sprintf("%v", config.ChunkStoreSize),
+		fmt.Sprintf("-fsync=%v", config.Fsync),
+		fmt.Sprintf("-refuseOutsideSymlinks=%v", config.RefuseOutsideSymlinks),
+		fmt.Sprintf("-trash=%v", config.Trash),
+		"-trashMaxAge", config.TrashMaxAge.String(),
+		"-trashMaxSize", fmt.Sprintf("%v", config.TrashMaxSize),
+		"-ignoreFolders", strings.Join(config.FoldersToIgnore, ","),
+		"-ignoreFiles", strings.Join(config.FilesToIgnore, ","),
+	}
+}
+
+// commandConn is a conn over the stdin / stdout of a command (e.g. ssh running syncer -receive -stdio on the other
+// side); the command's stderr is passed through, so the other side's logs end up in ours
+type commandConn struct {
+	mu        sync.Mutex
+	cmd       *exec.Cmd
+	stdin     *os.File
+	stdout    *os.File
+	done      chan bool
+	closeOnce sync.Once
+	closed    bool
+}
+
+func startCommand(command []string) (*commandConn, error) {
+	// note: our own pipes (rather than cmd.StdinPipe etc), so that cmd.Wait doesn't close them under a read
+	stdinReader, stdinWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		_ = stdinReader.Close()
+		_ = stdinWriter.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = stdinReader
+	cmd.Stdout = stdoutWriter
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+
+	// note: the command has its own copies of these now (if it started at all)
+	_ = stdinReader.Close()
+	_ = stdoutWriter.Close()
+
+	if err != nil {
+		_ = stdinWriter.Close()
+		_ = stdoutReader.Close()
+		return nil, err
+	}
+
+	c := commandConn{
+		cmd:    cmd,
+		stdin:  stdinWriter,
+		stdout: stdoutReader,
+		done:   make(chan bool),
+	}
+
+	go c.wait()
+
+	return &c, nil
+}
+
+func (c *commandConn) wait() {
+	err := c.cmd.Wait()
+
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+
+	if err != nil && !closed {
+		log.Printf("warning: %v exited with %v", c.cmd.Args[0], err)
+	}
+
+	close(c.done)
+}
+
+func (c *commandConn) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *commandConn) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+// Close lets the command finish (it exits once its stdin closes), killing it if it doesn't do so in time
+func (c *commandConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+
+		_ = c.stdin.Close()
+
+		select {
+		case <-c.done:
+		case <-time.After(commandCloseTimeout):
+			_ = c.cmd.Process.Kill()
+			<-c.done
+		}
+
+		_ = c.stdout.Close()
+	})
+
+	return nil
+}
+
+// stdioConn is the other end of a commandConn (i.e. this process is the command)
+type stdioConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (c stdioConn) Close() error {
+	_ = os.Stdout.Close()
+	return os.Stdin.Close()
+}
+
+// serveStdio receives over stdin / stdout until the other side closes it
+func (r *Receiver) serveStdio() error {
+	conn := GetConn(stdioConn{Reader: os.Stdin, Writer: os.Stdout})
+
+	if !r.addConn(conn) {
+		_ = conn.Close()
+		return nil
+	}
+
+	defer func() {
+		r.removeConn(conn)
+		_ = conn.Close()
+	}()
+
+	log.Printf("receiving into %v over stdin / stdout", r.remotePath)
+
+	reverse, err := r.handleHello(conn)
+	if err == nil && reverse {
+		err = fmt.Errorf("there's only the one conn over stdin / stdout, so changes can't be sent back over another")
+	}
+
+	if err == nil {
+		err = r.handleConn(conn)
+	}
+
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,304 @@
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/initialed85/syncer/internal/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+type Compression string
+
+const (
+	// CompressionAuto uses whichever of the codecs both sides have (zstd first)
+	CompressionAuto Compression = "auto"
+	CompressionZstd Compression = "zstd" // smaller
+	CompressionLZ4  Compression = "lz4"  // faster
+	CompressionNone Compression = "none"
+)
+
+var Compressions = []Compression{
+	CompressionAuto,
+	CompressionZstd,
+	CompressionLZ4,
+	CompressionNone,
+}
+
+const (
+	// maxFrameSize is how much is compressed at once (a flush is usually less)
+	maxFrameSize = 1024 * 1024
+	frameKindRaw = byte(0)
+	// note: a compressed frame is compressed with whatever codec was agreed on in the hello
+	frameKindCompressed = byte(1)
+)
+
+// incompressibleExtensions are the files that are already compressed (so compressing them again is a waste of time)
+var incompressibleExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avif": true, ".br": true, ".bz2": true, ".deb": true, ".docx": true, ".flac": true,
+	".gif": true, ".gz": true, ".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".lz4": true, ".m4a": true,
+	".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".ogg": true, ".pdf": true, ".png": true, ".pptx": true,
+	".rar": true, ".rpm": true, ".tgz": true, ".webm": true, ".webp": true, ".whl": true, ".woff": true, ".woff2": true,
+	".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+func isCompressible(path string) bool {
+	return !incompressibleExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// getOfferedCompressions is what a sender set to compression asks for in its hello (most wanted first)
+func getOfferedCompressions(compression Compression) []Compression {
+	switch compression {
+	case CompressionAuto:
+		return []Compression{CompressionZstd, CompressionLZ4}
+	case CompressionNone:
+		return nil
+	}
+
+	return []Compression{compression}
+}
+
+// pickCompression is what a receiver set to compression agrees to out of offered (CompressionNone if nothing suits)
+func pickCompression(compression Compression, offered []Compression) Compression {
+	for _, possibleCompression := range offered {
+		if possibleCompression == CompressionNone || possibleCompression == CompressionAuto {
+			continue
+		}
+
+		if compression == CompressionAuto || compression == possibleCompression {
+			return possibleCompression
+		}
+	}
+
+	return CompressionNone
+}
+
+type codec interface {
+	// compress returns src compressed, or nil if it doesn't get any smaller
+	compress(src []byte) []byte
+	decompress(src []byte, size int) ([]byte, error)
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *zstdCodec) compress(src []byte) []byte {
+	dst := c.encoder.EncodeAll(src, nil)
+	if len(dst) >= len(src) {
+		return nil
+	}
+
+	return dst
+}
+
+func (c *zstdCodec) decompress(src []byte, size int) ([]byte, error) {
+	return c.decoder.DecodeAll(src, make([]byte, 0, size))
+}
+
+type lz4Codec struct {
+	compressor lz4.Compressor
+}
+
+func (c *lz4Codec) compress(src []byte) []byte {
+	dst := make([]byte, lz4.CompressBlockBound(len(src)))
+
+	n, err := c.compressor.CompressBlock(src, dst)
+	if err != nil || n == 0 || n >= len(src) {
+		return nil
+	}
+
+	return dst[:n]
+}
+
+func (c *lz4Codec) decompress(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, size)
+
+	n, err := lz4.UncompressBlock(src, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	return dst[:n], nil
+}
+
+func getCodec(compression Compression) (codec, error) {
+	switch compression {
+
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if err != nil {
+			return nil, err
+		}
+
+		decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxFrameSize))
+		if err != nil {
+			return nil, err
+		}
+
+		return &zstdCodec{encoder: encoder, decoder: decoder}, nil
+
+	case CompressionLZ4:
+		return &lz4Codec{}, nil
+
+	}
+
+	return nil, fmt.Errorf("unsupported compression %#+v", compression)
+}
+
+// frameWriter compresses what's written to it a frame at a time (each frame being a header of the kind, the size
+// and the compressed size, then the frame itself); a frame ends on a flush or once it's maxFrameSize
+type frameWriter struct {
+	writer io.Writer
+	codec  codec
+	buf    bytes.Buffer
+	raw    bool
+	header [1 + binary.MaxVarintLen64*2]byte
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		n := maxFrameSize - w.buf.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+
+		_, _ = w.buf.Write(p[:n])
+		p = p[n:]
+		written += n
+
+		if w.buf.Len() >= maxFrameSize {
+			err := w.Flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// setRaw ends the frame so far and has whatever comes next sent as it is (until setRaw(false))
+func (w *frameWriter) setRaw(raw bool) error {
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+
+	w.raw = raw
+
+	return nil
+}
+
+func (w *frameWriter) Flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+
+	data := w.buf.Bytes()
+
+	kind := frameKindRaw
+	if !w.raw {
+		compressedData := w.codec.compress(data)
+		if compressedData != nil {
+			kind = frameKindCompressed
+			data = compressedData
+		}
+	}
+
+	utils.DebugLog("conn", "frame", fmt.Sprintf("%v bytes as %v bytes", w.buf.Len(), len(data)))
+
+	w.header[0] = kind
+	n := 1
+	n += binary.PutUvarint(w.header[n:], uint64(w.buf.Len()))
+	n += binary.PutUvarint(w.header[n:], uint64(len(data)))
+
+	_, err := w.writer.Write(w.header[:n])
+	if err == nil {
+		_, err = w.writer.Write(data)
+	}
+
+	w.buf.Reset()
+
+	return err
+}
+
+// frameReader is the other end of a frameWriter
+type frameReader struct {
+	reader *bufio.Reader
+	codec  codec
+	frame  []byte
+}
+
+func (r *frameReader) readFrame() error {
+	kind, err := r.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	size, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return err
+	}
+
+	compressedSize, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return err
+	}
+
+	// note: the sizes are checked before anything is allocated for them, as they're from the other side
+	if size > maxFrameSize || compressedSize > size || (kind == frameKindRaw && compressedSize != size) {
+		return fmt.Errorf("a frame of %v bytes (%v compressed) is no good", size, compressedSize)
+	}
+
+	data := make([]byte, compressedSize)
+
+	_, err = io.ReadFull(r.reader, data)
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+
+	case frameKindRaw:
+		r.frame = data
+
+	case frameKindCompressed:
+		r.frame, err = r.codec.decompress(data, int(size))
+		if err != nil {
+			return err
+		}
+
+		if len(r.frame) != int(size) {
+			return fmt.Errorf("a frame of %v bytes came out as %v bytes", size, len(r.frame))
+		}
+
+	default:
+		return fmt.Errorf("unknown frame kind %v", kind)
+
+	}
+
+	return nil
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.frame) == 0 {
+		err := r.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.frame)
+	r.frame = r.frame[n:]
+
+	return n, nil
+}
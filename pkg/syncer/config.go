@@ -0,0 +1,53 @@
+package syncer
+
+import (
+	"time"
+)
+
+// Config is everything needed to run either side of a sync (see Run and RunReceiver for which fields each side uses)
+type Config struct {
+	LocalPath             string
+	RemotePath            string
+	RemoteHost            string
+	ListenAddr            string
+	RemoteCommand         string
+	RemoteSyncer          string
+	Stdio                 bool
+	Rate                  time.Duration
+	Debounce              time.Duration
+	HashAlgorithm         HashAlgorithm
+	HashWorkers           int
+	WatchBackend          WatchBackendName
+	PollInterval          time.Duration
+	ReconcileInterval     time.Duration
+	ReconcileRate         int
+	FoldersToIgnore       []string
+	FilesToIgnore         []string
+	Compression           Compression
+	DeltaThreshold        int64
+	Chunking              bool
+	ChunkThreshold        int64
+	ChunkStoreSize        int64
+	ArchiveThreshold      int64
+	StreamThreshold       int64
+	TransferWorkers       int
+	HotPaths              []string
+	ColdPaths             []string
+	Fsync                 bool
+	RefuseOutsideSymlinks bool
+	Bidirectional         bool
+	ConflictPolicy        ConflictPolicy
+	VerifyInterval        time.Duration
+	DeleteThreshold       DeleteThreshold
+	DeletePrompt          bool
+	ControlAddr           string
+	ControlTokenFile      string
+	Trash                 bool
+	TrashMaxAge           time.Duration
+	TrashMaxSize          int64
+	TLSCert               string
+	TLSKey                string
+	TLSCA                 string
+	TLSPeerFingerprints   []string
+	PSKFile               string
+}
@@ -0,0 +1,167 @@
+package syncer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// getConfinedPath returns where relativePath (as sent by the other side, so not to be trusted) is under rootPath, or an
+// error if it's anywhere else (e.g. "../../etc/passwd" or "/etc/passwd")
+func getConfinedPath(rootPath string, relativePath string) (string, error) {
+	if relativePath == "" {
+		return "", fmt.Errorf("the path is empty")
+	}
+
+	if strings.ContainsRune(relativePath, 0) {
+		return "", fmt.Errorf("%#+v has a NUL in it", relativePath)
+	}
+
+	localPath := filepath.FromSlash(relativePath)
+
+	if path.IsAbs(relativePath) || filepath.IsAbs(localPath) || filepath.VolumeName(localPath) != "" {
+		return "", fmt.Errorf("%#+v is absolute", relativePath)
+	}
+
+	localPath = filepath.Clean(localPath)
+
+	if localPath == ".." || strings.HasPrefix(localPath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%#+v is outside %v", relativePath, rootPath)
+	}
+
+	return filepath.Join(rootPath, localPath), nil
+}
+
+// checkParents makes sure the folders path is in don't go anywhere outside rootPath (whose real path is realRootPath)
+// by way of a symlink; folders that don't exist yet are fine, as they'll be made as real folders
+func checkParents(rootPath string, realRootPath string, path string) error {
+	for folderPath := filepath.Dir(path); ; folderPath = filepath.Dir(folderPath) {
+		realFolderPath, err := filepath.EvalSymlinks(folderPath)
+		if err == nil {
+			if !isUnderAnyPath(realFolderPath, []string{realRootPath}) {
+				return fmt.Errorf("%v is through a symlink to %v, which is outside %v", path, realFolderPath, rootPath)
+			}
+
+			return nil
+		}
+
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		_, err = os.Lstat(folderPath)
+		if err == nil { // note: it's there but it doesn't resolve, so it's a symlink to somewhere that isn't
+			return fmt.Errorf("%v is through a symlink (%v) that doesn't go anywhere", path, folderPath)
+		}
+
+		if folderPath == rootPath || filepath.Dir(folderPath) == folderPath {
+			return nil
+		}
+	}
+}
+
+// isSymlinkOutside is true if a symlink at path to target would point somewhere outside rootPath
+func isSymlinkOutside(rootPath string, realRootPath string, path string, target string) bool {
+	targetPath := filepath.FromSlash(target)
+	if !filepath.IsAbs(targetPath) {
+		targetPath = filepath.Join(filepath.Dir(path), targetPath)
+	}
+
+	targetPath = filepath.Clean(targetPath)
+
+	if !isUnderAnyPath(targetPath, []string{rootPath, realRootPath}) {
+		return true
+	}
+
+	// note: it could still get out by way of another symlink (even if what it points to doesn't exist yet)
+	for ; ; targetPath = filepath.Dir(targetPath) {
+		realTargetPath, err := filepath.EvalSymlinks(targetPath)
+		if err == nil {
+			return !isUnderAnyPath(realTargetPath, []string{realRootPath})
+		}
+
+		_, err = os.Lstat(targetPath)
+		if err == nil { // note: a symlink that doesn't go anywhere (yet), so there's no telling where it'll end up
+			return true
+		}
+
+		if targetPath == rootPath || filepath.Dir(targetPath) == targetPath {
+			return false
+		}
+	}
+}
+
+func (r *Receiver) checkParents(paths ...string) error {
+	for _, path := range paths {
+		err := checkParents(r.remotePath, r.realRemotePath, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkMessage rejects anything from the other side that would touch something outside r.remotePath
+func (r *Receiver) checkMessage(message *Message) error {
+	switch message.Type {
+
+	case MessageTypeCommit, MessageTypeHandOff, MessageTypeChunks, MessageTypeArchive: // note: what's in an archive is checked as it's unpacked
+		return nil
+
+	case MessageTypeDigests:
+		for _, relativePath := range message.Paths {
+			_, err := getConfinedPath(r.remotePath, relativePath)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+
+	}
+
+	relativePaths := []string{message.Path}
+	if message.Type == MessageTypeMove {
+		relativePaths = append(relativePaths, message.FromPath)
+	}
+
+	paths := make([]string, 0, len(relativePaths))
+
+	for _, relativePath := range relativePaths {
+		path, err := getConfinedPath(r.remotePath, relativePath)
+		if err != nil {
+			return err
+		}
+
+		if path == r.remotePath {
+			return fmt.Errorf("%#+v is the top of the tree", relativePath)
+		}
+
+		paths = append(paths, path)
+	}
+
+	err := r.checkParents(paths...)
+	if err != nil {
+		return err
+	}
+
+	switch message.Type {
+
+	case MessageTypeSignatures, MessageTypeDelta: // note: these read what's there now
+		info, err := os.Lstat(paths[0])
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%v is a symlink", paths[0])
+		}
+
+	case MessageTypeSymlink:
+		if r.refuseOutsideSymlinks && isSymlinkOutside(r.remotePath, r.realRemotePath, paths[0], message.Target) {
+			return fmt.Errorf("%v would be a symlink to %v, which is outside %v", paths[0], message.Target, r.remotePath)
+		}
+
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGetConfinedPath(t *testing.T) {
+	rootPath := filepath.Join(string(filepath.Separator), "remote")
+
+	tests := []struct {
+		relativePath string
+		want         string
+		wantErr      bool
+	}{
+		{"a.txt", filepath.Join(rootPath, "a.txt"), false},
+		{"a/b/c.txt", filepath.Join(rootPath, "a", "b", "c.txt"), false},
+		{"a/../b.txt", filepath.Join(rootPath, "b.txt"), false},
+		{"./a.txt", filepath.Join(rootPath, "a.txt"), false},
+		{"a/..", rootPath, false},
+		{"..", "", true},
+		{"../outside.txt", "", true},
+		{"../../etc/passwd", "", true},
+		{"a/../../outside.txt", "", true},
+		{"a/b/../../../outside.txt", "", true},
+		{"/etc/passwd", "", true},
+		{"", "", true},
+		{"a\x00b", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := getConfinedPath(rootPath, test.relativePath)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%q gave %v; wanted an error", test.relativePath, got)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q caused %v", test.relativePath, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%q gave %v; wanted %v", test.relativePath, got, test.want)
+		}
+	}
+}
+
+func getConfineTestReceiver(t *testing.T, refuseOutsideSymlinks bool) (*Receiver, string) {
+	t.Helper()
+
+	remotePath := t.TempDir()
+	outsidePath := t.TempDir()
+
+	err := os.Mkdir(filepath.Join(remotePath, "inside"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, target := range map[string]string{
+		"escape":       outsidePath,
+		"deep-escape":  filepath.Join(outsidePath, "deeper"),
+		"dangling":     filepath.Join(outsidePath, "not-there"),
+		"inside-link":  filepath.Join(remotePath, "inside"),
+		"file-link":    filepath.Join(outsidePath, "file.txt"),
+		"relative-out": filepath.Join("..", filepath.Base(outsidePath)),
+	} {
+		err = os.Symlink(target, filepath.Join(remotePath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Mkdir(filepath.Join(outsidePath, "deeper"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := getReceiver(remotePath, Config{RefuseOutsideSymlinks: refuseOutsideSymlinks}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r, outsidePath
+}
+
+func TestCheckMessage(t *testing.T) {
+	r, outsidePath := getConfineTestReceiver(t, true)
+
+	tests := []struct {
+		name    string
+		message *Message
+		wantErr bool
+	}{
+		{"write", &Message{Type: MessageTypeWrite, Path: "a.txt"}, false},
+		{"write in a new folder", &Message{Type: MessageTypeWrite, Path: "new/folder/a.txt"}, false},
+		{"write through a symlink inside", &Message{Type: MessageTypeWrite, Path: "inside-link/a.txt"}, false},
+		{"write with traversal", &Message{Type: MessageTypeWrite, Path: "../a.txt"}, true},
+		{"write with deep traversal", &Message{Type: MessageTypeWrite, Path: "inside/../../a.txt"}, true},
+		{"write to an absolute path", &Message{Type: MessageTypeWrite, Path: "/etc/passwd"}, true},
+		{"write to the top", &Message{Type: MessageTypeWrite, Path: "."}, true},
+		{"write through a symlink outside", &Message{Type: MessageTypeWrite, Path: "escape/a.txt"}, true},
+		{"write through a relative symlink outside", &Message{Type: MessageTypeWrite, Path: "relative-out/a.txt"}, true},
+		{"write under a symlink outside", &Message{Type: MessageTypeWrite, Path: "deep-escape/new/a.txt"}, true},
+		{"write through a dangling symlink", &Message{Type: MessageTypeWrite, Path: "dangling/a.txt"}, true},
+		{"mkdir through a symlink outside", &Message{Type: MessageTypeMkdir, Path: "escape/folder"}, true},
+		{"delete through a symlink outside", &Message{Type: MessageTypeDelete, Path: "escape/a.txt"}, true},
+		{"delete with traversal", &Message{Type: MessageTypeDelete, Path: "../../a.txt"}, true},
+		{"move", &Message{Type: MessageTypeMove, Path: "b.txt", FromPath: "a.txt"}, false},
+		{"move from outside", &Message{Type: MessageTypeMove, Path: "b.txt", FromPath: "../a.txt"}, true},
+		{"move to outside", &Message{Type: MessageTypeMove, Path: "escape/b.txt", FromPath: "a.txt"}, true},
+		{"delta", &Message{Type: MessageTypeDelta, Path: "a.txt"}, false},
+		{"delta against a symlink", &Message{Type: MessageTypeDelta, Path: "file-link"}, true},
+		{"signatures of a symlink", &Message{Type: MessageTypeSignatures, Path: "file-link"}, true},
+		{"symlink inside", &Message{Type: MessageTypeSymlink, Path: "link", Target: "inside"}, false},
+		{"symlink outside", &Message{Type: MessageTypeSymlink, Path: "link", Target: outsidePath}, true},
+		{"relative symlink outside", &Message{Type: MessageTypeSymlink, Path: "inside/link", Target: "../../x"}, true},
+		{"symlink through a symlink outside", &Message{Type: MessageTypeSymlink, Path: "link", Target: "escape/x"}, true},
+		{"symlink through a dangling symlink", &Message{Type: MessageTypeSymlink, Path: "link", Target: "dangling/x"}, true},
+		{"digests", &Message{Type: MessageTypeDigests, Paths: []string{"a.txt", "inside/b.txt"}}, false},
+		{"digests with traversal", &Message{Type: MessageTypeDigests, Paths: []string{"a.txt", "../b.txt"}}, true},
+		{"commit", &Message{Type: MessageTypeCommit}, false},
+	}
+
+	for _, test := range tests {
+		err := r.checkMessage(test.message)
+		if test.wantErr && err == nil {
+			t.Errorf("%v was allowed; wanted an error", test.name)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("%v caused %v", test.name, err)
+		}
+	}
+}
+
+func TestCheckMessageAllowsOutsideSymlinks(t *testing.T) {
+	r, outsidePath := getConfineTestReceiver(t, false)
+
+	err := r.checkMessage(&Message{Type: MessageTypeSymlink, Path: "link", Target: outsidePath})
+	if err != nil {
+		t.Errorf("a symlink outside caused %v without -refuseOutsideSymlinks", err)
+	}
+
+	// note: making the symlink is one thing; going through it is another
+	err = r.checkMessage(&Message{Type: MessageTypeWrite, Path: "escape/a.txt"})
+	if err == nil {
+		t.Errorf("a write through a symlink outside was allowed without -refuseOutsideSymlinks")
+	}
+}
@@ -8,10 +8,17 @@ import (
 )
 
 var (
-	// TODO: expose (some of) these as flags
-	foldersToIgnore = []string{
-		".pytest_cache",
+	// these are always ignored no matter what the flags say
+	foldersToAlwaysIgnore = []string{
 		".git",
+		indexFolderName,
+		trashFolderName,
+	}
+	filesToAlwaysIgnore = []string{
+		tempFileSuffix,
+	}
+	DefaultFoldersToIgnore = []string{
+		".pytest_cache",
 		".idea",
 		"node_modules",
 		// e.g. these below are probably particular to my use case only
@@ -23,9 +30,8 @@ var (
 		"coverage",
 		"test_results",
 	}
-	folderIgnoreExp *regexp.Regexp
-	// TODO: expose (some of) these as flags
-	filesToIgnore = []string{
+	folderIgnoreExp      *regexp.Regexp
+	DefaultFilesToIgnore = []string{
 		".pyc",
 		".tmp",
 	}
@@ -33,56 +39,110 @@ var (
 )
 
 func init() {
-	testExp := func(exp *regexp.Regexp, testValue string) {
+	err := SetIgnoreRules(DefaultFoldersToIgnore, DefaultFilesToIgnore)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// SetIgnoreRules builds the regexes for the folders (anywhere in a path) and the file suffixes to ignore; it has to be
+// called before anything is walked or watched
+func SetIgnoreRules(foldersToIgnore []string, filesToIgnore []string) error {
+	testExp := func(exp *regexp.Regexp, testValue string) error {
 		if exp.MatchString(testValue) {
-			return
+			return nil
 		}
 
-		log.Fatalf("exp=%#+v could not match testValue=%#+v", exp.String(), testValue)
+		return fmt.Errorf("exp=%#+v could not match testValue=%#+v", exp.String(), testValue)
 	}
 
 	rawFolderIgnoreExp := ""
-	for _, folder := range foldersToIgnore {
+	for _, folder := range append(foldersToAlwaysIgnore, foldersToIgnore...) {
+		folder = strings.Trim(strings.TrimSpace(folder), "/")
+		if folder == "" {
+			continue
+		}
+
 		rawFolderIgnoreExp += fmt.Sprintf(
 			"(.*(/|^)%v(/|$).*)|",
-			folder,
+			regexp.QuoteMeta(folder),
 		)
 	}
 	rawFolderIgnoreExp = strings.Trim(rawFolderIgnoreExp, "|")
-	folderIgnoreExp = regexp.MustCompile(rawFolderIgnoreExp)
+
+	newFolderIgnoreExp, err := regexp.Compile(rawFolderIgnoreExp)
+	if err != nil {
+		return err
+	}
 
 	folderIgnoreTestValues := []string{
-		"/node_modules",
-		"/node_modules/",
-		"/node_modules/something",
-		"/node_modules/something/",
-		"/something/node_modules",
-		"/something/node_modules/",
-		"/something/node_modules/something",
-		"/something/node_modules/something/",
+		"/.git",
+		"/.git/",
+		"/.git/something",
+		"/.git/something/",
+		"/something/.git",
+		"/something/.git/",
+		"/something/.git/something",
+		"/something/.git/something/",
 	}
 
 	for _, testValue := range folderIgnoreTestValues {
-		testExp(folderIgnoreExp, testValue)
+		err = testExp(newFolderIgnoreExp, testValue)
+		if err != nil {
+			return err
+		}
 	}
 
 	rawFileIgnoreExp := ""
-	for _, file := range filesToIgnore {
+	for _, file := range append(filesToAlwaysIgnore, filesToIgnore...) {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+
 		rawFileIgnoreExp += fmt.Sprintf(
 			"(.*\\w+%v$)|",
-			file,
+			regexp.QuoteMeta(file),
 		)
 	}
 	rawFileIgnoreExp = strings.Trim(rawFileIgnoreExp, "|")
-	fileIgnoreExp = regexp.MustCompile(rawFileIgnoreExp)
 
-	fileIgnoreTestValues := []string{
-		"some_file.pyc",
-		"/some_file.pyc",
-		"/something/some_file.pyc",
+	if rawFileIgnoreExp == "" { // note: an empty regex matches everything
+		rawFileIgnoreExp = "$^"
 	}
 
-	for _, testValue := range fileIgnoreTestValues {
-		testExp(fileIgnoreExp, testValue)
+	newFileIgnoreExp, err := regexp.Compile(rawFileIgnoreExp)
+	if err != nil {
+		return err
 	}
+
+	for _, file := range filesToIgnore {
+		file = strings.TrimSpace(file)
+		if file == "" {
+			continue
+		}
+
+		fileIgnoreTestValues := []string{
+			fmt.Sprintf("some_file%v", file),
+			fmt.Sprintf("/some_file%v", file),
+			fmt.Sprintf("/something/some_file%v", file),
+		}
+
+		for _, testValue := range fileIgnoreTestValues {
+			err = testExp(newFileIgnoreExp, testValue)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	folderIgnoreExp = newFolderIgnoreExp
+	fileIgnoreExp = newFileIgnoreExp
+
+	return nil
+}
+
+// getIgnoreRules is a summary of the regexes (e.g. so the index can tell if they've changed)
+func getIgnoreRules() []string {
+	return []string{folderIgnoreExp.String(), fileIgnoreExp.String()}
 }
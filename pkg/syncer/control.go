@@ -0,0 +1,134 @@
+package syncer
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ControlServer is a small HTTP API for whoever is looking after a sync that isn't running in a terminal:
+//
+//	GET  /status  - what (if anything) the DeleteGuard is holding
+//	POST /confirm - let it go ahead
+//
+// With a token, every request needs it as "Authorization: Bearer <token>"; without one, it'll only listen on loopback
+// (as anybody who can reach it can confirm a deletion).
+type ControlServer struct {
+	listener    net.Listener
+	server      *http.Server
+	deleteGuard *DeleteGuard
+	token       []byte
+}
+
+// GetControlServer returns a ControlServer listening on listenAddr; tokenPath is optional (see ControlServer)
+func GetControlServer(listenAddr string, tokenPath string, deleteGuard *DeleteGuard) (*ControlServer, error) {
+	c := ControlServer{
+		deleteGuard: deleteGuard,
+	}
+
+	if tokenPath != "" {
+		token, err := os.ReadFile(tokenPath)
+		if err != nil {
+			return nil, err
+		}
+
+		c.token = []byte(strings.TrimSpace(string(token)))
+		if len(c.token) == 0 {
+			return nil, fmt.Errorf("there's no token in %v", tokenPath)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.authorize(c.handleStatus))
+	mux.HandleFunc("/confirm", c.authorize(c.handleConfirm))
+
+	c.server = &http.Server{Handler: mux}
+
+	var err error
+
+	c.listener, err = net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.token == nil && !isLoopbackAddr(c.listener.Addr()) {
+		_ = c.listener.Close()
+		return nil, fmt.Errorf("%v isn't a loopback address, so the control API needs a token", c.listener.Addr())
+	}
+
+	log.Printf("listening on %v for control requests", c.listener.Addr())
+
+	go func() {
+		err := c.server.Serve(c.listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("warning: attempt to serve control requests caused %v", err)
+		}
+	}()
+
+	return &c, nil
+}
+
+func isLoopbackAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+
+	return ok && tcpAddr.IP.IsLoopback()
+}
+
+// authorize has handler refuse requests without the token (if there is one)
+func (c *ControlServer) authorize(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.token != nil {
+			authorization := r.Header.Get("Authorization")
+			token := []byte(strings.TrimPrefix(authorization, "Bearer "))
+
+			if !strings.HasPrefix(authorization, "Bearer ") || subtle.ConstantTimeCompare(token, c.token) != 1 {
+				log.Printf("warning: refused a control request from %v as it didn't have the token", r.RemoteAddr)
+				writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "a token is needed"})
+				return
+			}
+		}
+
+		handler(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (c *ControlServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use GET"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, c.deleteGuard.Status())
+}
+
+func (c *ControlServer) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "use POST"})
+		return
+	}
+
+	err := c.deleteGuard.Confirm()
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Printf("deletion confirmed by %v", r.RemoteAddr)
+
+	writeJSON(w, http.StatusOK, map[string]bool{"confirmed": true})
+}
+
+func (c *ControlServer) Close() {
+	_ = c.server.Close()
+}
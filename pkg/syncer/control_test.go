@@ -0,0 +1,54 @@
+package syncer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlServerConfirmNeedsTheToken(t *testing.T) {
+	g := GetDeleteGuard(DeleteThreshold{Count: 1}, false)
+
+	if g.allow(deleteSourceDiff, []string{"/l/a", "/l/b"}, 10) {
+		t.Fatalf("it allowed a deletion over the threshold")
+	}
+
+	c := ControlServer{
+		deleteGuard: g,
+		token:       []byte("a token"),
+	}
+
+	handler := c.authorize(c.handleConfirm)
+
+	for _, authorization := range []string{"", "Bearer another token", "a token"} {
+		request := httptest.NewRequest(http.MethodPost, "/confirm", nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%#+v: got %v; wanted %v", authorization, recorder.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if g.allow(deleteSourceDiff, []string{"/l/a", "/l/b"}, 10) {
+		t.Fatalf("it was confirmed without the token")
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/confirm", nil)
+	request.Header.Set("Authorization", "Bearer a token")
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("got %v with the token; wanted %v", recorder.Code, http.StatusOK)
+	}
+
+	if !g.allow(deleteSourceDiff, []string{"/l/a", "/l/b"}, 10) {
+		t.Errorf("it wasn't confirmed with the token")
+	}
+}
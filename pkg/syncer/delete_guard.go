@@ -0,0 +1,308 @@
+package syncer
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxStatusPaths bounds how many of the paths being deleted are listed in a DeleteGuardStatus
+const maxStatusPaths = 100
+
+const (
+	deleteSourceDiff   = "diff"   // removals seen by the Differ
+	deleteSourceVerify = "verify" // extras found on the remote when comparing trees
+)
+
+// DeleteThreshold is how much can be deleted at once before a DeleteGuard asks first; either Count files or Percent of
+// the files being tracked (a zero DeleteThreshold never asks)
+type DeleteThreshold struct {
+	Count   int
+	Percent float64
+}
+
+// ParseDeleteThreshold parses e.g. "500" (files) or "25%" (of the files being tracked); "" or "0" is no threshold
+func ParseDeleteThreshold(rawThreshold string) (DeleteThreshold, error) {
+	rawThreshold = strings.TrimSpace(rawThreshold)
+	if rawThreshold == "" {
+		return DeleteThreshold{}, nil
+	}
+
+	if strings.HasSuffix(rawThreshold, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(rawThreshold, "%"), 64)
+		if err != nil {
+			return DeleteThreshold{}, err
+		}
+
+		if percent < 0 || percent > 100 {
+			return DeleteThreshold{}, fmt.Errorf("%v is not a percentage between 0 and 100", rawThreshold)
+		}
+
+		return DeleteThreshold{Percent: percent}, nil
+	}
+
+	count, err := strconv.Atoi(rawThreshold)
+	if err != nil {
+		return DeleteThreshold{}, err
+	}
+
+	if count < 0 {
+		return DeleteThreshold{}, fmt.Errorf("%v is negative", rawThreshold)
+	}
+
+	return DeleteThreshold{Count: count}, nil
+}
+
+func (t DeleteThreshold) String() string {
+	if t.Percent > 0 {
+		return fmt.Sprintf("%v%% of files", t.Percent)
+	}
+
+	if t.Count > 0 {
+		return fmt.Sprintf("%v files", t.Count)
+	}
+
+	return "none"
+}
+
+// isCrossedBy is true if deleting removed of tracked files is more than the threshold allows
+func (t DeleteThreshold) isCrossedBy(removed int, tracked int) bool {
+	if removed == 0 {
+		return false
+	}
+
+	if t.Percent > 0 {
+		return tracked > 0 && float64(removed)*100 > t.Percent*float64(tracked)
+	}
+
+	return t.Count > 0 && removed > t.Count
+}
+
+// deletePause is a deletion that crossed the threshold and is being held until it's confirmed
+type deletePause struct {
+	paths     map[string]bool
+	tracked   int
+	confirmed bool
+}
+
+// DeleteGuardStatus is what's being held by a DeleteGuard (e.g. for the control API)
+type DeleteGuardStatus struct {
+	Paused    bool     `json:"paused"`
+	Threshold string   `json:"threshold"`
+	Removed   int      `json:"removed"`
+	Tracked   int      `json:"tracked"`
+	Paths     []string `json:"paths"`
+}
+
+// DeleteGuard stops a mass deletion (e.g. a bad .gitignore, an unmounted volume or a botched checkout) from being
+// mirrored to the other side without somebody saying so first; while it's paused nothing else is sent either, so the
+// other side is left as it was before it all went missing
+type DeleteGuard struct {
+	mu            sync.Mutex
+	threshold     DeleteThreshold
+	pauseBySource map[string]*deletePause
+	onConfirm     map[string]func()
+	prompting     bool
+}
+
+// GetDeleteGuard returns a DeleteGuard for threshold; if prompt is set, it asks for confirmation on stdin as well as
+// through Confirm
+func GetDeleteGuard(threshold DeleteThreshold, prompt bool) *DeleteGuard {
+	g := DeleteGuard{
+		threshold:     threshold,
+		pauseBySource: make(map[string]*deletePause),
+		onConfirm:     make(map[string]func()),
+		prompting:     prompt && threshold != DeleteThreshold{},
+	}
+
+	if g.prompting {
+		go g.readConfirmations()
+	}
+
+	return &g
+}
+
+// setOnConfirm is called after a deletion from source is confirmed, so it goes ahead straight away (rather than on
+// the next change)
+func (g *DeleteGuard) setOnConfirm(source string, onConfirm func()) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.onConfirm[source] = onConfirm
+}
+
+func (g *DeleteGuard) isPaused(source string) bool {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.pauseBySource[source]
+	return ok
+}
+
+// allow is true if paths (the files source wants deleted, out of tracked files) can be deleted; otherwise source is
+// paused until either it's confirmed or the deletion drops back under the threshold (e.g. the volume is mounted again)
+func (g *DeleteGuard) allow(source string, paths []string, tracked int) bool {
+	if g == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	pause, paused := g.pauseBySource[source]
+
+	if !g.threshold.isCrossedBy(len(paths), tracked) {
+		if paused {
+			g.resumeLocked(source)
+		}
+
+		return true
+	}
+
+	if paused && pause.confirmed && isSubset(paths, pause.paths) {
+		log.Printf("deleting %v of %v files (%v) as it was confirmed", len(paths), tracked, source)
+		delete(g.pauseBySource, source)
+		return true
+	}
+
+	if paused && isSubset(paths, pause.paths) { // note: already asked about (some of it may have come back since)
+		return false
+	}
+
+	pause = &deletePause{
+		paths:   make(map[string]bool),
+		tracked: tracked,
+	}
+
+	for _, path := range paths {
+		pause.paths[path] = true
+	}
+
+	g.pauseBySource[source] = pause
+
+	log.Printf(
+		"warning: pausing (%v) as %v of %v files would be deleted (more than the threshold of %v); confirm it to go ahead",
+		source, len(paths), tracked, g.threshold,
+	)
+
+	if g.prompting {
+		fmt.Fprintf(os.Stderr, "delete %v of %v files? [y/N] ", len(paths), tracked)
+	}
+
+	return false
+}
+
+// resume forgets about anything paused for source, e.g. because it's all come back
+func (g *DeleteGuard) resume(source string) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.pauseBySource[source]
+	if ok {
+		g.resumeLocked(source)
+	}
+}
+
+func (g *DeleteGuard) resumeLocked(source string) {
+	log.Printf("resuming (%v) as what's being deleted is under the threshold of %v now", source, g.threshold)
+	delete(g.pauseBySource, source)
+}
+
+func isSubset(paths []string, pathSet map[string]bool) bool {
+	for _, path := range paths {
+		if !pathSet[path] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Confirm lets whatever deletion is paused go ahead
+func (g *DeleteGuard) Confirm() error {
+	g.mu.Lock()
+
+	if len(g.pauseBySource) == 0 {
+		g.mu.Unlock()
+		return fmt.Errorf("nothing is paused")
+	}
+
+	onConfirm := make([]func(), 0)
+
+	for source, pause := range g.pauseBySource {
+		pause.confirmed = true
+
+		f, ok := g.onConfirm[source]
+		if ok {
+			onConfirm = append(onConfirm, f)
+		}
+	}
+
+	g.mu.Unlock()
+
+	for _, f := range onConfirm {
+		go f()
+	}
+
+	return nil
+}
+
+// Status returns what (if anything) is paused
+func (g *DeleteGuard) Status() DeleteGuardStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	status := DeleteGuardStatus{
+		Paused:    len(g.pauseBySource) > 0,
+		Threshold: g.threshold.String(),
+		Paths:     make([]string, 0),
+	}
+
+	for _, pause := range g.pauseBySource {
+		status.Removed += len(pause.paths)
+		if pause.tracked > status.Tracked {
+			status.Tracked = pause.tracked
+		}
+
+		for path := range pause.paths {
+			status.Paths = append(status.Paths, path)
+		}
+	}
+
+	sort.Strings(status.Paths)
+	if len(status.Paths) > maxStatusPaths {
+		status.Paths = status.Paths[:maxStatusPaths]
+	}
+
+	return status
+}
+
+// readConfirmations confirms on a "y" (or "yes") on stdin
+func (g *DeleteGuard) readConfirmations() {
+	scanner := bufio.NewScanner(os.Stdin)
+
+	for scanner.Scan() {
+		answer := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if answer != "y" && answer != "yes" {
+			continue
+		}
+
+		err := g.Confirm()
+		if err != nil {
+			log.Printf("warning: attempt to confirm caused %v", err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package syncer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDeleteThreshold(t *testing.T) {
+	tests := []struct {
+		rawThreshold string
+		want         DeleteThreshold
+		wantErr      bool
+	}{
+		{"", DeleteThreshold{}, false},
+		{"0", DeleteThreshold{}, false},
+		{"500", DeleteThreshold{Count: 500}, false},
+		{" 500 ", DeleteThreshold{Count: 500}, false},
+		{"25%", DeleteThreshold{Percent: 25}, false},
+		{"0.5%", DeleteThreshold{Percent: 0.5}, false},
+		{"100%", DeleteThreshold{Percent: 100}, false},
+		{"101%", DeleteThreshold{}, true},
+		{"-1%", DeleteThreshold{}, true},
+		{"-1", DeleteThreshold{}, true},
+		{"lots", DeleteThreshold{}, true},
+		{"%", DeleteThreshold{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseDeleteThreshold(test.rawThreshold)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%#+v: got %#+v; wanted an error", test.rawThreshold, got)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%#+v: caused %v", test.rawThreshold, err)
+			continue
+		}
+
+		if got != test.want {
+			t.Errorf("%#+v: got %#+v; wanted %#+v", test.rawThreshold, got, test.want)
+		}
+	}
+}
+
+func TestDeleteThresholdIsCrossedBy(t *testing.T) {
+	tests := []struct {
+		threshold DeleteThreshold
+		removed   int
+		tracked   int
+		want      bool
+	}{
+		{DeleteThreshold{}, 1000, 1000, false},
+		{DeleteThreshold{Count: 10}, 0, 100, false},
+		{DeleteThreshold{Count: 10}, 10, 100, false},
+		{DeleteThreshold{Count: 10}, 11, 100, true},
+		{DeleteThreshold{Count: 10}, 11, 0, true},
+		{DeleteThreshold{Percent: 25}, 25, 100, false},
+		{DeleteThreshold{Percent: 25}, 26, 100, true},
+		{DeleteThreshold{Percent: 25}, 1, 3, true},
+		{DeleteThreshold{Percent: 25}, 0, 100, false},
+		{DeleteThreshold{Percent: 25}, 5, 0, false}, // note: there's nothing to take a percentage of
+		{DeleteThreshold{Percent: 0.5}, 1, 1000, false},
+		{DeleteThreshold{Percent: 0.5}, 6, 1000, true},
+	}
+
+	for _, test := range tests {
+		got := test.threshold.isCrossedBy(test.removed, test.tracked)
+		if got != test.want {
+			t.Errorf("%v: %v of %v crossed it is %v; wanted %v", test.threshold, test.removed, test.tracked, got, test.want)
+		}
+	}
+}
+
+func TestDeleteGuardPauseConfirmResume(t *testing.T) {
+	g := GetDeleteGuard(DeleteThreshold{Count: 2}, false)
+
+	confirmed := make(chan bool, 1)
+	g.setOnConfirm(deleteSourceDiff, func() {
+		confirmed <- true
+	})
+
+	err := g.Confirm()
+	if err == nil {
+		t.Errorf("it confirmed with nothing paused")
+	}
+
+	if !g.allow(deleteSourceDiff, []string{"/l/a"}, 10) {
+		t.Fatalf("it paused for a deletion under the threshold")
+	}
+
+	paths := []string{"/l/a", "/l/b", "/l/c"}
+
+	if g.allow(deleteSourceDiff, paths, 10) {
+		t.Fatalf("it allowed a deletion over the threshold")
+	}
+
+	status := g.Status()
+	if !status.Paused || status.Removed != 3 || status.Tracked != 10 || len(status.Paths) != 3 {
+		t.Errorf("the status is %#+v; wanted 3 of 10 paused", status)
+	}
+
+	if !g.isPaused(deleteSourceDiff) || g.isPaused(deleteSourceVerify) {
+		t.Errorf("only the diff should be paused")
+	}
+
+	// note: asking again (or about some of it) doesn't go ahead without a confirmation
+	if g.allow(deleteSourceDiff, paths, 10) {
+		t.Errorf("it allowed the same deletion again")
+	}
+
+	err = g.Confirm()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-confirmed:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the confirmation wasn't passed on")
+	}
+
+	// note: a confirmation is for what was asked about, not for more
+	if g.allow(deleteSourceDiff, append(paths, "/l/d"), 10) {
+		t.Errorf("it allowed more than was confirmed")
+	}
+
+	err = g.Confirm()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-confirmed
+
+	if !g.allow(deleteSourceDiff, paths, 10) {
+		t.Errorf("it didn't allow what was confirmed")
+	}
+
+	if g.isPaused(deleteSourceDiff) {
+		t.Errorf("it's still paused after going ahead")
+	}
+
+	// note: if most of it comes back (e.g. the volume is mounted again), what's left goes ahead without asking
+	if g.allow(deleteSourceVerify, paths, 10) {
+		t.Fatalf("it allowed a deletion over the threshold")
+	}
+
+	if !g.allow(deleteSourceVerify, []string{"/l/a"}, 10) {
+		t.Errorf("it didn't allow a deletion back under the threshold")
+	}
+
+	if g.Status().Paused {
+		t.Errorf("it didn't resume once back under the threshold")
+	}
+}
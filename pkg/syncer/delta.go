@@ -0,0 +1,213 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math"
+	"os"
+)
+
+const (
+	DefaultDeltaThreshold = 128 * 1024
+	minDeltaBlockSize     = 1024
+	maxDeltaBlockSize     = 64 * 1024
+)
+
+// BlockSignature is what the receiver knows about one block of its copy of a file; Weak is cheap to roll along the
+// sender's copy a byte at a time and Strong is only checked when Weak matches
+type BlockSignature struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// DeltaOp is either some literal bytes (Data) or a copy of one of the receiver's blocks (Block)
+type DeltaOp struct {
+	Block int
+	Data  []byte
+}
+
+// getDeltaBlockSize is roughly the square root of the size (as rsync does), which balances the number of signatures
+// against how much has to be sent for a small change
+func getDeltaBlockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize -= blockSize % 8
+
+	if blockSize < minDeltaBlockSize {
+		return minDeltaBlockSize
+	}
+
+	if blockSize > maxDeltaBlockSize {
+		return maxDeltaBlockSize
+	}
+
+	return blockSize
+}
+
+func getWeakChecksumParts(block []byte) (uint32, uint32) {
+	a, b := uint32(0), uint32(0)
+
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+
+	return a & 0xffff, b & 0xffff
+}
+
+func getWeakChecksum(a uint32, b uint32) uint32 {
+	return a | b<<16
+}
+
+func getStrongChecksum(block []byte) [16]byte {
+	sum := [16]byte{}
+	fullSum := sha256.Sum256(block)
+	copy(sum[:], fullSum[:16])
+	return sum
+}
+
+func getSignatures(data []byte, blockSize int) []BlockSignature {
+	signatures := make([]BlockSignature, 0, len(data)/blockSize+1)
+
+	for offset := 0; offset < len(data); offset += blockSize {
+		end := offset + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		block := data[offset:end]
+
+		signatures = append(signatures, BlockSignature{
+			Weak:   getWeakChecksum(getWeakChecksumParts(block)),
+			Strong: getStrongChecksum(block),
+		})
+	}
+
+	return signatures
+}
+
+func getSignaturesForPath(path string, blockSize int) ([]BlockSignature, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return getSignatures(data, blockSize), nil
+}
+
+// getDelta slides a window along data looking for blocks the receiver already has; everything else is sent literally
+func getDelta(data []byte, blockSize int, signatures []BlockSignature) ([]DeltaOp, int) {
+	blocksByWeak := make(map[uint32][]int)
+	for i, signature := range signatures {
+		blocksByWeak[signature.Weak] = append(blocksByWeak[signature.Weak], i)
+	}
+
+	ops := make([]DeltaOp, 0)
+	literalBytes := 0
+	literalStart := 0
+
+	findBlock := func(window []byte, weak uint32) int {
+		blocks, ok := blocksByWeak[weak]
+		if !ok {
+			return -1
+		}
+
+		strong := getStrongChecksum(window)
+		for _, block := range blocks {
+			if signatures[block].Strong == strong {
+				return block
+			}
+		}
+
+		return -1
+	}
+
+	flushLiteral := func(end int) {
+		if end <= literalStart {
+			return
+		}
+
+		ops = append(ops, DeltaOp{Block: -1, Data: data[literalStart:end]})
+		literalBytes += end - literalStart
+	}
+
+	i := 0
+	a, b := uint32(0), uint32(0)
+	rolling := false
+
+	for i < len(data) {
+		end := i + blockSize
+		if end > len(data) { // only the receiver's last block can be this short, so there's no need to roll
+			end = len(data)
+			a, b = getWeakChecksumParts(data[i:end])
+		} else if !rolling {
+			a, b = getWeakChecksumParts(data[i:end])
+			rolling = true
+		}
+
+		block := findBlock(data[i:end], getWeakChecksum(a, b))
+		if block >= 0 {
+			flushLiteral(i)
+			ops = append(ops, DeltaOp{Block: block})
+			i = end
+			literalStart = i
+			rolling = false
+			continue
+		}
+
+		if end == len(data) && end-i < blockSize {
+			break
+		}
+
+		// roll the window along a byte
+		out := uint32(data[i])
+		a = (a - out) & 0xffff
+		b = (b - uint32(blockSize)*out) & 0xffff
+		if end < len(data) {
+			in := uint32(data[end])
+			a = (a + in) & 0xffff
+			b = (b + a) & 0xffff
+		} else {
+			rolling = false
+		}
+
+		i++
+	}
+
+	flushLiteral(len(data))
+
+	return ops, literalBytes
+}
+
+// applyDelta builds the sender's copy from base and ops; blockSize and ops come from the other side, so they're checked
+// rather than trusted
+func applyDelta(base []byte, blockSize int, ops []DeltaOp) ([]byte, error) {
+	if blockSize < minDeltaBlockSize || blockSize > maxDeltaBlockSize {
+		return nil, fmt.Errorf("unsupported block size %v", blockSize)
+	}
+
+	blocks := (len(base) + blockSize - 1) / blockSize
+
+	data := make([]byte, 0, len(base))
+
+	for _, op := range ops {
+		if op.Block == -1 {
+			data = append(data, op.Data...)
+			continue
+		}
+
+		if op.Block < 0 || op.Block >= blocks {
+			return nil, fmt.Errorf("delta refers to block %v but there are only %v blocks", op.Block, blocks)
+		}
+
+		offset := op.Block * blockSize
+
+		end := offset + blockSize
+		if end > len(base) {
+			end = len(base)
+		}
+
+		data = append(data, base[offset:end]...)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,215 @@
+package syncer
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func getTestData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(seed)).Read(data)
+
+	return data
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := getTestData(1, 256*1024)
+	blockSize := getDeltaBlockSize(int64(len(base)))
+
+	tests := []struct {
+		name       string
+		data       []byte
+		maxLiteral int
+	}{
+		{"unchanged", base, 0},
+		{"empty", []byte{}, 0},
+		{"byte changed", join(base[:1000], []byte{base[1000] + 1}, base[1001:]), 2 * blockSize},
+		{"inserted at the start", join([]byte("hello"), base), 2 * blockSize},
+		{"inserted in the middle", join(base[:100000], []byte("hello"), base[100000:]), 2 * blockSize},
+		{"deleted from the middle", join(base[:100000], base[100005:]), 2 * blockSize},
+		{"appended", join(base, []byte("hello")), 2 * blockSize},
+		{"truncated", base[:len(base)-12345], 2 * blockSize},
+		{"unaligned tail", base[:len(base)-blockSize/2], blockSize},
+		{"blocks swapped", join(base[blockSize*4:blockSize*8], base[:blockSize*4], base[blockSize*8:]), 0},
+		{"repeated block", join(base[:blockSize], base[:blockSize], base), 0},
+		{"all new", getTestData(2, 64*1024), 64 * 1024},
+		{"shorter than a block", base[:blockSize/3], blockSize / 3},
+	}
+
+	signatures := getSignatures(base, blockSize)
+
+	for _, test := range tests {
+		ops, literalBytes := getDelta(test.data, blockSize, signatures)
+
+		got, err := applyDelta(base, blockSize, ops)
+		if err != nil {
+			t.Errorf("%v: applyDelta caused %v", test.name, err)
+			continue
+		}
+
+		if !bytes.Equal(got, test.data) {
+			t.Errorf("%v: came out as %v bytes that differ from the %v wanted", test.name, len(got), len(test.data))
+		}
+
+		if literalBytes > test.maxLiteral {
+			t.Errorf("%v: sent %v literal bytes; wanted no more than %v", test.name, literalBytes, test.maxLiteral)
+		}
+	}
+}
+
+func TestDeltaRoundTripAgainstEmpty(t *testing.T) {
+	data := getTestData(3, 10000)
+
+	ops, literalBytes := getDelta(data, minDeltaBlockSize, getSignatures(nil, minDeltaBlockSize))
+	if literalBytes != len(data) {
+		t.Errorf("sent %v literal bytes; wanted %v", literalBytes, len(data))
+	}
+
+	got, err := applyDelta(nil, minDeltaBlockSize, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Errorf("came out different")
+	}
+}
+
+func TestApplyDeltaRejectsBadOps(t *testing.T) {
+	base := getTestData(4, 4*minDeltaBlockSize+10)
+
+	tests := []struct {
+		name      string
+		blockSize int
+		ops       []DeltaOp
+	}{
+		{"a block past the end", minDeltaBlockSize, []DeltaOp{{Block: 5}}},
+		{"a huge block", minDeltaBlockSize, []DeltaOp{{Block: math.MaxInt / 2}}},
+		{"a negative block", minDeltaBlockSize, []DeltaOp{{Block: -2}}},
+		{"a negative block size", -minDeltaBlockSize, []DeltaOp{{Block: 0}}},
+		{"a zero block size", 0, []DeltaOp{{Block: -1, Data: []byte("a")}}},
+		{"a block size that's too big", maxDeltaBlockSize * 2, []DeltaOp{{Block: 0}}},
+	}
+
+	for _, test := range tests {
+		_, err := applyDelta(base, test.blockSize, test.ops)
+		if err == nil {
+			t.Errorf("%v was applied", test.name)
+		}
+	}
+
+	// note: the last block is the short one
+	data, err := applyDelta(base, minDeltaBlockSize, []DeltaOp{{Block: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, base[4*minDeltaBlockSize:]) {
+		t.Errorf("the last block came out as %v bytes; wanted 10", len(data))
+	}
+}
+
+func TestReceiverRejectsBadDeltas(t *testing.T) {
+	l := getLoopback(t, 1)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.bin"), string(getTestData(7, 64*1024)))
+	l.sync(t)
+
+	conn, err := l.sender.getConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range []*Message{
+		{Type: MessageTypeDelta, Path: "a.bin", BlockSize: -minDeltaBlockSize, Ops: []DeltaOp{{Block: 1}}},
+		{Type: MessageTypeDelta, Path: "a.bin", BlockSize: minDeltaBlockSize, Ops: []DeltaOp{{Block: math.MaxInt / 2}}},
+		{Type: MessageTypeDelta, Path: "a.bin", BlockSize: minDeltaBlockSize, Ops: []DeltaOp{{Block: -5}}},
+	} {
+		err = conn.send(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := conn.request(&Message{Type: MessageTypeCommit})
+		if response == nil {
+			t.Fatalf("the receiver didn't respond to a bad delta (%v)", err)
+		}
+
+		if len(response.Failed) != 1 || response.Failed[0] != "a.bin" {
+			t.Errorf("%v failed; wanted just a.bin", response.Failed)
+		}
+	}
+
+	// note: and it's still there for what comes next
+	writeTestFile(t, filepath.Join(l.localPath, "b.txt"), "b")
+	l.sync(t)
+	requireSameTree(t, l.localPath, l.remotePath)
+}
+
+func TestSenderToReceiverWithDeltas(t *testing.T) {
+	l := getLoopback(t, 1)
+	l.sender.deltaThreshold = 1024
+
+	base := getTestData(5, 512*1024)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.bin"), string(base))
+	l.sync(t)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.bin"), string(join(base[:1000], []byte("changed"), base[2000:])))
+
+	stats := l.syncWithStats(t)
+
+	if stats.deltaFiles != 1 {
+		t.Errorf("sent %v files as deltas; wanted 1", stats.deltaFiles)
+	}
+
+	requireSameTree(t, l.localPath, l.remotePath)
+}
+
+func TestDeltaWithWrongSumIsSentInFull(t *testing.T) {
+	l := getLoopback(t, 1)
+
+	base := getTestData(6, 64*1024)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.bin"), string(base))
+	l.sync(t)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.bin"), string(join(base, []byte("more"))))
+
+	conn, err := l.sender.getConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// note: as if the remote copy changed after it sent its signatures (so the delta comes out as something else)
+	err = conn.send(&Message{
+		Type:      MessageTypeDelta,
+		Path:      "a.bin",
+		BlockSize: minDeltaBlockSize,
+		Ops:       []DeltaOp{{Block: 0}},
+		Sum:       getStrongChecksum(join(base, []byte("more"))),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := &stagedBatch{deltaPaths: map[string]bool{"a.bin": true}}
+
+	response, err := l.sender.commitBatch(conn, &Message{Type: MessageTypeCommit}, &transferStats{}, []*stagedBatch{staged})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Failed) != 1 || response.Failed[0] != "a.bin" {
+		t.Errorf("%v failed; wanted just a.bin", response.Failed)
+	}
+
+	requireSameTree(t, l.localPath, l.remotePath)
+}
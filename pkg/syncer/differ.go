@@ -1,6 +1,7 @@
 package syncer
 
 import (
+	"fmt"
 	"github.com/initialed85/syncer/internal/utils"
 	"log"
 	"reflect"
@@ -29,6 +30,7 @@ func (s *Differ) update(fileByPath map[string]*File) {
 		if utils.Debug {
 			log.Printf("differ update ignored; fileByPath=%v, lastFileByPath=%v- no chnages", len(fileByPath), len(s.fileByPath))
 		}
+		s.lastFileByPath = s.fileByPath // note: so that the diff is empty (rather than the last one again)
 		return
 	}
 
@@ -52,7 +54,7 @@ func (s *Differ) update(fileByPath map[string]*File) {
 	}
 }
 
-func (s *Differ) diff() (map[string]*File, map[string]*File, map[string]*File) {
+func (s *Differ) diff() (map[string]*File, map[string]*File, map[string]*File, map[string]*Move) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -63,7 +65,16 @@ func (s *Differ) diff() (map[string]*File, map[string]*File, map[string]*File) {
 	for path, file := range s.fileByPath {
 		lastFile, ok := s.lastFileByPath[path]
 		if ok {
-			if file.Modified == lastFile.Modified && file.Size == lastFile.Size {
+			if file.Mode != lastFile.Mode { // note: e.g. it's been made executable
+				modified[path] = file
+				continue
+			}
+
+			if file.HasSum && lastFile.HasSum { // the content is what matters; e.g. build tools like to touch mtimes
+				if file.Sum == lastFile.Sum {
+					continue
+				}
+			} else if file.Modified == lastFile.Modified && file.Size == lastFile.Size {
 				continue
 			}
 
@@ -83,12 +94,16 @@ func (s *Differ) diff() (map[string]*File, map[string]*File, map[string]*File) {
 		removed[lastPath] = lastFile
 	}
 
+	moved := getMoved(added, removed)
+
 	addedFiles := 0
 	removedFiles := 0
 	addedFolders := 0
 	modifiedFiles := 0
 	removedFolders := 0
 	modifiedFolders := 0
+	movedFiles := 0
+	movedFolders := 0
 
 	for _, file := range added {
 		utils.DebugLog("differ", "added", file.Path)
@@ -120,15 +135,58 @@ func (s *Differ) diff() (map[string]*File, map[string]*File, map[string]*File) {
 		modifiedFolders++
 	}
 
+	for _, move := range moved {
+		utils.DebugLog("differ", "moved", fmt.Sprintf("%v -> %v", move.From.Path, move.To.Path))
+
+		if !move.To.IsDir {
+			movedFiles++
+			continue
+		}
+		movedFolders++
+	}
+
 	log.Printf(
-		"files: %v added, %v removed, %v modified; folders: %v added, %v removed, %v modified",
+		"files: %v added, %v removed, %v modified, %v moved; folders: %v added, %v removed, %v modified, %v moved",
 		addedFiles,
 		removedFiles,
 		modifiedFiles,
+		movedFiles,
 		addedFolders,
 		removedFolders,
 		modifiedFolders,
+		movedFolders,
 	)
 
-	return added, removed, modified
+	return added, removed, modified, moved
+}
+
+// countLastFiles is how many files (not folders) the last diff was against
+func (s *Differ) countLastFiles() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, file := range s.lastFileByPath {
+		if !file.IsDir {
+			count++
+		}
+	}
+
+	return count
+}
+
+// setBase is what the first update is diffed against (rather than nothing)
+func (s *Differ) setBase(fileByPath map[string]*File) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fileByPath = CopyFileByPath(fileByPath)
+}
+
+// revert forgets the last update, so the next diff covers it again (e.g. because sending it failed)
+func (s *Differ) revert() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fileByPath = s.lastFileByPath
 }
@@ -18,6 +18,8 @@ type File struct {
 	Mode       fs.FileMode
 	IsDir      bool
 	IsSymlink  bool
+	Inode      uint64
+	HasSum     bool
 	Sum        [16]byte
 }
 
@@ -46,11 +48,27 @@ func GetFileWithInfo(path string, info fs.FileInfo) (*File, error) {
 		Mode:       info.Mode(),
 		IsDir:      isDir,
 		IsSymlink:  isSymlink,
+		Inode:      getInode(info),
 	}
 
 	return &file, nil
 }
 
+// isSpecial is true for the things that can't be synced (e.g. FIFOs, sockets and devices)
+func (f *File) isSpecial() bool {
+	return f.HasInfo && !f.IsDir && !f.IsSymlink && !f.Mode.IsRegular()
+}
+
+// getSymlinkSum is what a symlink is compared by; symlinks aren't followed, so that's its target
+func getSymlinkSum(path string) ([16]byte, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return [16]byte{}, err
+	}
+
+	return getStrongChecksum([]byte(target)), nil
+}
+
 func GetFileWithoutInfo(path string) *File {
 	parentPath, name := filepath.Split(path)
 
@@ -64,6 +82,8 @@ func GetFileWithoutInfo(path string) *File {
 		Mode:       fs.ModeIrregular,
 		IsDir:      false,
 		IsSymlink:  false,
+		Inode:      0,
+		HasSum:     false,
 		Sum:        [16]byte{},
 	}
 }
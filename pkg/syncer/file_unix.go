@@ -0,0 +1,17 @@
+//go:build !windows
+
+package syncer
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func getInode(info fs.FileInfo) uint64 {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+
+	return uint64(stat.Ino)
+}
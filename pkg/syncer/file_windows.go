@@ -0,0 +1,10 @@
+package syncer
+
+import (
+	"io/fs"
+)
+
+// note: os.FileInfo doesn't expose file IDs on Windows, so move detection falls back to content hashes
+func getInode(info fs.FileInfo) uint64 {
+	return 0
+}
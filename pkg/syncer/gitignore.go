@@ -0,0 +1,451 @@
+package syncer
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+type gitIgnorePattern struct {
+	exp     *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// GitIgnore is the rules from the ignore files in one folder (matched relative to that folder); ExcludeLines are the
+// rules from .git/info/exclude and core.excludesFile (if the folder is the top of a repo), which lose to everything else
+type GitIgnore struct {
+	Path            string
+	Lines           []string
+	ExcludeLines    []string
+	patterns        []*gitIgnorePattern
+	excludePatterns []*gitIgnorePattern
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// translateGitIgnoreSegment turns one path segment of a gitignore pattern (i.e. no slashes) into a regex
+func translateGitIgnoreSegment(segment string) string {
+	exp := ""
+
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+
+		switch c {
+
+		case '*':
+			exp += "[^/]*"
+
+		case '?':
+			exp += "[^/]"
+
+		case '\\':
+			if i+1 < len(segment) {
+				i++
+				exp += regexp.QuoteMeta(string(segment[i]))
+			}
+
+		case '[':
+			j := i + 1
+			if j < len(segment) && (segment[j] == '!' || segment[j] == '^') {
+				j++
+			}
+			if j < len(segment) && segment[j] == ']' { // a leading ] is part of the class
+				j++
+			}
+			for j < len(segment) && segment[j] != ']' {
+				j++
+			}
+
+			if j >= len(segment) { // no closing ], so it's just a [
+				exp += regexp.QuoteMeta("[")
+				continue
+			}
+
+			class := segment[i+1 : j]
+			exp += "["
+			if class[0] == '!' || class[0] == '^' {
+				exp += "^"
+				class = class[1:]
+			}
+			for k := 0; k < len(class); k++ {
+				if class[k] == '\\' && k+1 < len(class) {
+					k++
+					if !isAlphanumeric(class[k]) && class[k] < 0x80 { // note: an escaped letter would mean something else to regexp
+						exp += "\\"
+					}
+					exp += string(class[k])
+					continue
+				}
+
+				if class[k] == '-' { // a range
+					exp += "-"
+					continue
+				}
+
+				exp += regexp.QuoteMeta(string(class[k]))
+			}
+			exp += "]"
+
+			i = j
+
+		default:
+			exp += regexp.QuoteMeta(string(c))
+
+		}
+	}
+
+	return exp
+}
+
+func compileGitIgnorePattern(line string) (*gitIgnorePattern, error) {
+	line = strings.TrimSuffix(line, "\r")
+
+	// trailing spaces are ignored unless they're escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	pattern := gitIgnorePattern{}
+
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if line == "" {
+		return nil, nil
+	}
+
+	// a slash anywhere but the end anchors the pattern to the folder of the ignore file
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	exp := "^"
+	if !anchored {
+		exp += "(?:.*/)?"
+	}
+
+	segments := strings.Split(line, "/")
+	for i, segment := range segments {
+		if segment == "**" {
+			if i == len(segments)-1 {
+				exp += ".*"
+			} else {
+				exp += "(?:.*/)?"
+			}
+
+			continue
+		}
+
+		exp += translateGitIgnoreSegment(segment)
+
+		if i < len(segments)-1 {
+			exp += "/"
+		}
+	}
+
+	exp += "$"
+
+	var err error
+
+	pattern.exp, err = regexp.Compile(exp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pattern, nil
+}
+
+func compileGitIgnorePatterns(lines []string) []*gitIgnorePattern {
+	patterns := make([]*gitIgnorePattern, 0)
+
+	for _, line := range lines {
+		pattern, err := compileGitIgnorePattern(line)
+		if err != nil || pattern == nil { // git quietly skips anything it can't make sense of too
+			continue
+		}
+
+		patterns = append(patterns, pattern)
+	}
+
+	return patterns
+}
+
+func CompileGitIgnore(path string, lines []string, excludeLines []string) *GitIgnore {
+	g := GitIgnore{
+		Path:            path,
+		Lines:           lines,
+		ExcludeLines:    excludeLines,
+		patterns:        compileGitIgnorePatterns(lines),
+		excludePatterns: compileGitIgnorePatterns(excludeLines),
+	}
+
+	return &g
+}
+
+// match checks relativePath (slash separated, relative to g.Path) against the rules; the last rule to match wins
+func (g *GitIgnore) match(relativePath string, isDir bool, exclude bool) (matched bool, ignored bool) {
+	patterns := g.patterns
+	if exclude {
+		patterns = g.excludePatterns
+	}
+
+	for i := len(patterns) - 1; i >= 0; i-- {
+		pattern := patterns[i]
+
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+
+		if !pattern.exp.MatchString(relativePath) {
+			continue
+		}
+
+		return true, !pattern.negate
+	}
+
+	return false, false
+}
+
+func (g *GitIgnore) equal(other *GitIgnore) bool {
+	return other != nil &&
+		g.Path == other.Path &&
+		strings.Join(g.Lines, "\n") == strings.Join(other.Lines, "\n") &&
+		strings.Join(g.ExcludeLines, "\n") == strings.Join(other.ExcludeLines, "\n")
+}
+
+// gitIgnoreMatcher applies a set of GitIgnores the way git does (deeper folders win, nothing under an ignored folder
+// can be brought back); it remembers the folders it has seen so siblings don't have to work it all out again
+type gitIgnoreMatcher struct {
+	mu              sync.Mutex
+	gitIgnoreByPath map[string]*GitIgnore
+	ignoredByFolder map[string]bool
+}
+
+func getGitIgnoreMatcher(gitIgnoreByPath map[string]*GitIgnore) *gitIgnoreMatcher {
+	m := gitIgnoreMatcher{
+		gitIgnoreByPath: gitIgnoreByPath,
+		ignoredByFolder: make(map[string]bool),
+	}
+
+	return &m
+}
+
+func (m *gitIgnoreMatcher) matches(path string, isDir bool) bool {
+	for _, exclude := range []bool{false, true} {
+		folderPath := filepath.Dir(path)
+
+		for {
+			gitIgnore, ok := m.gitIgnoreByPath[folderPath]
+			if ok {
+				relativePath := filepath.ToSlash(strings.TrimLeft(strings.TrimPrefix(path, folderPath), string(filepath.Separator)))
+
+				matched, ignored := gitIgnore.match(relativePath, isDir, exclude)
+				if matched {
+					return ignored
+				}
+			}
+
+			parentPath := filepath.Dir(folderPath)
+			if parentPath == folderPath {
+				break
+			}
+
+			folderPath = parentPath
+		}
+	}
+
+	return false
+}
+
+func (m *gitIgnoreMatcher) isFolderIgnored(path string) bool {
+	m.mu.Lock()
+	ignored, ok := m.ignoredByFolder[path]
+	m.mu.Unlock()
+
+	if ok {
+		return ignored
+	}
+
+	ignored = m.isIgnored(path, true)
+
+	m.mu.Lock()
+	m.ignoredByFolder[path] = ignored
+	m.mu.Unlock()
+
+	return ignored
+}
+
+func (m *gitIgnoreMatcher) isIgnored(path string, isDir bool) bool {
+	parentPath := filepath.Dir(path)
+	if parentPath != path && m.isFolderIgnored(parentPath) {
+		return true
+	}
+
+	return m.matches(path, isDir)
+}
+
+// getGitDir returns the git folder for a repo whose top is folderPath (if it is one); .git is a file pointing elsewhere
+// for worktrees and submodules
+func getGitDir(folderPath string) (string, bool) {
+	gitPath := filepath.Join(folderPath, ".git")
+
+	info, err := os.Stat(gitPath)
+	if err != nil {
+		return "", false
+	}
+
+	if info.IsDir() {
+		return gitPath, true
+	}
+
+	data, err := os.ReadFile(gitPath)
+	if err != nil {
+		return "", false
+	}
+
+	gitDir := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(data)), "gitdir:"))
+	if gitDir == "" {
+		return "", false
+	}
+
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(folderPath, gitDir)
+	}
+
+	return gitDir, true
+}
+
+// getGitConfigValue is a minimal git config reader for a plain [section] key (the last file to set it wins)
+func getGitConfigValue(configPaths []string, section string, key string) string {
+	value := ""
+
+	for _, configPath := range configPaths {
+		f, err := os.Open(configPath)
+		if err != nil {
+			continue
+		}
+
+		currentSection := ""
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+				continue
+			}
+
+			if strings.HasPrefix(line, "[") {
+				currentSection = strings.ToLower(strings.TrimSpace(strings.Trim(line, "[]")))
+				continue
+			}
+
+			if currentSection != strings.ToLower(section) {
+				continue
+			}
+
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 || strings.ToLower(strings.TrimSpace(parts[0])) != strings.ToLower(key) {
+				continue
+			}
+
+			value = strings.Trim(strings.TrimSpace(parts[1]), "\"")
+		}
+
+		_ = f.Close()
+	}
+
+	return value
+}
+
+func getExcludesFilePath(gitDir string) string {
+	homePath, _ := os.UserHomeDir()
+
+	xdgConfigPath := os.Getenv("XDG_CONFIG_HOME")
+	if xdgConfigPath == "" && homePath != "" {
+		xdgConfigPath = filepath.Join(homePath, ".config")
+	}
+
+	configPaths := make([]string, 0)
+	if xdgConfigPath != "" {
+		configPaths = append(configPaths, filepath.Join(xdgConfigPath, "git", "config"))
+	}
+	if homePath != "" {
+		configPaths = append(configPaths, filepath.Join(homePath, ".gitconfig"))
+	}
+	configPaths = append(configPaths, filepath.Join(gitDir, "config"))
+
+	excludesFilePath := getGitConfigValue(configPaths, "core", "excludesFile")
+	if excludesFilePath == "" {
+		if xdgConfigPath == "" {
+			return ""
+		}
+
+		return filepath.Join(xdgConfigPath, "git", "ignore")
+	}
+
+	if strings.HasPrefix(excludesFilePath, "~/") && homePath != "" {
+		excludesFilePath = filepath.Join(homePath, excludesFilePath[2:])
+	}
+
+	return excludesFilePath
+}
+
+func readLines(path string) ([]string, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return strings.Split(string(data), "\n"), true, nil
+}
+
+// getExcludeLines returns the repo-wide rules for a repo whose top is folderPath (nothing if it isn't one); they're in
+// increasing order of precedence (core.excludesFile and then .git/info/exclude)
+func getExcludeLines(folderPath string) ([]string, bool) {
+	gitDir, ok := getGitDir(folderPath)
+	if !ok {
+		return nil, false
+	}
+
+	excludeLines := make([]string, 0)
+
+	for _, excludePath := range []string{getExcludesFilePath(gitDir), filepath.Join(gitDir, "info", "exclude")} {
+		if excludePath == "" {
+			continue
+		}
+
+		lines, _, err := readLines(excludePath)
+		if err != nil {
+			continue
+		}
+
+		excludeLines = append(excludeLines, lines...)
+	}
+
+	return excludeLines, true
+}
@@ -0,0 +1,225 @@
+package syncer
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCompileGitIgnorePattern(t *testing.T) {
+	type match struct {
+		path  string
+		isDir bool
+		want  bool
+	}
+
+	tests := []struct {
+		line    string
+		negate  bool
+		matches []match
+	}{
+		{
+			line: "*.pyc",
+			matches: []match{
+				{"a.pyc", false, true},
+				{"deep/down/a.pyc", false, true},
+				{"a.py", false, false},
+				{"a.pyc/b", false, false},
+			},
+		},
+		{
+			line: "build/",
+			matches: []match{
+				{"build", true, true},
+				{"src/build", true, true},
+				{"build", false, false},
+			},
+		},
+		{
+			line: "/build",
+			matches: []match{
+				{"build", true, true},
+				{"src/build", true, false},
+			},
+		},
+		{
+			line: "doc/*.txt",
+			matches: []match{
+				{"doc/a.txt", false, true},
+				{"doc/more/a.txt", false, false},
+				{"src/doc/a.txt", false, false},
+			},
+		},
+		{
+			line: "**/logs",
+			matches: []match{
+				{"logs", true, true},
+				{"a/b/logs", true, true},
+				{"a/logs/b", false, false},
+			},
+		},
+		{
+			line: "a/**/b",
+			matches: []match{
+				{"a/b", false, true},
+				{"a/x/b", false, true},
+				{"a/x/y/b", false, true},
+				{"b", false, false},
+			},
+		},
+		{
+			line: "abc/**",
+			matches: []match{
+				{"abc/x", false, true},
+				{"abc/x/y", false, true},
+				{"abc", true, false},
+			},
+		},
+		{
+			line: "file?.[ch]",
+			matches: []match{
+				{"file1.c", false, true},
+				{"fileA.h", false, true},
+				{"file.c", false, false},
+				{"file12.c", false, false},
+				{"file1.o", false, false},
+			},
+		},
+		{
+			line: "[!a]*.go",
+			matches: []match{
+				{"b.go", false, true},
+				{"a.go", false, false},
+			},
+		},
+		{
+			line:   "!keep.pyc",
+			negate: true,
+			matches: []match{
+				{"keep.pyc", false, true},
+			},
+		},
+		{
+			line: "\\!important",
+			matches: []match{
+				{"!important", false, true},
+			},
+		},
+		{
+			line: "\\#hash",
+			matches: []match{
+				{"#hash", false, true},
+			},
+		},
+		{
+			line: "trailing   ",
+			matches: []match{
+				{"trailing", false, true},
+				{"trailing   ", false, false},
+			},
+		},
+		{
+			line: "space\\ ",
+			matches: []match{
+				{"space ", false, true},
+				{"space", false, false},
+			},
+		},
+		{
+			line: "a.b(c)+",
+			matches: []match{
+				{"a.b(c)+", false, true},
+				{"aXb(c)+", false, false},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		pattern, err := compileGitIgnorePattern(test.line)
+		if err != nil {
+			t.Errorf("%q caused %v", test.line, err)
+			continue
+		}
+
+		if pattern == nil {
+			t.Errorf("%q compiled to nothing", test.line)
+			continue
+		}
+
+		if pattern.negate != test.negate {
+			t.Errorf("%q has negate %v; wanted %v", test.line, pattern.negate, test.negate)
+		}
+
+		for _, m := range test.matches {
+			got := pattern.exp.MatchString(m.path) && (!pattern.dirOnly || m.isDir)
+			if got != m.want {
+				t.Errorf("%q matching %q (isDir %v) was %v; wanted %v", test.line, m.path, m.isDir, got, m.want)
+			}
+		}
+	}
+}
+
+func TestCompileGitIgnorePatternWithoutRule(t *testing.T) {
+	for _, line := range []string{"", "   ", "# a comment", "/", "!", "\r"} {
+		pattern, err := compileGitIgnorePattern(line)
+		if err != nil {
+			t.Errorf("%q caused %v", line, err)
+		}
+
+		if pattern != nil {
+			t.Errorf("%q compiled to %v; wanted nothing", line, pattern.exp)
+		}
+	}
+}
+
+func TestGitIgnoreMatcher(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "repo")
+
+	gitIgnoreByPath := map[string]*GitIgnore{
+		root: CompileGitIgnore(
+			root,
+			[]string{"*.log", "!keep.log", "build/", "node_modules", "/secret.txt"},
+			[]string{"*.tmp", "!wanted.tmp", "local.txt"},
+		),
+		filepath.Join(root, "sub"): CompileGitIgnore(
+			filepath.Join(root, "sub"),
+			[]string{"!*.log", "*.txt", "!local.txt"},
+			nil,
+		),
+	}
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"a.log", false, true},
+		{"keep.log", false, false},
+		{"x/a.log", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"build/out.o", false, true},
+		{"build/keep.log", false, true}, // note: nothing under an ignored folder can be brought back
+		{"node_modules/a/b.js", false, true},
+		{"secret.txt", false, true},
+		{"x/secret.txt", false, false},
+		{"a.tmp", false, true},
+		{"wanted.tmp", false, false},
+		{"sub/a.log", false, false}, // note: the deeper folder wins
+		{"sub/deeper/a.log", false, false},
+		{"sub/a.txt", false, true},
+		{"sub/local.txt", false, false}, // note: the exclude rules lose to every ignore file
+		{"local.txt", false, true},
+		{"main.go", false, false},
+	}
+
+	m := getGitIgnoreMatcher(gitIgnoreByPath)
+
+	for _, test := range tests {
+		path := filepath.Join(root, filepath.FromSlash(test.path))
+
+		got := m.isIgnored(path, test.isDir)
+		if got != test.want {
+			t.Errorf("%v (isDir %v) ignored was %v; wanted %v", test.path, test.isDir, got, test.want)
+		}
+	}
+}
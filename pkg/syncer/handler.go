@@ -3,8 +3,8 @@ package syncer
 import (
 	"fmt"
 	"github.com/initialed85/syncer/internal/utils"
-	ignore "github.com/sabhiram/go-gitignore"
 	"log"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -14,38 +14,40 @@ import (
 type Handler struct {
 	mu              sync.Mutex
 	fileByPath      map[string]*File
-	gitIgnoreByPath map[string]*ignore.GitIgnore
+	gitIgnoreByPath map[string]*GitIgnore
 	watcher         *Watcher
 	path            string
 	differ          *Differ
+	sender          *Sender
+	hasher          *Hasher
+	baseFileByPath  map[string]*File
+	baseFromState   bool
+	merkleTree      *merkleTree
 }
 
-func GetHandler(path string, differ *Differ) (*Handler, error) {
+func GetHandler(path string, differ *Differ, sender *Sender, hasher *Hasher) (*Handler, error) {
 	h := Handler{
 		fileByPath:      make(map[string]*File),
-		gitIgnoreByPath: make(map[string]*ignore.GitIgnore),
+		gitIgnoreByPath: make(map[string]*GitIgnore),
 		path:            path,
 		differ:          differ,
+		sender:          sender,
+		hasher:          hasher,
+		merkleTree:      getMerkleTree(path),
 	}
 
 	return &h, nil
 }
 
-func (h *Handler) handleFileByPath(operation Operation, fileByPath map[string]*File) error {
-	commonPath := ""
-	for path := range fileByPath {
-		if commonPath != "" && len(path) > len(commonPath) {
-			continue
-		}
-
-		commonPath = path
-	}
-
+// handleFileByPath updates what we know about everything at or under path (e.g. for Modified, things that weren't found
+// by a walk of path have gone)
+func (h *Handler) handleFileByPath(operation Operation, path string, fileByPath map[string]*File) error {
 	if operation == Created {
 		h.mu.Lock()
 
 		for path, file := range fileByPath {
 			h.fileByPath[path] = file
+			h.merkleTree.set(file)
 		}
 
 		h.mu.Unlock()
@@ -56,27 +58,27 @@ func (h *Handler) handleFileByPath(operation Operation, fileByPath map[string]*F
 
 		for path, file := range fileByPath {
 			h.fileByPath[path] = file
+			h.merkleTree.set(file)
 		}
 
 		pathsToDelete := make([]string, 0)
 
-		if commonPath != "" {
-			for existingPath := range h.fileByPath {
-				if !strings.HasPrefix(existingPath, commonPath) {
-					continue
-				}
-
-				_, ok := fileByPath[existingPath]
-				if ok {
-					continue
-				}
+		for existingPath := range h.fileByPath {
+			if !isUnderAnyPath(existingPath, []string{path}) {
+				continue
+			}
 
-				pathsToDelete = append(pathsToDelete, existingPath)
+			_, ok := fileByPath[existingPath]
+			if ok {
+				continue
 			}
+
+			pathsToDelete = append(pathsToDelete, existingPath)
 		}
 
 		for _, path := range pathsToDelete {
 			delete(h.fileByPath, path)
+			h.merkleTree.remove(path)
 		}
 		h.mu.Unlock()
 	}
@@ -86,18 +88,17 @@ func (h *Handler) handleFileByPath(operation Operation, fileByPath map[string]*F
 
 		pathsToDelete := make([]string, 0)
 
-		for path := range fileByPath {
-			for existingPath := range h.fileByPath {
-				if !strings.HasPrefix(existingPath, path) {
-					continue
-				}
-
-				pathsToDelete = append(pathsToDelete, existingPath)
+		for existingPath := range h.fileByPath {
+			if !isUnderAnyPath(existingPath, []string{path}) {
+				continue
 			}
+
+			pathsToDelete = append(pathsToDelete, existingPath)
 		}
 
 		for _, path := range pathsToDelete {
 			delete(h.fileByPath, path)
+			h.merkleTree.remove(path)
 		}
 
 		h.mu.Unlock()
@@ -106,33 +107,97 @@ func (h *Handler) handleFileByPath(operation Operation, fileByPath map[string]*F
 	return nil
 }
 
-func (h *Handler) handleGitIgnoreByPath(operation Operation, gitIgnoreByPath map[string]*ignore.GitIgnore) error {
-	if operation == Created || operation == Modified {
-		h.mu.Lock()
-		for path, gitIgnore := range gitIgnoreByPath {
-			h.gitIgnoreByPath[path] = gitIgnore
+// isIgnored is true if path would be ignored if it were here (by the flags or by any ignore file we know about)
+func (h *Handler) isIgnored(path string, isDir bool) bool {
+	if folderIgnoreExp.MatchString(path) || fileIgnoreExp.MatchString(path) {
+		return true
+	}
+
+	h.mu.Lock()
+	gitIgnoreByPath := make(map[string]*GitIgnore)
+	for path, gitIgnore := range h.gitIgnoreByPath {
+		gitIgnoreByPath[path] = gitIgnore
+	}
+	h.mu.Unlock()
+
+	return getGitIgnoreMatcher(gitIgnoreByPath).isIgnored(path, isDir)
+}
+
+// filterFileByPath applies all the ignore rules we know about (a walk only knows about the ones it came across, which
+// misses any from above the walked path)
+func (h *Handler) filterFileByPath(fileByPath map[string]*File) map[string]*File {
+	h.mu.Lock()
+	gitIgnoreByPath := make(map[string]*GitIgnore)
+	for path, gitIgnore := range h.gitIgnoreByPath {
+		gitIgnoreByPath[path] = gitIgnore
+	}
+	h.mu.Unlock()
+
+	files, err := GetFilesFromFileByPath(fileByPath)
+	if err != nil {
+		return fileByPath
+	}
+
+	files, err = FilterFiles(files, gitIgnoreByPath)
+	if err != nil {
+		return fileByPath
+	}
+
+	filteredFileByPath, err := GetFileByPathFromFiles(files)
+	if err != nil {
+		return fileByPath
+	}
+
+	return filteredFileByPath
+}
+
+func (h *Handler) hashFileByPath(fileByPath map[string]*File) {
+	h.mu.Lock()
+	lastFileByPath := make(map[string]*File)
+	for path := range fileByPath {
+		lastFile, ok := h.fileByPath[path]
+		if !ok {
+			continue
 		}
-		h.mu.Unlock()
+
+		lastFileByPath[path] = lastFile
 	}
+	h.mu.Unlock()
 
-	if operation == Deleted {
-		h.mu.Lock()
+	h.hasher.hashFiles(fileByPath, lastFileByPath)
+}
+
+// handleGitIgnoreByPath updates the ignore rules we know about for everything at or under path (e.g. rules that weren't
+// found by a walk of path have gone)
+func (h *Handler) handleGitIgnoreByPath(operation Operation, path string, gitIgnoreByPath map[string]*GitIgnore) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if operation == Modified || operation == Deleted {
 		pathsToDelete := make([]string, 0)
 
-		for path := range gitIgnoreByPath {
-			for existingPath := range h.gitIgnoreByPath {
-				if !strings.HasPrefix(existingPath, path) {
-					continue
-				}
+		for existingPath := range h.gitIgnoreByPath {
+			if !isUnderAnyPath(existingPath, []string{path}) {
+				continue
+			}
 
-				pathsToDelete = append(pathsToDelete, existingPath)
+			_, ok := gitIgnoreByPath[existingPath]
+			if ok && operation == Modified {
+				continue
 			}
+
+			pathsToDelete = append(pathsToDelete, existingPath)
 		}
 
 		for _, path := range pathsToDelete {
-			delete(h.fileByPath, path)
+			delete(h.gitIgnoreByPath, path)
+		}
+	}
+
+	if operation == Created || operation == Modified {
+		for path, gitIgnore := range gitIgnoreByPath {
+			h.gitIgnoreByPath[path] = gitIgnore
 		}
-		h.mu.Unlock()
 	}
 
 	return nil
@@ -146,7 +211,7 @@ func (h *Handler) add(path string) {
 		return
 	}
 
-	err = h.handleGitIgnoreByPath(Created, gitIgnoreByPath)
+	err = h.handleGitIgnoreByPath(Created, path, gitIgnoreByPath)
 	if err != nil {
 		log.Printf(
 			"warning: handleGitIgnoreByPath for %#+v caused %v",
@@ -156,7 +221,11 @@ func (h *Handler) add(path string) {
 		return
 	}
 
-	err = h.handleFileByPath(Created, fileByPath)
+	fileByPath = h.filterFileByPath(fileByPath)
+
+	h.hashFileByPath(fileByPath)
+
+	err = h.handleFileByPath(Created, path, fileByPath)
 	if err != nil {
 		log.Printf(
 			"warning: handleFileByPath for %#+v caused %v",
@@ -186,7 +255,7 @@ func (h *Handler) remove(path string) {
 	var err error
 	var fileByPath map[string]*File
 	var folderByPath map[string]*File
-	var gitIgnoreByPath map[string]*ignore.GitIgnore
+	var gitIgnoreByPath map[string]*GitIgnore
 
 	madeAssumptions := false
 
@@ -220,10 +289,10 @@ func (h *Handler) remove(path string) {
 		}
 
 		folderByPath = fileByPath
-		gitIgnoreByPath = make(map[string]*ignore.GitIgnore)
+		gitIgnoreByPath = make(map[string]*GitIgnore)
 	}
 
-	err = h.handleGitIgnoreByPath(Deleted, gitIgnoreByPath)
+	err = h.handleGitIgnoreByPath(Deleted, path, gitIgnoreByPath)
 	if err != nil {
 		log.Printf(
 			"warning: handleGitIgnoreByPath for %#+v caused %v",
@@ -233,7 +302,7 @@ func (h *Handler) remove(path string) {
 		return
 	}
 
-	err = h.handleFileByPath(Deleted, fileByPath)
+	err = h.handleFileByPath(Deleted, path, fileByPath)
 	if err != nil {
 		log.Printf(
 			"warning: handleFileByPath for %#+v caused %v",
@@ -265,7 +334,7 @@ func (h *Handler) update(path string) {
 		return
 	}
 
-	err = h.handleGitIgnoreByPath(Modified, gitIgnoreByPath)
+	err = h.handleGitIgnoreByPath(Modified, path, gitIgnoreByPath)
 	if err != nil {
 		log.Printf(
 			"warning: handleGitIgnoreByPath for %#+v caused %v",
@@ -275,7 +344,11 @@ func (h *Handler) update(path string) {
 		return
 	}
 
-	err = h.handleFileByPath(Modified, fileByPath)
+	fileByPath = h.filterFileByPath(fileByPath)
+
+	h.hashFileByPath(fileByPath)
+
+	err = h.handleFileByPath(Modified, path, fileByPath)
 	if err != nil {
 		log.Printf(
 			"warning: handleFileByPath for %#+v caused %v",
@@ -299,6 +372,17 @@ func (h *Handler) update(path string) {
 	}
 }
 
+// rescan re-walks path for when we know we've missed events for it
+func (h *Handler) rescan(path string) {
+	_, err := os.Lstat(path)
+	if err != nil {
+		h.remove(path)
+		return
+	}
+
+	h.update(path)
+}
+
 func (h *Handler) handleEvent(event *Event) error {
 	path, err := filepath.Abs(event.Name)
 	if err != nil {
@@ -320,6 +404,13 @@ func (h *Handler) handleEvent(event *Event) error {
 
 	utils.DebugLog("event", string(event.Operation), event.Path)
 
+	// the rules for everything in the folder may have changed, so it all needs to be looked at again
+	if isIgnoreFileName(filepath.Base(event.Path)) && isUnderAnyPath(event.ParentPath, []string{h.path}) {
+		log.Printf("re-evaluating %v as %v has changed", event.ParentPath, filepath.Base(event.Path))
+		h.rescan(event.ParentPath)
+		return nil
+	}
+
 	if event.Operation == Created {
 		h.add(event.Path)
 	}
@@ -342,7 +433,45 @@ func (h *Handler) updateDiffer() {
 	h.mu.Unlock()
 
 	h.differ.update(fileByPath)
-	_, _, _ = h.differ.diff()
+	added, removed, modified, moved := h.differ.diff()
+
+	if h.sender == nil {
+		return
+	}
+
+	removedFilePaths := make([]string, 0)
+	for path, file := range removed {
+		if !file.IsDir {
+			removedFilePaths = append(removedFilePaths, path)
+		}
+	}
+
+	// note: reverting means the deletion is still in the next diff (so it goes ahead once it's confirmed)
+	if !h.sender.deleteGuard.allow(deleteSourceDiff, removedFilePaths, h.differ.countLastFiles()) {
+		h.differ.revert()
+		return
+	}
+
+	err := h.sender.send(added, removed, modified, moved)
+	if err != nil {
+		log.Printf("warning: send caused %v; will try again on the next change", err)
+		h.differ.revert()
+	}
+}
+
+// setBase has the first diff be against baseFileByPath (what was last synced) rather than against nothing
+func (h *Handler) setBase(baseFileByPath map[string]*File) {
+	h.mu.Lock()
+	h.baseFileByPath = baseFileByPath
+	h.mu.Unlock()
+}
+
+// setBaseFromState has the first diff be against what's here now (so it's empty), for when something else (see
+// Sender.verify) is going to work out what the other side is missing
+func (h *Handler) setBaseFromState() {
+	h.mu.Lock()
+	h.baseFromState = true
+	h.mu.Unlock()
 }
 
 func (h *Handler) setWatcher(watcher *Watcher) {
@@ -350,8 +479,23 @@ func (h *Handler) setWatcher(watcher *Watcher) {
 	h.watcher = watcher
 	h.mu.Unlock()
 
-	log.Printf("walking %v to build base state", h.path)
-	h.add(h.path)
+	err := h.warmStart()
+	if err != nil {
+		log.Printf("walking %v to build base state (can't warm start because %v)", h.path, err)
+		h.add(h.path)
+	}
+
+	h.mu.Lock()
+	baseFileByPath := h.baseFileByPath
+	h.baseFileByPath = nil
+	if h.baseFromState {
+		baseFileByPath = h.fileByPath
+	}
+	h.mu.Unlock()
+
+	if baseFileByPath != nil { // note: anything that's ignored now is left alone, rather than looking deleted
+		h.differ.setBase(h.filterFileByPath(baseFileByPath))
+	}
 
 	h.updateDiffer()
 }
@@ -0,0 +1,169 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/kalafut/imohash"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+type HashAlgorithm string
+
+const (
+	HashAlgorithmNone    HashAlgorithm = "none"
+	HashAlgorithmImoHash HashAlgorithm = "imohash" // fast; samples large files rather than reading them fully
+	HashAlgorithmXXHash  HashAlgorithm = "xxhash"
+	HashAlgorithmSHA256  HashAlgorithm = "sha256"
+)
+
+var HashAlgorithms = []HashAlgorithm{
+	HashAlgorithmNone,
+	HashAlgorithmImoHash,
+	HashAlgorithmXXHash,
+	HashAlgorithmSHA256,
+}
+
+type Hasher struct {
+	algorithm HashAlgorithm
+	workers   int
+}
+
+func GetHasher(algorithm HashAlgorithm, workers int) (*Hasher, error) {
+	supported := false
+	for _, possibleAlgorithm := range HashAlgorithms {
+		if algorithm == possibleAlgorithm {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		return nil, fmt.Errorf("unsupported hash algorithm %#+v", algorithm)
+	}
+
+	if workers < 1 {
+		return nil, fmt.Errorf("need at least 1 hash worker, got %v", workers)
+	}
+
+	h := Hasher{
+		algorithm: algorithm,
+		workers:   workers,
+	}
+
+	return &h, nil
+}
+
+func sumWithHash(path string, hasher hash.Hash) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	_, err = io.Copy(hasher, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return hasher.Sum(nil), nil
+}
+
+// note: File.Sum is 16 bytes; xxhash fills the first 8 and sha256 is truncated to 16 (plenty for change detection)
+func (h *Hasher) sum(path string) ([16]byte, error) {
+	sum := [16]byte{}
+
+	switch h.algorithm {
+
+	case HashAlgorithmImoHash:
+		return imohash.SumFile(path)
+
+	case HashAlgorithmXXHash:
+		digest := xxhash.New()
+		_, err := sumWithHash(path, digest)
+		if err != nil {
+			return sum, err
+		}
+
+		binary.BigEndian.PutUint64(sum[:8], digest.Sum64())
+
+	case HashAlgorithmSHA256:
+		rawSum, err := sumWithHash(path, sha256.New())
+		if err != nil {
+			return sum, err
+		}
+
+		copy(sum[:], rawSum)
+
+	}
+
+	return sum, nil
+}
+
+// hashFiles sets Sum for the regular files (and symlinks) in fileByPath, using a bounded pool of workers; the Sum from
+// lastFileByPath is reused where the size and modified time are unchanged
+func (h *Hasher) hashFiles(fileByPath map[string]*File, lastFileByPath map[string]*File) {
+	if h.algorithm == HashAlgorithmNone {
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	files := make(chan *File)
+
+	for i := 0; i < h.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for file := range files {
+				sum, err := h.sum(file.Path)
+				if err != nil { // this can occur if things are quickly added then deleted- the file won't have a Sum
+					log.Printf("warning: attempt to %v %v caused %v", h.algorithm, file.Path, err)
+					continue
+				}
+
+				file.Sum = sum
+				file.HasSum = true
+			}
+		}()
+	}
+
+	for path, file := range fileByPath {
+		if file.HasInfo && file.IsSymlink {
+			sum, err := getSymlinkSum(file.Path)
+			if err != nil {
+				log.Printf("warning: attempt to read the symlink %v caused %v", file.Path, err)
+				continue
+			}
+
+			file.Sum = sum
+			file.HasSum = true
+			continue
+		}
+
+		if !file.HasInfo || !file.Mode.IsRegular() {
+			continue
+		}
+
+		lastFile, ok := lastFileByPath[path]
+		if ok && lastFile.HasSum && lastFile.Size == file.Size && lastFile.Modified.Equal(file.Modified) {
+			file.Sum = lastFile.Sum
+			file.HasSum = true
+			continue
+		}
+
+		files <- file
+	}
+
+	close(files)
+
+	wg.Wait()
+}
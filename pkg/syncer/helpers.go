@@ -1,6 +1,10 @@
 package syncer
 
-import "sort"
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
 
 func SortFilesInPlace(files []*File) {
 	sort.SliceStable(
@@ -20,3 +24,42 @@ func CopyFileByPath(fileByPath map[string]*File) map[string]*File {
 
 	return copiedFileByPath
 }
+
+// getOutermostPaths drops any paths that are under other paths (as walking the outer path covers them)
+func getOutermostPaths(pathSet map[string]bool) []string {
+	paths := make([]string, 0)
+	for path := range pathSet {
+		paths = append(paths, path)
+	}
+
+	sort.Strings(paths)
+
+	outermostPaths := make([]string, 0)
+	for _, path := range paths {
+		covered := false
+		for childPath, parentPath := path, filepath.Dir(path); parentPath != childPath; childPath, parentPath = parentPath, filepath.Dir(parentPath) {
+			if pathSet[parentPath] {
+				covered = true
+				break
+			}
+		}
+
+		if covered {
+			continue
+		}
+
+		outermostPaths = append(outermostPaths, path)
+	}
+
+	return outermostPaths
+}
+
+func isUnderAnyPath(path string, paths []string) bool {
+	for _, otherPath := range paths {
+		if path == otherPath || strings.HasPrefix(path, strings.TrimRight(otherPath, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,82 @@
+package syncer
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const syncIgnoreFileName = ".syncignore"
+
+// ignoreFileNames are the files (in gitignore syntax) that can ignore things in their folder and below; .syncignore is
+// for things that should be left out of the sync but that git should still care about
+var ignoreFileNames = []string{
+	".gitignore",
+	syncIgnoreFileName,
+}
+
+type IgnoreConfig struct {
+	IgnoreFolders []string `json:"ignoreFolders"`
+	IgnoreFiles   []string `json:"ignoreFiles"`
+}
+
+func LoadIgnoreConfig(path string) (*IgnoreConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ignoreConfig := IgnoreConfig{}
+
+	err = json.Unmarshal(data, &ignoreConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ignoreConfig, nil
+}
+
+func isIgnoreFileName(name string) bool {
+	for _, ignoreFileName := range ignoreFileNames {
+		if name == ignoreFileName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compileIgnoreFiles compiles the rules from all the ignore files in folderPath as one (as if they were one file), along
+// with the repo-wide rules if folderPath is the top of a git repo
+func compileIgnoreFiles(folderPath string) (*GitIgnore, error) {
+	lines := make([]string, 0)
+
+	found := false
+
+	for _, ignoreFileName := range ignoreFileNames {
+		fileLines, ok, err := readLines(filepath.Join(folderPath, ignoreFileName))
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		found = true
+
+		lines = append(lines, fileLines...)
+	}
+
+	excludeLines, ok := getExcludeLines(folderPath)
+	if ok {
+		found = true
+	}
+
+	if !found {
+		return nil, fs.ErrNotExist
+	}
+
+	return CompileGitIgnore(folderPath, lines, excludeLines), nil
+}
@@ -0,0 +1,309 @@
+package syncer
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	indexVersion    = 2
+	indexFolderName = ".syncer"
+	indexFileName   = "index"
+)
+
+type Index struct {
+	Version         int
+	Path            string
+	FileByPath      map[string]*File
+	GitIgnoreByPath map[string]*GitIgnore
+	IgnoreRules     []string
+}
+
+func getIndexPath(path string) string {
+	return filepath.Join(path, indexFolderName, indexFileName)
+}
+
+func SaveIndex(path string, fileByPath map[string]*File, gitIgnoreByPath map[string]*GitIgnore) error {
+	index := Index{
+		Version:         indexVersion,
+		Path:            path,
+		FileByPath:      fileByPath,
+		GitIgnoreByPath: gitIgnoreByPath,
+		IgnoreRules:     getIgnoreRules(),
+	}
+
+	indexPath := getIndexPath(path)
+
+	err := os.MkdirAll(filepath.Dir(indexPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	// write somewhere else first so a crash can't leave a half-written index
+	f, err := os.CreateTemp(filepath.Dir(indexPath), indexFileName+".*")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(&index)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), indexPath)
+}
+
+func LoadIndex(path string) (*Index, error) {
+	f, err := os.Open(getIndexPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	index := Index{}
+
+	err = gob.NewDecoder(f).Decode(&index)
+	if err != nil {
+		return nil, err
+	}
+
+	if index.Version != indexVersion {
+		return nil, fmt.Errorf("expected index version %v but got %v", indexVersion, index.Version)
+	}
+
+	if index.Path != path {
+		return nil, fmt.Errorf("expected index for %#+v but got %#+v", path, index.Path)
+	}
+
+	return &index, nil
+}
+
+// statFileByPath re-stats everything in fileByPath (skipping anything that's gone)
+func statFileByPath(fileByPath map[string]*File) map[string]*File {
+	wg := sync.WaitGroup{}
+	mu := sync.Mutex{}
+
+	statedFileByPath := make(map[string]*File)
+	paths := make(chan string)
+
+	for i := 0; i < runtime.NumCPU()*4; i++ { // note: stat is mostly waiting on the OS, so we can have lots going
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for path := range paths {
+				info, err := os.Lstat(path)
+				if err != nil {
+					continue
+				}
+
+				file, err := GetFileWithInfo(path, info)
+				if err != nil {
+					continue
+				}
+
+				mu.Lock()
+				statedFileByPath[path] = file
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for path := range fileByPath {
+		paths <- path
+	}
+
+	close(paths)
+
+	wg.Wait()
+
+	return statedFileByPath
+}
+
+// warmStart builds the base state from the index left by the last run rather than walking everything; only folders
+// that have changed (going by their modified time) are listed and only new things in them are walked
+func (h *Handler) warmStart() error {
+	before := time.Now()
+
+	index, err := LoadIndex(h.path)
+	if err != nil {
+		return err
+	}
+
+	if strings.Join(index.IgnoreRules, "\n") != strings.Join(getIgnoreRules(), "\n") {
+		return fmt.Errorf("the ignore rules have changed since the index was saved")
+	}
+
+	fileByPath := statFileByPath(index.FileByPath)
+
+	for path, lastFile := range index.FileByPath {
+		if !isIgnoreFileName(lastFile.Name) {
+			continue
+		}
+
+		file, ok := fileByPath[path]
+		if !ok {
+			return fmt.Errorf("%v has gone since the index was saved", path)
+		}
+
+		if file.Modified.Equal(lastFile.Modified) && file.Size == lastFile.Size {
+			continue
+		}
+
+		return fmt.Errorf("%v has changed since the index was saved", path)
+	}
+
+	// note: this also catches changes to the repo-wide rules (which we don't get events for)
+	gitIgnoreByPath := make(map[string]*GitIgnore)
+	for gitIgnorePath, lastGitIgnore := range index.GitIgnoreByPath {
+		gitIgnore, err := compileIgnoreFiles(gitIgnorePath)
+		if err != nil {
+			return err
+		}
+
+		if !gitIgnore.equal(lastGitIgnore) {
+			return fmt.Errorf("ignore rules for %v have changed since the index was saved", gitIgnorePath)
+		}
+
+		gitIgnoreByPath[gitIgnorePath] = gitIgnore
+	}
+
+	changedFolders := 0
+	walkedPaths := 0
+
+	folders := make([]*File, 0)
+	for _, file := range fileByPath {
+		if !file.IsDir {
+			continue
+		}
+
+		folders = append(folders, file)
+	}
+
+	for _, file := range folders {
+		path := file.Path
+
+		lastFile := index.FileByPath[path]
+		if lastFile.IsDir && file.Modified.Equal(lastFile.Modified) {
+			continue
+		}
+
+		changedFolders++
+
+		var entries []os.DirEntry
+		entries, err = os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			entryPath := filepath.Join(path, entry.Name())
+
+			_, ok := index.FileByPath[entryPath]
+			if ok && lastFile.IsDir {
+				continue
+			}
+
+			if isIgnoreFileName(entry.Name()) {
+				return fmt.Errorf("%v has appeared since the index was saved", entryPath)
+			}
+
+			if entry.Name() == ".git" {
+				_, ok = index.GitIgnoreByPath[path]
+				if !ok {
+					return fmt.Errorf("%v has appeared since the index was saved", entryPath)
+				}
+			}
+
+			// skip the walk for anything we're only going to ignore
+			if folderIgnoreExp.MatchString(entryPath) || fileIgnoreExp.MatchString(entryPath) {
+				continue
+			}
+
+			entryFile := GetFileWithoutInfo(entryPath)
+			entryFile.IsDir = entry.IsDir()
+
+			files, err := FilterFiles([]*File{entryFile}, gitIgnoreByPath)
+			if err != nil {
+				return err
+			}
+
+			if len(files) == 0 {
+				continue
+			}
+
+			walkedPaths++
+
+			walkedFileByPath, _, walkedGitIgnoreByPath, err := GetFileByPathAndFolderByPathAndGitIgnoreByPathForPath(entryPath)
+			if err != nil { // this can occur if things are quickly added then deleted- not much we can do about it
+				continue
+			}
+
+			walkedFiles, err := GetFilesFromFileByPath(walkedFileByPath)
+			if err != nil {
+				return err
+			}
+
+			walkedFiles, err = FilterFiles(walkedFiles, gitIgnoreByPath)
+			if err != nil {
+				return err
+			}
+
+			for _, walkedFile := range walkedFiles {
+				fileByPath[walkedFile.Path] = walkedFile
+			}
+
+			for walkedGitIgnorePath, walkedGitIgnore := range walkedGitIgnoreByPath {
+				gitIgnoreByPath[walkedGitIgnorePath] = walkedGitIgnore
+			}
+		}
+	}
+
+	h.hasher.hashFiles(fileByPath, index.FileByPath)
+
+	h.mu.Lock()
+	h.fileByPath = fileByPath
+	h.gitIgnoreByPath = gitIgnoreByPath
+	h.merkleTree.reset(fileByPath)
+	h.mu.Unlock()
+
+	log.Printf(
+		"warm started from index of %v files; %v folders changed, %v new paths walked in %v",
+		len(index.FileByPath), changedFolders, walkedPaths, time.Since(before),
+	)
+
+	return nil
+}
+
+func (h *Handler) saveIndex() {
+	h.mu.Lock()
+	fileByPath := CopyFileByPath(h.fileByPath)
+	gitIgnoreByPath := h.gitIgnoreByPath
+	h.mu.Unlock()
+
+	err := SaveIndex(h.path, fileByPath, gitIgnoreByPath)
+	if err != nil {
+		log.Printf("warning: attempt to save index for %v caused %v", h.path, err)
+		return
+	}
+
+	log.Printf("saved index of %v files for %v", len(fileByPath), h.path)
+}
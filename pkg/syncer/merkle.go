@@ -0,0 +1,364 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Digest [32]byte
+
+// MerkleEntry is one thing in a folder as far as comparing trees goes; for a folder, Digest covers everything under it
+type MerkleEntry struct {
+	Name   string
+	IsDir  bool
+	Digest Digest
+}
+
+// MerkleListing is a folder (Path is relative to the top of the tree, "." for the top itself) and what's in it
+type MerkleListing struct {
+	Path    string
+	Found   bool
+	Digest  Digest
+	Entries []MerkleEntry
+}
+
+// merkleTree gives every folder a digest made from the names, types and hashes of what's in it (and so of everything
+// under it); two trees can be compared by starting at the top and only going into folders whose digests differ. The
+// digests are worked out when asked for and kept until something under the folder changes.
+type merkleTree struct {
+	mu             sync.Mutex
+	path           string
+	fileByPath     map[string]*File
+	childrenByPath map[string]map[string]bool
+	digestByPath   map[string]Digest
+}
+
+func getMerkleTree(path string) *merkleTree {
+	m := merkleTree{
+		path:           path,
+		fileByPath:     make(map[string]*File),
+		childrenByPath: make(map[string]map[string]bool),
+		digestByPath:   make(map[string]Digest),
+	}
+
+	return &m
+}
+
+// isInTree is true for the things that get synced (so that both sides of a sync have the same tree)
+func isInTree(file *File) bool {
+	return file.IsDir || file.IsSymlink || file.Mode.IsRegular()
+}
+
+func (m *merkleTree) invalidate(path string) {
+	for {
+		delete(m.digestByPath, path)
+
+		if path == m.path || !strings.HasPrefix(path, m.path+"/") {
+			return
+		}
+
+		path = filepath.Dir(path)
+	}
+}
+
+func (m *merkleTree) setLocked(file *File) {
+	if file.Path == m.path || !strings.HasPrefix(file.Path, m.path+"/") {
+		return
+	}
+
+	if !isInTree(file) {
+		m.removeLocked(file.Path)
+		return
+	}
+
+	lastFile, ok := m.fileByPath[file.Path]
+	if ok && lastFile.IsDir && !file.IsDir { // a folder has been replaced by a file
+		m.removeLocked(file.Path)
+	}
+
+	m.fileByPath[file.Path] = file
+
+	children, ok := m.childrenByPath[file.ParentPath]
+	if !ok {
+		children = make(map[string]bool)
+		m.childrenByPath[file.ParentPath] = children
+	}
+	children[file.Path] = true
+
+	m.invalidate(file.Path)
+}
+
+func (m *merkleTree) removeLocked(path string) {
+	for childPath := range m.childrenByPath[path] {
+		m.removeLocked(childPath)
+	}
+
+	delete(m.childrenByPath, path)
+	delete(m.digestByPath, path)
+
+	file, ok := m.fileByPath[path]
+	if !ok {
+		return
+	}
+
+	delete(m.fileByPath, path)
+	delete(m.childrenByPath[file.ParentPath], path)
+
+	m.invalidate(file.ParentPath)
+}
+
+func (m *merkleTree) has(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.fileByPath[path]
+	return ok || path == m.path
+}
+
+func (m *merkleTree) set(file *File) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setLocked(file)
+}
+
+// remove takes out path and everything under it
+func (m *merkleTree) remove(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(path)
+}
+
+// move takes fromPath and everything under it to toPath (in place of anything already there), as a rename would
+func (m *merkleTree) move(fromPath string, toPath string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := make([]*File, 0)
+
+	var addFiles func(path string)
+	addFiles = func(path string) {
+		file, ok := m.fileByPath[path]
+		if !ok {
+			return
+		}
+
+		files = append(files, file)
+
+		for childPath := range m.childrenByPath[path] {
+			addFiles(childPath)
+		}
+	}
+
+	addFiles(fromPath)
+
+	m.removeLocked(fromPath)
+	m.removeLocked(toPath)
+
+	for _, file := range files {
+		movedFile := *file
+		movedFile.Path = toPath + strings.TrimPrefix(file.Path, fromPath)
+		movedFile.ParentPath = filepath.Dir(movedFile.Path)
+		movedFile.Name = filepath.Base(movedFile.Path)
+
+		m.setLocked(&movedFile)
+	}
+}
+
+func (m *merkleTree) getFileByPath() map[string]*File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.fileByPath
+}
+
+// countFiles is how many files (not folders) are in the tree
+func (m *merkleTree) countFiles() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	for _, file := range m.fileByPath {
+		if !file.IsDir {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (m *merkleTree) reset(fileByPath map[string]*File) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fileByPath = make(map[string]*File)
+	m.childrenByPath = make(map[string]map[string]bool)
+	m.digestByPath = make(map[string]Digest)
+
+	for _, file := range fileByPath {
+		m.setLocked(file)
+	}
+}
+
+// update makes the tree match fileByPath (e.g. from a walk), only setting what's changed so that the digests of the
+// folders that nothing under has changed (including their own modified times) are kept
+func (m *merkleTree) update(fileByPath map[string]*File) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for path := range m.fileByPath {
+		_, ok := fileByPath[path]
+		if !ok {
+			m.removeLocked(path)
+		}
+	}
+
+	for path, file := range fileByPath {
+		lastFile, ok := m.fileByPath[path]
+		if ok && lastFile.IsDir == file.IsDir && lastFile.Mode == file.Mode && lastFile.Size == file.Size &&
+			lastFile.Modified.Equal(file.Modified) && lastFile.HasSum == file.HasSum && lastFile.Sum == file.Sum {
+			continue
+		}
+
+		m.setLocked(file)
+	}
+}
+
+// getFileDigest covers what matters for a file (or symlink) being the same on both sides; with no hash (see
+// HashAlgorithmNone) it only goes by the type, permissions and size
+func getFileDigest(file *File) Digest {
+	mode := file.Mode.Type()
+	if file.Mode.IsRegular() { // note: the permissions of a symlink don't mean anything
+		mode |= file.Mode.Perm()
+	}
+
+	buf := make([]byte, 12, 28)
+	binary.BigEndian.PutUint32(buf[:4], uint32(mode))
+	binary.BigEndian.PutUint64(buf[4:], uint64(file.Size))
+	if file.HasSum {
+		buf = append(buf, file.Sum[:]...)
+	}
+
+	return sha256.Sum256(buf)
+}
+
+func (m *merkleTree) getSortedChildren(path string) []*File {
+	children := make([]*File, 0, len(m.childrenByPath[path]))
+	for childPath := range m.childrenByPath[path] {
+		children = append(children, m.fileByPath[childPath])
+	}
+
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name < children[j].Name
+	})
+
+	return children
+}
+
+func (m *merkleTree) getEntry(file *File) MerkleEntry {
+	entry := MerkleEntry{
+		Name:  file.Name,
+		IsDir: file.IsDir,
+	}
+
+	if file.IsDir {
+		entry.Digest = m.getFolderDigest(file.Path)
+	} else {
+		entry.Digest = getFileDigest(file)
+	}
+
+	return entry
+}
+
+func (m *merkleTree) getFolderDigest(path string) Digest {
+	digest, ok := m.digestByPath[path]
+	if ok {
+		return digest
+	}
+
+	h := sha256.New()
+
+	for _, child := range m.getSortedChildren(path) {
+		entry := m.getEntry(child)
+
+		_, _ = h.Write([]byte(entry.Name))
+		_, _ = h.Write([]byte{0})
+		if entry.IsDir {
+			_, _ = h.Write([]byte{1})
+		} else {
+			_, _ = h.Write([]byte{0})
+		}
+		_, _ = h.Write(entry.Digest[:])
+	}
+
+	copy(digest[:], h.Sum(nil))
+
+	m.digestByPath[path] = digest
+
+	return digest
+}
+
+func (m *merkleTree) getPath(relativePath string) string {
+	if relativePath == "." {
+		return m.path
+	}
+
+	return filepath.Join(m.path, filepath.FromSlash(relativePath))
+}
+
+// getListing returns the digest of the folder at relativePath and the entries in it
+func (m *merkleTree) getListing(relativePath string) MerkleListing {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	listing := MerkleListing{
+		Path: relativePath,
+	}
+
+	path := m.getPath(relativePath)
+
+	file, ok := m.fileByPath[path]
+	if path != m.path && (!ok || !file.IsDir) {
+		return listing
+	}
+
+	listing.Found = true
+	listing.Digest = m.getFolderDigest(path)
+
+	for _, child := range m.getSortedChildren(path) {
+		listing.Entries = append(listing.Entries, m.getEntry(child))
+	}
+
+	return listing
+}
+
+// getFilesUnder returns relativePath and everything under it (parents before their children)
+func (m *merkleTree) getFilesUnder(relativePath string) []*File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files := make([]*File, 0)
+
+	var addFiles func(path string)
+	addFiles = func(path string) {
+		file, ok := m.fileByPath[path]
+		if !ok {
+			return
+		}
+
+		files = append(files, file)
+
+		for _, child := range m.getSortedChildren(path) {
+			addFiles(child.Path)
+		}
+	}
+
+	addFiles(m.getPath(relativePath))
+
+	return files
+}
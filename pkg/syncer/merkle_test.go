@@ -0,0 +1,117 @@
+package syncer
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// getTestTreeFileByPath is getTestFileByPath for files that go in a merkleTree (i.e. regular files and folders)
+func getTestTreeFileByPath(files ...*File) map[string]*File {
+	for _, file := range files {
+		file.Mode = 0o644
+		if file.IsDir {
+			file.Mode = fs.ModeDir | 0o755
+		}
+	}
+
+	return getTestFileByPath(files...)
+}
+
+func TestMerkleTreeUpdateKeepsDigests(t *testing.T) {
+	m := getMerkleTree("/l")
+
+	m.update(getTestTreeFileByPath(
+		getTestFile("/l/a", true, 1, 0, 0),
+		getTestFile("/l/a/b.txt", false, 2, 10, 1),
+		getTestFile("/l/c", true, 3, 0, 0),
+		getTestFile("/l/c/d.txt", false, 4, 10, 2),
+	))
+
+	before := m.getListing(".")
+
+	// note: as a walk would find them (new Files, but only a/b.txt has changed)
+	m.update(getTestTreeFileByPath(
+		getTestFile("/l/a", true, 1, 0, 0),
+		getTestFile("/l/a/b.txt", false, 2, 11, 3),
+		getTestFile("/l/c", true, 3, 0, 0),
+		getTestFile("/l/c/d.txt", false, 4, 10, 2),
+	))
+
+	_, ok := m.digestByPath["/l/c"]
+	if !ok {
+		t.Errorf("the digest of c was thrown away though nothing in it changed")
+	}
+
+	_, ok = m.digestByPath["/l/a"]
+	if ok {
+		t.Errorf("the digest of a was kept though a/b.txt changed")
+	}
+
+	if m.getListing(".").Digest == before.Digest {
+		t.Errorf("the digest of the top didn't change")
+	}
+}
+
+func TestReceiverTreeFollowsCommits(t *testing.T) {
+	l := getLoopback(t, 1)
+
+	writeTestFile(t, filepath.Join(l.localPath, "old", "a.txt"), "a")
+	writeTestFile(t, filepath.Join(l.localPath, "old", "sub", "b.txt"), "b")
+	writeTestFile(t, filepath.Join(l.localPath, "c.txt"), "c")
+	writeTestFile(t, filepath.Join(l.localPath, "d.txt"), "d")
+	l.sync(t)
+
+	tree, err := l.receiver.getTree(HashAlgorithmSHA256, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Rename(filepath.Join(l.localPath, "old"), filepath.Join(l.localPath, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Remove(filepath.Join(l.localPath, "d.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(l.localPath, "c.txt"), "c edit")
+	writeTestFile(t, filepath.Join(l.localPath, "e", "f", "g.txt"), "g")
+	l.sync(t)
+
+	requireSameTree(t, l.localPath, l.remotePath)
+
+	// note: without walking it again, it has to be the same as a tree that's walked from scratch
+	sameTree, err := l.receiver.getTree(HashAlgorithmSHA256, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sameTree != tree {
+		t.Fatalf("the tree was built again")
+	}
+
+	fileByPath, err := l.receiver.walkTree(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walkedTree := getMerkleTree(l.remotePath)
+	walkedTree.update(fileByPath)
+
+	for _, relativePath := range []string{".", "new", "new/sub", "e", "e/f"} {
+		got := tree.getListing(relativePath)
+		want := walkedTree.getListing(relativePath)
+
+		if !got.Found || got.Digest != want.Digest {
+			t.Errorf("%v has %v entries in the tree; wanted the %v from a walk", relativePath, len(got.Entries), len(want.Entries))
+		}
+	}
+
+	if tree.has(filepath.Join(l.remotePath, "old")) || tree.has(filepath.Join(l.remotePath, "d.txt")) {
+		t.Errorf("what was moved or deleted is still in the tree")
+	}
+}
@@ -0,0 +1,176 @@
+package syncer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type Move struct {
+	From *File
+	To   *File
+}
+
+// getMoveKeys returns the ways a file can be recognised after it has been moved, best first
+func getMoveKeys(file *File) []string {
+	keys := make([]string, 0)
+
+	if file.Inode != 0 {
+		if file.IsDir {
+			keys = append(keys, fmt.Sprintf("dir:%v", file.Inode))
+		} else {
+			keys = append(keys, fmt.Sprintf("inode:%v:%v:%v", file.Inode, file.Size, file.Modified.UnixNano()))
+		}
+	}
+
+	if !file.IsDir && file.HasSum {
+		keys = append(keys, fmt.Sprintf("sum:%v:%x", file.Size, file.Sum))
+	}
+
+	return keys
+}
+
+func isSameFile(a *File, b *File) bool {
+	if a.IsDir != b.IsDir {
+		return false
+	}
+
+	for _, keyA := range getMoveKeys(a) {
+		for _, keyB := range getMoveKeys(b) {
+			if keyA == keyB {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func getPathsUnder(sortedPaths []string, path string) []string {
+	prefix := path + "/"
+
+	i := sort.SearchStrings(sortedPaths, prefix)
+	j := i
+	for j < len(sortedPaths) && strings.HasPrefix(sortedPaths[j], prefix) {
+		j++
+	}
+
+	return sortedPaths[i:j]
+}
+
+// isCleanFolderMove checks that everything under from went to the same place under to (and nothing else changed),
+// so that renaming the folder is the whole story
+func isCleanFolderMove(from *File, to *File, added, removed map[string]*File, sortedAddedPaths, sortedRemovedPaths []string) bool {
+	removedPaths := getPathsUnder(sortedRemovedPaths, from.Path)
+	addedPaths := getPathsUnder(sortedAddedPaths, to.Path)
+
+	if len(removedPaths) != len(addedPaths) {
+		return false
+	}
+
+	for _, removedPath := range removedPaths {
+		addedFile, ok := added[to.Path+strings.TrimPrefix(removedPath, from.Path)]
+		if !ok {
+			return false
+		}
+
+		if !isSameFile(removed[removedPath], addedFile) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getMoved pairs up added and removed files that are actually the same file; the pairs are taken out of added and
+// removed and returned keyed by the path they were moved to
+func getMoved(added, removed map[string]*File) map[string]*Move {
+	moved := make(map[string]*Move)
+
+	sortedAddedPaths := make([]string, 0, len(added))
+	for path := range added {
+		sortedAddedPaths = append(sortedAddedPaths, path)
+	}
+	sort.Strings(sortedAddedPaths)
+
+	sortedRemovedPaths := make([]string, 0, len(removed))
+	for path := range removed {
+		sortedRemovedPaths = append(sortedRemovedPaths, path)
+	}
+	sort.Strings(sortedRemovedPaths)
+
+	// note: more than one file can have the same key (e.g. identical content); first come first served
+	removedByKey := make(map[string][]*File)
+	for _, path := range sortedRemovedPaths {
+		for _, key := range getMoveKeys(removed[path]) {
+			removedByKey[key] = append(removedByKey[key], removed[path])
+		}
+	}
+
+	used := make(map[string]bool)
+
+	getFrom := func(to *File) *File {
+		for _, key := range getMoveKeys(to) {
+			for _, from := range removedByKey[key] {
+				if used[from.Path] || from.IsDir != to.IsDir {
+					continue
+				}
+
+				if to.IsDir && !isCleanFolderMove(from, to, added, removed, sortedAddedPaths, sortedRemovedPaths) {
+					continue
+				}
+
+				return from
+			}
+		}
+
+		return nil
+	}
+
+	// folders first (shallowest first), so that a clean folder move swallows everything under it
+	for _, path := range sortedAddedPaths {
+		to := added[path]
+		if !to.IsDir || used[path] {
+			continue
+		}
+
+		from := getFrom(to)
+		if from == nil {
+			continue
+		}
+
+		moved[to.Path] = &Move{From: from, To: to}
+		used[from.Path] = true
+		used[to.Path] = true
+
+		for _, removedPath := range getPathsUnder(sortedRemovedPaths, from.Path) {
+			addedPath := to.Path + strings.TrimPrefix(removedPath, from.Path)
+			moved[addedPath] = &Move{From: removed[removedPath], To: added[addedPath]}
+			used[removedPath] = true
+			used[addedPath] = true
+		}
+	}
+
+	for _, path := range sortedAddedPaths {
+		to := added[path]
+		if to.IsDir || used[path] {
+			continue
+		}
+
+		from := getFrom(to)
+		if from == nil {
+			continue
+		}
+
+		moved[to.Path] = &Move{From: from, To: to}
+		used[from.Path] = true
+		used[to.Path] = true
+	}
+
+	for _, move := range moved {
+		delete(added, move.To.Path)
+		delete(removed, move.From.Path)
+	}
+
+	return moved
+}
@@ -0,0 +1,291 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func getTestFile(path string, isDir bool, inode uint64, size int64, sum byte) *File {
+	file := GetFileWithoutInfo(path)
+	file.HasInfo = true
+	file.IsDir = isDir
+	file.Inode = inode
+	file.Size = size
+	file.Modified = time.Unix(1700000000, 0)
+
+	if sum != 0 {
+		file.HasSum = true
+		file.Sum = [16]byte{sum}
+	}
+
+	return file
+}
+
+func getTestFileByPath(files ...*File) map[string]*File {
+	fileByPath := make(map[string]*File)
+	for _, file := range files {
+		fileByPath[file.Path] = file
+	}
+
+	return fileByPath
+}
+
+func getMovedPaths(moved map[string]*Move) []string {
+	movedPaths := make([]string, 0, len(moved))
+	for _, move := range moved {
+		movedPaths = append(movedPaths, move.From.Path+" -> "+move.To.Path)
+	}
+
+	sort.Strings(movedPaths)
+
+	return movedPaths
+}
+
+func TestGetMoved(t *testing.T) {
+	tests := []struct {
+		name        string
+		added       map[string]*File
+		removed     map[string]*File
+		wantMoved   []string
+		wantAdded   int
+		wantRemoved int
+	}{
+		{
+			name:      "by inode",
+			added:     getTestFileByPath(getTestFile("/l/b.txt", false, 1, 10, 0)),
+			removed:   getTestFileByPath(getTestFile("/l/a.txt", false, 1, 10, 0)),
+			wantMoved: []string{"/l/a.txt -> /l/b.txt"},
+		},
+		{
+			name:      "by sum",
+			added:     getTestFileByPath(getTestFile("/l/b.txt", false, 0, 10, 7)),
+			removed:   getTestFileByPath(getTestFile("/l/a.txt", false, 0, 10, 7)),
+			wantMoved: []string{"/l/a.txt -> /l/b.txt"},
+		},
+		{
+			name:        "same inode but a different size",
+			added:       getTestFileByPath(getTestFile("/l/b.txt", false, 1, 11, 0)),
+			removed:     getTestFileByPath(getTestFile("/l/a.txt", false, 1, 10, 0)),
+			wantMoved:   []string{},
+			wantAdded:   1,
+			wantRemoved: 1,
+		},
+		{
+			name:        "different sums",
+			added:       getTestFileByPath(getTestFile("/l/b.txt", false, 0, 10, 7)),
+			removed:     getTestFileByPath(getTestFile("/l/a.txt", false, 0, 10, 8)),
+			wantMoved:   []string{},
+			wantAdded:   1,
+			wantRemoved: 1,
+		},
+		{
+			name:        "nothing to go by",
+			added:       getTestFileByPath(getTestFile("/l/b.txt", false, 0, 10, 0)),
+			removed:     getTestFileByPath(getTestFile("/l/a.txt", false, 0, 10, 0)),
+			wantMoved:   []string{},
+			wantAdded:   1,
+			wantRemoved: 1,
+		},
+		{
+			name:        "a file and a folder",
+			added:       getTestFileByPath(getTestFile("/l/b", true, 1, 10, 0)),
+			removed:     getTestFileByPath(getTestFile("/l/a", false, 1, 10, 0)),
+			wantMoved:   []string{},
+			wantAdded:   1,
+			wantRemoved: 1,
+		},
+		{
+			name: "identical copies",
+			added: getTestFileByPath(
+				getTestFile("/l/c.txt", false, 0, 10, 7),
+				getTestFile("/l/d.txt", false, 0, 10, 7),
+			),
+			removed: getTestFileByPath(
+				getTestFile("/l/a.txt", false, 0, 10, 7),
+				getTestFile("/l/b.txt", false, 0, 10, 7),
+			),
+			wantMoved: []string{"/l/a.txt -> /l/c.txt", "/l/b.txt -> /l/d.txt"},
+		},
+		{
+			name: "more copies than originals",
+			added: getTestFileByPath(
+				getTestFile("/l/b.txt", false, 0, 10, 7),
+				getTestFile("/l/c.txt", false, 0, 10, 7),
+			),
+			removed:   getTestFileByPath(getTestFile("/l/a.txt", false, 0, 10, 7)),
+			wantMoved: []string{"/l/a.txt -> /l/b.txt"},
+			wantAdded: 1,
+		},
+		{
+			name: "a clean folder move",
+			added: getTestFileByPath(
+				getTestFile("/l/new", true, 1, 0, 0),
+				getTestFile("/l/new/a.txt", false, 2, 10, 0),
+				getTestFile("/l/new/sub", true, 3, 0, 0),
+				getTestFile("/l/new/sub/b.txt", false, 4, 10, 0),
+			),
+			removed: getTestFileByPath(
+				getTestFile("/l/old", true, 1, 0, 0),
+				getTestFile("/l/old/a.txt", false, 2, 10, 0),
+				getTestFile("/l/old/sub", true, 3, 0, 0),
+				getTestFile("/l/old/sub/b.txt", false, 4, 10, 0),
+			),
+			wantMoved: []string{
+				"/l/old -> /l/new",
+				"/l/old/a.txt -> /l/new/a.txt",
+				"/l/old/sub -> /l/new/sub",
+				"/l/old/sub/b.txt -> /l/new/sub/b.txt",
+			},
+		},
+		{
+			name: "a folder move with a change in it",
+			added: getTestFileByPath(
+				getTestFile("/l/new", true, 1, 0, 0),
+				getTestFile("/l/new/a.txt", false, 2, 10, 0),
+				getTestFile("/l/new/b.txt", false, 5, 20, 0),
+			),
+			removed: getTestFileByPath(
+				getTestFile("/l/old", true, 1, 0, 0),
+				getTestFile("/l/old/a.txt", false, 2, 10, 0),
+				getTestFile("/l/old/b.txt", false, 4, 10, 0),
+			),
+			wantMoved:   []string{"/l/old/a.txt -> /l/new/a.txt"},
+			wantAdded:   2,
+			wantRemoved: 2,
+		},
+	}
+
+	for _, test := range tests {
+		moved := getMoved(test.added, test.removed)
+
+		movedPaths := getMovedPaths(moved)
+		if len(movedPaths) != len(test.wantMoved) {
+			t.Errorf("%v: moved %v; wanted %v", test.name, movedPaths, test.wantMoved)
+			continue
+		}
+
+		for i := range movedPaths {
+			if movedPaths[i] != test.wantMoved[i] {
+				t.Errorf("%v: moved %v; wanted %v", test.name, movedPaths, test.wantMoved)
+				break
+			}
+		}
+
+		if len(test.added) != test.wantAdded {
+			t.Errorf("%v: %v left added; wanted %v", test.name, len(test.added), test.wantAdded)
+		}
+
+		if len(test.removed) != test.wantRemoved {
+			t.Errorf("%v: %v left removed; wanted %v", test.name, len(test.removed), test.wantRemoved)
+		}
+	}
+}
+
+func TestDifferMoved(t *testing.T) {
+	differ, err := GetDiffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	differ.update(getTestFileByPath(
+		getTestFile("/l", true, 1, 0, 0),
+		getTestFile("/l/a.txt", false, 2, 10, 0),
+		getTestFile("/l/b.txt", false, 3, 10, 0),
+	))
+	_, _, _, _ = differ.diff()
+
+	differ.update(getTestFileByPath(
+		getTestFile("/l", true, 1, 0, 0),
+		getTestFile("/l/c.txt", false, 2, 10, 0),
+		getTestFile("/l/b.txt", false, 3, 10, 0),
+	))
+
+	added, removed, modified, moved := differ.diff()
+	if len(added) != 0 || len(removed) != 0 || len(modified) != 0 {
+		t.Errorf("%v added, %v removed and %v modified; wanted just a move", len(added), len(removed), len(modified))
+	}
+
+	movedPaths := getMovedPaths(moved)
+	if len(movedPaths) != 1 || movedPaths[0] != "/l/a.txt -> /l/c.txt" {
+		t.Errorf("moved %v; wanted /l/a.txt -> /l/c.txt", movedPaths)
+	}
+}
+
+func getTestInode(t *testing.T, path string) uint64 {
+	t.Helper()
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return getInode(info)
+}
+
+func TestSenderToReceiverMoves(t *testing.T) {
+	l := getLoopback(t, 1)
+
+	writeTestFile(t, filepath.Join(l.localPath, "old", "a.txt"), "a\n")
+	writeTestFile(t, filepath.Join(l.localPath, "old", "sub", "b.txt"), "b\n")
+	writeTestFile(t, filepath.Join(l.localPath, "c.txt"), "c\n")
+
+	l.sync(t)
+	requireSameTree(t, l.localPath, l.remotePath)
+
+	inodeA := getTestInode(t, filepath.Join(l.remotePath, "old", "a.txt"))
+	inodeC := getTestInode(t, filepath.Join(l.remotePath, "c.txt"))
+
+	err := os.Rename(filepath.Join(l.localPath, "old"), filepath.Join(l.localPath, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Rename(filepath.Join(l.localPath, "c.txt"), filepath.Join(l.localPath, "new", "d.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.sync(t)
+	requireSameTree(t, l.localPath, l.remotePath)
+
+	// note: a move is a rename on the other side too (rather than the data being sent again)
+	if getTestInode(t, filepath.Join(l.remotePath, "new", "a.txt")) != inodeA {
+		t.Errorf("new/a.txt was written again rather than moved")
+	}
+
+	if getTestInode(t, filepath.Join(l.remotePath, "new", "d.txt")) != inodeC {
+		t.Errorf("new/d.txt was written again rather than moved")
+	}
+}
+
+func TestReceiverMoveWithoutASource(t *testing.T) {
+	l := getLoopback(t, 1)
+
+	writeTestFile(t, filepath.Join(l.localPath, "b.txt"), "b")
+	l.sync(t)
+
+	conn, err := l.sender.getConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = conn.send(&Message{Type: MessageTypeMove, Path: "b.txt", FromPath: "a.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := conn.request(&Message{Type: MessageTypeCommit})
+	if response == nil {
+		t.Fatalf("the receiver didn't respond to a move without a source (%v)", err)
+	}
+
+	if len(response.Failed) != 1 || response.Failed[0] != "b.txt" {
+		t.Errorf("%v failed; wanted just b.txt", response.Failed)
+	}
+
+	// note: what it'd have been moved over is left where it was
+	requireSameTree(t, l.localPath, l.remotePath)
+}
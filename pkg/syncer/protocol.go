@@ -0,0 +1,234 @@
+package syncer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+const (
+	protocolVersion = 11
+	DefaultPort     = 7331
+)
+
+type MessageType string
+
+const (
+	MessageTypeHello  MessageType = "hello"
+	MessageTypeMkdir  MessageType = "mkdir"
+	MessageTypeWrite  MessageType = "write"
+	MessageTypeDelete MessageType = "delete"
+	MessageTypeMove   MessageType = "move"
+	MessageTypeDelta  MessageType = "delta"
+	// MessageTypeSymlink makes a symlink to Target (as it is, so a relative target stays relative)
+	MessageTypeSymlink MessageType = "symlink"
+	// MessageTypeSignatures asks for the block signatures of the receiver's copy of a file (to send a delta against)
+	MessageTypeSignatures MessageType = "signatures"
+	// MessageTypeChunks asks which of some chunks the receiver doesn't have yet
+	MessageTypeChunks       MessageType = "chunks"
+	MessageTypeChunkedWrite MessageType = "chunked_write"
+	// MessageTypeArchive is a lot of small mkdirs, writes and symlinks in one (as a tar stream in Data)
+	MessageTypeArchive MessageType = "archive"
+	// MessageTypeWriteStream is a part of a large file (there's one of these per part, up to one without More)
+	MessageTypeWriteStream MessageType = "write_stream"
+	// MessageTypeDigests asks for the merkle listings of some folders (to compare trees with)
+	MessageTypeDigests MessageType = "digests"
+	MessageTypeCommit  MessageType = "commit"
+	// MessageTypeHandOff has what's been staged on this conn applied with the commit of Window (on another conn)
+	MessageTypeHandOff MessageType = "hand_off"
+	MessageTypeAck     MessageType = "ack"
+)
+
+type Message struct {
+	Type       MessageType
+	Version    int
+	RemotePath string
+	Path       string
+	FromPath   string
+	Data       []byte
+	More       bool
+	Target     string
+	// note: for writes and mkdirs, the permissions and modified time it should end up with
+	Mode       fs.FileMode
+	Modified   time.Time
+	Error      string
+	Failed     []string
+	BlockSize  int
+	Signatures []BlockSignature
+	Ops        []DeltaOp
+	// note: for a delta, the strong checksum of the whole file it should come out as
+	Sum      [16]byte
+	ChunkIDs []ChunkID
+	Chunks   []ChunkData
+	Missing  []ChunkID
+	Paths    []string
+	// note: the digests only compare if both sides hash the same way; Rewalk has the other side walk its tree again
+	// before answering (to catch changes made directly to it)
+	HashAlgorithm HashAlgorithm
+	Rewalk        bool
+	Listings      []MerkleListing
+	// note: the codecs the sender can use (in the hello) and the one the receiver picked (in the ack)
+	Compressions []Compression
+	Compression  Compression
+	// note: the rest are only used for bidirectional syncs
+	Bidirectional bool
+	Reverse       bool
+	HasBase       bool
+	BaseSum       [16]byte
+	Conflicts     []string
+	// note: a window is one commit's worth of changes staged over more than one conn (see Sender.sendWindow); the
+	// commit says how many hand offs to expect
+	Window   string
+	HandOffs int
+}
+
+type Conn struct {
+	conn        io.ReadWriteCloser
+	writer      *bufio.Writer
+	reader      *bufio.Reader
+	encoder     *gob.Encoder
+	decoder     *gob.Decoder
+	frameWriter *frameWriter
+	compression Compression
+}
+
+func GetConn(conn io.ReadWriteCloser) *Conn {
+	writer := bufio.NewWriter(conn)
+	reader := bufio.NewReader(conn)
+
+	c := Conn{
+		conn:    conn,
+		writer:  writer,
+		reader:  reader,
+		encoder: gob.NewEncoder(writer),
+		decoder: gob.NewDecoder(reader),
+	}
+
+	return &c
+}
+
+// setCompression has everything after the hello compressed with compression (both ways); it has to be called at the
+// same point by both sides (i.e. once the ack to the hello is flushed / received)
+func (c *Conn) setCompression(compression Compression) error {
+	if compression == CompressionNone || compression == "" {
+		c.compression = CompressionNone
+		return nil
+	}
+
+	codec, err := getCodec(compression)
+	if err != nil {
+		return err
+	}
+
+	err = c.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	c.frameWriter = &frameWriter{writer: c.conn, codec: codec}
+	c.writer.Reset(c.frameWriter)
+
+	// note: anything already read past the ack is the first of the frames
+	buffered, _ := c.reader.Peek(c.reader.Buffered())
+	frameReader := &frameReader{
+		reader: bufio.NewReader(io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), c.conn)),
+		codec:  codec,
+	}
+
+	c.reader.Reset(frameReader)
+
+	c.compression = compression
+
+	return nil
+}
+
+// send doesn't flush; messages are buffered until the end of the turn (see flush / request)
+func (c *Conn) send(message *Message) error {
+	return c.encoder.Encode(message)
+}
+
+// sendRaw is send for a message with data that's already compressed (so it isn't compressed again)
+func (c *Conn) sendRaw(message *Message) error {
+	if c.frameWriter == nil {
+		return c.send(message)
+	}
+
+	err := c.writer.Flush()
+	if err == nil {
+		err = c.frameWriter.setRaw(true)
+	}
+
+	if err == nil {
+		err = c.send(message)
+	}
+
+	if err == nil {
+		err = c.writer.Flush()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.frameWriter.setRaw(false)
+}
+
+func (c *Conn) flush() error {
+	err := c.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	if c.frameWriter != nil {
+		return c.frameWriter.Flush()
+	}
+
+	return nil
+}
+
+func (c *Conn) receive() (*Message, error) {
+	message := Message{}
+
+	err := c.decoder.Decode(&message)
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+func (c *Conn) request(message *Message) (*Message, error) {
+	err := c.send(message)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.flush()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Type != MessageTypeAck {
+		return nil, fmt.Errorf("expected %#+v in response to %#+v but got %#+v", MessageTypeAck, message.Type, response.Type)
+	}
+
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+
+	return response, nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
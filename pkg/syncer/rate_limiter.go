@@ -0,0 +1,75 @@
+package syncer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errRateLimiterStopped = fmt.Errorf("rate limiter stopped")
+
+// rateLimiter hands out a slot every interval (to however many goroutines are asking) and can be stopped to give up
+// on whatever is waiting for it
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+	stop     chan bool
+	stopped  bool
+}
+
+func getRateLimiter(perSecond int) (*rateLimiter, error) {
+	if perSecond < 1 {
+		return nil, fmt.Errorf("rate must be at least 1 per second, got %v", perSecond)
+	}
+
+	l := rateLimiter{
+		interval: time.Second / time.Duration(perSecond),
+		stop:     make(chan bool),
+	}
+
+	return &l, nil
+}
+
+func (l *rateLimiter) wait() error {
+	select {
+	case <-l.stop:
+		return errRateLimiterStopped
+	default:
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	delay := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-l.stop:
+		return errRateLimiterStopped
+	}
+}
+
+func (l *rateLimiter) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		return
+	}
+
+	l.stopped = true
+	close(l.stop)
+}
@@ -0,0 +1,1073 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/initialed85/syncer/internal/utils"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Receiver struct {
+	mu          sync.Mutex
+	wg          sync.WaitGroup
+	listener    net.Listener
+	conns       map[*Conn]bool
+	remotePath  string
+	chunkStore  *ChunkStore
+	fsync       bool
+	syncState   *SyncState
+	trash       *Trash
+	compression Compression
+	transport   *Transport
+	sender      *Sender
+	stop        chan bool
+	closed      bool
+	// note: batches staged on one conn waiting for the commit of their window on another
+	handOffsByWindow map[string][]*batch
+
+	// note: the paths the other side sends are only ever applied under remotePath (see checkMessage)
+	realRemotePath        string
+	refuseOutsideSymlinks bool
+
+	// note: for answering digest requests when there's no Handler on this side (i.e. not a bidirectional sync)
+	treeMu     sync.Mutex
+	tree       *merkleTree
+	treeHasher *Hasher
+}
+
+func getReceiver(remotePath string, config Config, syncState *SyncState, trash *Trash) (*Receiver, error) {
+	var chunkStore *ChunkStore
+	var err error
+
+	if config.ChunkStoreSize > 0 {
+		chunkStore, err = GetChunkStore(filepath.Join(remotePath, indexFolderName, chunkFolderName), config.ChunkStoreSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	realRemotePath, err := filepath.EvalSymlinks(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// note: anything in the staging folder is from a batch that was never committed
+	err = os.RemoveAll(filepath.Join(remotePath, indexFolderName, stagingFolderName))
+	if err != nil {
+		return nil, err
+	}
+
+	r := Receiver{
+		conns:                 make(map[*Conn]bool),
+		remotePath:            remotePath,
+		realRemotePath:        realRemotePath,
+		refuseOutsideSymlinks: config.RefuseOutsideSymlinks,
+		chunkStore:            chunkStore,
+		fsync:                 config.Fsync,
+		syncState:             syncState,
+		trash:                 trash,
+		compression:           config.Compression,
+		stop:                  make(chan bool),
+	}
+
+	return &r, nil
+}
+
+// GetReceiver returns a Receiver listening on config.ListenAddr; for a bidirectional sync, syncState is shared with sender
+// (which sends this side's changes back over a conn the other side makes for it); trash and transport are optional
+func GetReceiver(
+	remotePath string,
+	config Config,
+	syncState *SyncState,
+	trash *Trash,
+	transport *Transport,
+	sender *Sender,
+) (*Receiver, error) {
+	r, err := getReceiver(remotePath, config, syncState, trash)
+	if err != nil {
+		return nil, err
+	}
+
+	r.transport = transport
+	r.sender = sender
+
+	r.listener, err = net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("listening on %v to receive into %v", r.listener.Addr(), remotePath)
+
+	r.wg.Add(1)
+	go r.run()
+
+	return r, nil
+}
+
+// getReverseReceiver returns a Receiver for the -send side of a bidirectional sync; it keeps a conn to the other side
+// open (using dial) for the other side to send its changes back over
+func getReverseReceiver(localPath string, config Config, syncState *SyncState, trash *Trash, dial func() (*Conn, error)) (*Receiver, error) {
+	config.Compression = CompressionNone // note: the hello is the other way
+
+	r, err := getReceiver(localPath, config, syncState, trash)
+	if err != nil {
+		return nil, err
+	}
+
+	r.wg.Add(1)
+	go r.runReverse(dial)
+
+	return r, nil
+}
+
+func (r *Receiver) addConn(conn *Conn) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	r.conns[conn] = true
+
+	return true
+}
+
+func (r *Receiver) removeConn(conn *Conn) {
+	r.mu.Lock()
+	delete(r.conns, conn)
+	r.mu.Unlock()
+}
+
+func (r *Receiver) run() {
+	defer r.wg.Done()
+
+	for {
+		rawConn, err := r.listener.Accept()
+		if err != nil { // the listener has been closed
+			return
+		}
+
+		r.wg.Add(1)
+		go func(rawConn net.Conn, remoteAddr net.Addr) {
+			defer r.wg.Done()
+
+			// note: in its own goroutine, so that one slow handshake doesn't hold up anybody else
+			secureConn, err := r.transport.server(rawConn)
+			if err != nil {
+				log.Printf("warning: handshake with %v failed: %v", remoteAddr, err)
+				_ = rawConn.Close()
+				return
+			}
+
+			conn := GetConn(secureConn)
+
+			if !r.addConn(conn) {
+				_ = conn.Close()
+				return
+			}
+
+			log.Printf("accepted %v", remoteAddr)
+
+			reverse, err := r.handleHello(conn)
+			if err == nil && reverse { // the sender has this one now
+				r.removeConn(conn)
+				r.sender.setConn(conn, remoteAddr.String())
+				return
+			}
+
+			if err == nil {
+				err = r.handleConn(conn)
+			}
+
+			if err != nil && err != io.EOF {
+				log.Printf("warning: conn from %v caused %v", remoteAddr, err)
+			}
+
+			r.removeConn(conn)
+
+			_ = conn.Close()
+
+			log.Printf("closed %v", remoteAddr)
+		}(rawConn, rawConn.RemoteAddr())
+	}
+}
+
+func (r *Receiver) runReverse(dial func() (*Conn, error)) {
+	defer r.wg.Done()
+
+	for {
+		conn, err := dial()
+		if err == nil {
+			if !r.addConn(conn) {
+				_ = conn.Close()
+				return
+			}
+
+			log.Printf("receiving changes back into %v", r.remotePath)
+
+			err = r.handleConn(conn)
+
+			r.removeConn(conn)
+
+			_ = conn.Close()
+		}
+
+		if err != nil && err != io.EOF {
+			log.Printf("warning: conn to receive changes back caused %v; will try again", err)
+		}
+
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+// isSamePath is true if the path the sender asked for is remotePath; a relative one is relative to where this side is
+// running (e.g. the home folder, when it was started over ssh)
+func isSamePath(path string, remotePath string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	return path == filepath.Clean(remotePath)
+}
+
+// handleHello returns true for a reverse conn (one that this side's changes should be sent back over)
+func (r *Receiver) handleHello(conn *Conn) (bool, error) {
+	message, err := conn.receive()
+	if err != nil {
+		return false, err
+	}
+
+	response := Message{
+		Type: MessageTypeAck,
+	}
+
+	if message.Type != MessageTypeHello {
+		err = fmt.Errorf("expected %#+v but got %#+v", MessageTypeHello, message.Type)
+	} else if message.Version != protocolVersion {
+		err = fmt.Errorf("expected version %v but got %v", protocolVersion, message.Version)
+	} else if !isSamePath(message.RemotePath, r.remotePath) {
+		err = fmt.Errorf("sender wants to sync to %#+v but this receiver is for %#+v", message.RemotePath, r.remotePath)
+	} else if message.Bidirectional != (r.sender != nil) {
+		err = fmt.Errorf("sender has bidirectional=%v but this receiver has bidirectional=%v", message.Bidirectional, r.sender != nil)
+	}
+
+	if err != nil {
+		response.Error = err.Error()
+	} else {
+		response.Compression = pickCompression(r.compression, message.Compressions)
+	}
+
+	_ = conn.send(&response)
+	_ = conn.flush()
+
+	if err == nil {
+		err = conn.setCompression(response.Compression)
+	}
+
+	return message.Reverse, err
+}
+
+// handOff keeps b to be applied with the commit of window
+func (r *Receiver) handOff(window string, b *batch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handOffsByWindow == nil {
+		r.handOffsByWindow = make(map[string][]*batch)
+	}
+
+	r.handOffsByWindow[window] = append(r.handOffsByWindow[window], b)
+}
+
+// takeHandOffs returns the batches handed off for window (which are then the caller's to apply or discard)
+func (r *Receiver) takeHandOffs(window string) []*batch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	handOffs := r.handOffsByWindow[window]
+	delete(r.handOffsByWindow, window)
+
+	return handOffs
+}
+
+// dropHandOff discards b if it's still waiting for the commit of window
+func (r *Receiver) dropHandOff(window string, b *batch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	handOffs := r.handOffsByWindow[window]
+
+	for i, otherB := range handOffs {
+		if otherB != b {
+			continue
+		}
+
+		b.discard()
+
+		r.handOffsByWindow[window] = append(handOffs[:i], handOffs[i+1:]...)
+		if len(r.handOffsByWindow[window]) == 0 {
+			delete(r.handOffsByWindow, window)
+		}
+
+		return
+	}
+}
+
+func (r *Receiver) handleConn(conn *Conn) error {
+	b := &batch{}
+
+	// note: a conn only has one hand off at a time, as the next window doesn't start until the last is committed
+	var handedOff *batch
+	handedOffWindow := ""
+
+	defer func() {
+		b.discard() // note: anything staged when the conn goes is never applied
+
+		// note: nor is anything handed off that hasn't been committed yet (its commit is refused, as it's short)
+		if handedOff != nil {
+			r.dropHandOff(handedOffWindow, handedOff)
+		}
+	}()
+
+	for {
+		message, err := conn.receive()
+		if err != nil {
+			return err
+		}
+
+		err = r.checkMessage(message)
+		if err != nil {
+			b.addRejection(message, err)
+
+			if message.Type == MessageTypeSignatures || message.Type == MessageTypeDigests { // note: these want an answer
+				err = conn.send(&Message{Type: MessageTypeAck, Error: err.Error()})
+				if err == nil {
+					err = conn.flush()
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		if message.Type == MessageTypeHandOff {
+			if handedOff != nil {
+				r.dropHandOff(handedOffWindow, handedOff)
+			}
+
+			r.handOff(message.Window, b)
+			handedOff = b
+			handedOffWindow = message.Window
+
+			b = &batch{}
+
+			err = conn.send(&Message{Type: MessageTypeAck})
+			if err == nil {
+				err = conn.flush()
+			}
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if message.Type == MessageTypeCommit {
+			if message.Window != "" {
+				handOffs := r.takeHandOffs(message.Window)
+
+				if len(handOffs) != message.HandOffs { // note: a conn went before its commit; none of the window is applied
+					for _, handedOff := range handOffs {
+						handedOff.discard()
+					}
+
+					return fmt.Errorf("expected %v hand offs for the commit but got %v", message.HandOffs, len(handOffs))
+				}
+
+				for _, handedOff := range handOffs {
+					b.merge(handedOff)
+				}
+			}
+
+			r.commit(b)
+
+			response := Message{
+				Type:      MessageTypeAck,
+				Error:     strings.Join(b.errs, "; "),
+				Failed:    b.failed,
+				Conflicts: b.conflicts,
+			}
+
+			err = conn.send(&response)
+			if err != nil {
+				return err
+			}
+
+			err = conn.flush()
+			if err != nil {
+				return err
+			}
+
+			b = &batch{}
+
+			if r.chunkStore != nil {
+				r.chunkStore.prune()
+			}
+
+			if r.trash != nil {
+				r.trash.prune()
+			}
+
+			if r.syncState != nil {
+				r.syncState.saveIfDue()
+			}
+
+			continue
+		}
+
+		if message.Type == MessageTypeChunks {
+			err = r.handleChunks(conn, message)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if message.Type == MessageTypeDigests {
+			err = r.handleDigests(conn, message)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if message.Type == MessageTypeSignatures {
+			// note: the signatures have to be of what the delta is going to be applied to (see Receiver.stage)
+			err = r.handleSignatures(conn, message, b.getBasePath(r.getPath(message.Path), r.getPath))
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		switch message.Type {
+		case MessageTypeArchive:
+			err = r.stageArchive(b, message)
+		case MessageTypeWriteStream:
+			err = r.stageStream(b, message)
+		default:
+			err = r.stage(b, message)
+		}
+
+		if err != nil {
+			b.addError(message, err)
+		}
+	}
+}
+
+// handleSignatures answers straight away (rather than at the commit) as the sender needs them to make the delta; they're
+// of what's at basePath (see batch.getBasePath)
+func (r *Receiver) handleSignatures(conn *Conn, message *Message, basePath string) error {
+	response := Message{
+		Type: MessageTypeAck,
+	}
+
+	if message.BlockSize < minDeltaBlockSize || message.BlockSize > maxDeltaBlockSize {
+		response.Error = fmt.Sprintf("unsupported block size %v", message.BlockSize)
+	} else if basePath == "" {
+		response.Error = fmt.Sprintf("there won't be anything at %v once the changes before it are applied", message.Path)
+	} else {
+		signatures, err := getSignaturesForPath(basePath, message.BlockSize)
+		if err != nil {
+			response.Error = err.Error()
+		}
+
+		response.Signatures = signatures
+	}
+
+	err := conn.send(&response)
+	if err != nil {
+		return err
+	}
+
+	return conn.flush()
+}
+
+// walkTree returns everything under r.remotePath that isn't ignored, hashed with r.treeHasher (reusing the Sum from
+// lastFileByPath for anything that hasn't changed)
+func (r *Receiver) walkTree(lastFileByPath map[string]*File) (map[string]*File, error) {
+	fileByPath, _, gitIgnoreByPath, err := GetFileByPathAndFolderByPathAndGitIgnoreByPathForPath(r.remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := GetFilesFromFileByPath(fileByPath)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err = FilterFiles(files, gitIgnoreByPath)
+	if err != nil {
+		return nil, err
+	}
+
+	fileByPath, err = GetFileByPathFromFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	r.treeHasher.hashFiles(fileByPath, lastFileByPath)
+
+	return fileByPath, nil
+}
+
+// getTree returns a merkleTree for this side; it's kept up to date by each commit (see updateTree), but nothing watches
+// this side, so if refresh is set it's walked again to catch changes made directly to it (only the files whose size or
+// modified time changed get hashed again, and only the folders with something changed under them get new digests)
+func (r *Receiver) getTree(hashAlgorithm HashAlgorithm, refresh bool) (*merkleTree, error) {
+	if r.sender != nil && r.sender.localTree != nil { // the Handler on this side keeps one
+		if r.sender.hashAlgorithm != hashAlgorithm {
+			return nil, fmt.Errorf("sender hashes with %v but this side hashes with %v", hashAlgorithm, r.sender.hashAlgorithm)
+		}
+
+		return r.sender.localTree, nil
+	}
+
+	r.treeMu.Lock()
+	defer r.treeMu.Unlock()
+
+	built := r.tree != nil && r.treeHasher.algorithm == hashAlgorithm
+	if built && !refresh {
+		return r.tree, nil
+	}
+
+	before := time.Now()
+
+	var lastFileByPath map[string]*File
+
+	if built {
+		lastFileByPath = r.tree.getFileByPath()
+	} else {
+		hasher, err := GetHasher(hashAlgorithm, runtime.NumCPU())
+		if err != nil {
+			return nil, err
+		}
+
+		r.treeHasher = hasher
+	}
+
+	fileByPath, err := r.walkTree(lastFileByPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.tree == nil {
+		r.tree = getMerkleTree(r.remotePath)
+	}
+
+	r.tree.update(fileByPath)
+
+	utils.DebugLog("receiver", "walked", fmt.Sprintf("%v files for the merkle tree in %v", len(fileByPath), time.Since(before)))
+
+	return r.tree, nil
+}
+
+// updateTree catches the tree up (if it's been built) with what applying change did, so that it only has to be walked
+// again to catch changes made directly to this side (see getTree)
+func (r *Receiver) updateTree(change *stagedChange) {
+	r.treeMu.Lock()
+	defer r.treeMu.Unlock()
+
+	if r.tree == nil {
+		return
+	}
+
+	paths := []string{change.path}
+	if change.message.Type == MessageTypeMove {
+		paths = append(paths, r.getPath(change.message.FromPath))
+	}
+
+	// note: what's renamed keeps its hashes (and so do the folders it's in, if nothing else changed in them)
+	for _, rename := range change.renames {
+		r.tree.move(rename[0], rename[1])
+		paths = append(paths, rename[0], rename[1])
+	}
+
+	written := change.message.Type != MessageTypeMove && change.message.Type != MessageTypeMkdir
+
+	for _, path := range paths {
+		r.updateTreePath(path, written && path == change.path)
+	}
+}
+
+// updateTreePath sets (or removes, if it's gone) the one thing at path in the tree, along with any of the folders it's
+// in that the tree doesn't have yet; unless rehash is set, its Sum is reused if its size and modified time haven't
+// changed
+func (r *Receiver) updateTreePath(path string, rehash bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		r.tree.remove(path)
+		return
+	}
+
+	if folderIgnoreExp.MatchString(path) || fileIgnoreExp.MatchString(path) {
+		return
+	}
+
+	file, err := GetFileWithInfo(path, info)
+	if err != nil {
+		return
+	}
+
+	lastFileByPath := r.tree.getFileByPath()
+	if rehash {
+		lastFileByPath = nil
+	}
+
+	r.treeHasher.hashFiles(map[string]*File{path: file}, lastFileByPath)
+
+	r.tree.set(file)
+
+	for folderPath := filepath.Dir(path); folderPath != r.remotePath && !r.tree.has(folderPath); folderPath = filepath.Dir(folderPath) {
+		info, err = os.Lstat(folderPath)
+		if err != nil {
+			return
+		}
+
+		folder, err := GetFileWithInfo(folderPath, info)
+		if err != nil {
+			return
+		}
+
+		r.tree.set(folder)
+	}
+}
+
+func (r *Receiver) handleDigests(conn *Conn, message *Message) error {
+	response := Message{
+		Type:     MessageTypeAck,
+		Listings: make([]MerkleListing, 0),
+	}
+
+	tree, err := r.getTree(message.HashAlgorithm, message.Rewalk)
+	if err != nil {
+		response.Error = err.Error()
+	} else {
+		for _, path := range message.Paths {
+			response.Listings = append(response.Listings, tree.getListing(path))
+		}
+	}
+
+	err = conn.send(&response)
+	if err != nil {
+		return err
+	}
+
+	return conn.flush()
+}
+
+func (r *Receiver) handleChunks(conn *Conn, message *Message) error {
+	response := Message{
+		Type:    MessageTypeAck,
+		Missing: make([]ChunkID, 0),
+	}
+
+	if r.chunkStore == nil { // note: chunks sent earlier in a batch have to be kept for later files to refer to
+		response.Error = "this receiver has no chunk store"
+	} else {
+		for _, id := range message.ChunkIDs {
+			if r.chunkStore.has(id) {
+				continue
+			}
+
+			response.Missing = append(response.Missing, id)
+		}
+	}
+
+	err := conn.send(&response)
+	if err != nil {
+		return err
+	}
+
+	return conn.flush()
+}
+
+func (r *Receiver) getChunkedData(message *Message) ([]byte, error) {
+	if r.chunkStore == nil {
+		return nil, fmt.Errorf("this receiver has no chunk store")
+	}
+
+	dataByID := make(map[ChunkID][]byte)
+
+	for _, chunk := range message.Chunks {
+		err := r.chunkStore.put(chunk.ID, chunk.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		dataByID[chunk.ID] = chunk.Data
+	}
+
+	data := make([]byte, 0)
+
+	for _, id := range message.ChunkIDs {
+		chunkData, ok := dataByID[id]
+		if !ok {
+			var err error
+
+			chunkData, err = r.chunkStore.get(id)
+			if err != nil {
+				return nil, fmt.Errorf("chunk %v is missing: %v", id, err)
+			}
+		}
+
+		data = append(data, chunkData...)
+	}
+
+	return data, nil
+}
+
+func (r *Receiver) getPath(relativePath string) string {
+	return filepath.Join(r.remotePath, filepath.FromSlash(relativePath))
+}
+
+// write renames the staged content (or symlink) into place, unless (for a bidirectional sync) it conflicts with a change on this side
+// that wins; it returns a description of any conflict
+func (r *Receiver) write(change *stagedChange) (string, error) {
+	path := change.path
+	message := change.message
+
+	conflictDescription := ""
+
+	if r.syncState != nil {
+		conflict, err := r.syncState.checkWrite(path, message, change.sum)
+		if err != nil {
+			return "", err
+		}
+
+		if conflict != nil {
+			keptSide := r.syncState.getSideName(conflict.keepIncoming)
+			otherSide := r.syncState.getSideName(!conflict.keepIncoming)
+
+			conflictDescription = fmt.Sprintf(
+				"%v was changed on both sides; kept the %v version (%v)",
+				message.Path, keptSide, conflict.reason,
+			)
+
+			conflictPath := ""
+			if conflict.keepBoth {
+				conflictPath = getConflictPath(path)
+				conflictDescription += fmt.Sprintf(" and put the %v version at %v", otherSide, filepath.Base(conflictPath))
+			}
+
+			if !conflict.keepIncoming {
+				if conflictPath != "" {
+					err = r.rename(change, change.tempPath, conflictPath)
+					if err != nil {
+						return conflictDescription, err
+					}
+
+					change.tempPath = ""
+				}
+
+				return conflictDescription, nil
+			}
+
+			if conflictPath != "" {
+				err = r.rename(change, path, conflictPath)
+				if err != nil {
+					return conflictDescription, err
+				}
+			}
+		}
+	}
+
+	info, err := os.Lstat(path)
+	if err == nil && info.IsDir() { // it's been replaced by a file on the other side (see SyncState.checkWrite otherwise)
+		err = r.remove(change, path)
+		if err != nil {
+			return conflictDescription, err
+		}
+	} else if err == nil && r.trash != nil {
+		err = r.trash.keep(change.trashName, path)
+		if err != nil { // note: it's left as it was rather than overwritten without a copy to go back to
+			return conflictDescription, fmt.Errorf("attempt to keep %v in the trash caused %v; left it as it was", path, err)
+		}
+	}
+
+	// note: if it was staged in the staging folder, the folder it's going to might only just have been made
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return conflictDescription, err
+	}
+
+	err = r.rename(change, change.tempPath, path)
+	if err != nil {
+		return conflictDescription, err
+	}
+
+	change.tempPath = ""
+
+	if r.syncState != nil {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return conflictDescription, err
+		}
+
+		r.syncState.set(message.Path, getSyncRecord(change.sum, info))
+	}
+
+	return conflictDescription, nil
+}
+
+// rename is os.Rename, noted in change so that the tree can follow it (see updateTree)
+func (r *Receiver) rename(change *stagedChange, fromPath string, toPath string) error {
+	err := os.Rename(fromPath, toPath)
+	if err != nil {
+		return err
+	}
+
+	change.renames = append(change.renames, [2]string{fromPath, toPath})
+
+	return nil
+}
+
+// remove gets path (and everything under it) out of the way, into the trash if there is one
+func (r *Receiver) remove(change *stagedChange, path string) error {
+	if r.trash == nil {
+		return os.RemoveAll(path)
+	}
+
+	err := r.trash.put(change.trashName, path)
+	if err != nil {
+		return fmt.Errorf("attempt to trash %v caused %v; left it as it was", path, err)
+	}
+
+	return nil
+}
+
+func (r *Receiver) delete(change *stagedChange) (string, error) {
+	path := change.path
+	message := change.message
+
+	if r.syncState != nil {
+		changed, err := r.syncState.checkDelete(path, message)
+		if err != nil {
+			return "", err
+		}
+
+		if changed { // note: it'll be sent back as the other side no longer has it
+			return fmt.Sprintf("%v was deleted on the other side but changed on this side; kept it", message.Path), nil
+		}
+	}
+
+	err := r.remove(change, path)
+	if err != nil {
+		return "", err
+	}
+
+	if r.syncState != nil {
+		r.syncState.forget(message.Path)
+	}
+
+	return "", nil
+}
+
+// move renames the thing at FromPath to path, unless (for a bidirectional sync) what's already at path has changed on
+// this side and wins; it returns a description of any conflict
+func (r *Receiver) move(change *stagedChange) (string, error) {
+	path := change.path
+	message := change.message
+	fromPath := r.getPath(message.FromPath)
+
+	// note: anything that'd stop the rename is checked before what's at path is cleared out of the way
+	fromInfo, err := os.Lstat(fromPath)
+	if err != nil {
+		return "", err
+	}
+
+	if isUnderRelativePath(message.Path, message.FromPath) || isUnderRelativePath(message.FromPath, message.Path) {
+		return "", fmt.Errorf("%v can't be moved to %v as one is in the other", message.FromPath, message.Path)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	conflictDescription := ""
+
+	if r.syncState != nil {
+		conflict, err := r.syncState.checkMove(path, fromPath, message)
+		if err != nil {
+			return "", err
+		}
+
+		if conflict != nil {
+			keptSide := r.syncState.getSideName(conflict.keepIncoming)
+			otherSide := r.syncState.getSideName(!conflict.keepIncoming)
+
+			conflictDescription = fmt.Sprintf(
+				"%v was moved over %v, which was changed on this side; kept the %v version (%v)",
+				message.FromPath, message.Path, keptSide, conflict.reason,
+			)
+
+			conflictPath := ""
+			if conflict.keepBoth {
+				conflictPath = getConflictPath(path)
+				conflictDescription += fmt.Sprintf(" and put the %v version at %v", otherSide, filepath.Base(conflictPath))
+			}
+
+			if !conflict.keepIncoming {
+				// note: the other side doesn't have it where it was any more, so it doesn't stay there on this side either
+				if conflictPath != "" {
+					err = r.rename(change, fromPath, conflictPath)
+				} else {
+					err = r.remove(change, fromPath)
+				}
+
+				if err != nil {
+					return conflictDescription, err
+				}
+
+				r.syncState.forget(message.FromPath)
+
+				return conflictDescription, nil
+			}
+
+			if conflictPath != "" {
+				err = r.rename(change, path, conflictPath)
+				if err != nil {
+					return conflictDescription, err
+				}
+			}
+		}
+	}
+
+	// note: unless it's the same thing (e.g. only the case of the name has changed)
+	info, err := os.Lstat(path)
+	if err == nil && !os.SameFile(info, fromInfo) {
+		err = r.remove(change, path)
+		if err != nil {
+			return conflictDescription, err
+		}
+	}
+
+	err = r.rename(change, fromPath, path)
+	if err != nil {
+		return conflictDescription, err
+	}
+
+	if r.syncState != nil {
+		r.syncState.forget(message.Path)
+		r.syncState.move(message.FromPath, message.Path)
+	}
+
+	return conflictDescription, nil
+}
+
+// apply returns a description of any conflict (for a bidirectional sync) along with any error
+func (r *Receiver) apply(change *stagedChange) (string, error) {
+	message := change.message
+	path := change.path
+
+	utils.DebugLog("receiver", string(message.Type), path)
+
+	// note: things may have changed since it was staged (e.g. a folder it's in has been replaced by a symlink)
+	err := r.checkParents(path)
+	if err == nil && message.Type == MessageTypeMove {
+		err = r.checkParents(r.getPath(message.FromPath))
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	switch message.Type {
+
+	case MessageTypeMkdir:
+		info, err := os.Lstat(path)
+		if err == nil && !info.IsDir() { // it's been replaced by a folder on the other side
+			if r.syncState != nil {
+				return "", fmt.Errorf("%v isn't a folder", path)
+			}
+
+			err = r.remove(change, path)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		err = os.MkdirAll(path, 0755)
+		if err != nil {
+			return "", err
+		}
+
+		if message.Mode != 0 {
+			err = os.Chmod(path, message.Mode.Perm())
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if r.syncState != nil {
+			info, err := os.Lstat(path)
+			if err != nil {
+				return "", err
+			}
+
+			r.syncState.set(message.Path, getSyncRecord([16]byte{}, info))
+		}
+
+		return "", nil
+
+	case MessageTypeWrite, MessageTypeDelta, MessageTypeChunkedWrite, MessageTypeSymlink:
+		return r.write(change)
+
+	case MessageTypeDelete:
+		return r.delete(change)
+
+	case MessageTypeMove:
+		return r.move(change)
+
+	}
+
+	return "", fmt.Errorf("unsupported message type %#+v", message.Type)
+}
+
+func (r *Receiver) Close() {
+	r.mu.Lock()
+	r.closed = true
+	for conn := range r.conns {
+		_ = conn.Close()
+	}
+	r.mu.Unlock()
+
+	close(r.stop)
+
+	if r.listener != nil {
+		_ = r.listener.Close()
+	}
+
+	r.wg.Wait()
+}
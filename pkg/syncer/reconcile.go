@@ -0,0 +1,89 @@
+package syncer
+
+import (
+	"log"
+	"time"
+)
+
+const DefaultReconcileRate = 10000
+
+// getDiscrepancies compares a (background) walk with what we think is there and returns the paths that don't agree;
+// note: the walk is slow so things may have changed since, but the worst that does is cause a needless rescan
+func (h *Handler) getDiscrepancies(walkedFileByPath map[string]*File) []string {
+	h.mu.Lock()
+	fileByPath := CopyFileByPath(h.fileByPath)
+	h.mu.Unlock()
+
+	paths := make([]string, 0)
+
+	for path, walkedFile := range walkedFileByPath {
+		file, ok := fileByPath[path]
+		if !ok {
+			paths = append(paths, path)
+			continue
+		}
+
+		if file.IsDir != walkedFile.IsDir {
+			paths = append(paths, path)
+			continue
+		}
+
+		if file.IsDir { // folder modified times only change because of their contents, which get compared anyway
+			continue
+		}
+
+		if file.Size != walkedFile.Size || !file.Modified.Equal(walkedFile.Modified) {
+			paths = append(paths, path)
+		}
+	}
+
+	for path := range fileByPath {
+		_, ok := walkedFileByPath[path]
+		if ok {
+			continue
+		}
+
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+// reconcile walks the whole tree (slowly, in the background) and sends the result to w.reconciled
+func (w *Watcher) reconcile(limiter *rateLimiter) {
+	before := time.Now()
+
+	fileByPath, _, _, err := getFileByPathAndFolderByPathAndGitIgnoreByPathForPath(w.path, limiter)
+	if err != nil {
+		if err != errRateLimiterStopped {
+			log.Printf("warning: attempt to walk %v for reconciliation caused %v", w.path, err)
+		}
+
+		fileByPath = nil
+	} else {
+		log.Printf("walked %v files for reconciliation in %v", len(fileByPath), time.Since(before))
+	}
+
+	w.reconciled <- fileByPath
+}
+
+func (w *Watcher) handleReconciled(fileByPath map[string]*File) {
+	if fileByPath == nil {
+		return
+	}
+
+	w.mu.Lock()
+	h := w.handler
+	w.mu.Unlock()
+
+	paths := h.getDiscrepancies(fileByPath)
+	if len(paths) == 0 {
+		return
+	}
+
+	log.Printf("reconciliation found %v paths that disagree with what events told us; resyncing them", len(paths))
+
+	for _, path := range paths {
+		w.bufferRescan(path)
+	}
+}
@@ -1,30 +1,266 @@
 package syncer
 
-import (
-	"time"
-)
-
-func Run(
-	localPath string,
-	rate time.Duration,
-	debounce time.Duration,
-) (func(), error) {
+// watch runs the Watcher / Handler / Differ stack for path, with any changes going to sender
+func watch(path string, config Config, sender *Sender) (*Handler, *Watcher, error) {
+	backend, err := GetWatchBackend(config.WatchBackend, config.PollInterval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hasher, err := GetHasher(config.HashAlgorithm, config.HashWorkers)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	differ, err := GetDiffer()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handler, err := GetHandler(path, differ, sender, hasher)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if sender.syncState != nil {
+		handler.setBase(sender.syncState.getFileByPath(path))
+	} else if sender.remoteHost != "" && config.HashAlgorithm != HashAlgorithmNone {
+		handler.setBaseFromState() // note: without hashes, the trees can't be compared well enough to rely on
+	}
+
+	sender.setLocalTree(handler.merkleTree, config.HashAlgorithm, handler.isIgnored)
+
+	deleteGuard := GetDeleteGuard(config.DeleteThreshold, config.DeletePrompt)
+	sender.setDeleteGuard(deleteGuard)
+
+	watcher, err := GetWatcher(path, config.Rate, config.Debounce, handler, backend, config.ReconcileInterval, config.ReconcileRate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	deleteGuard.setOnConfirm(deleteSourceDiff, watcher.requestUpdate)
+	deleteGuard.setOnConfirm(deleteSourceVerify, func() {
+		sender.verifyNow(false)
+	})
+
+	return handler, watcher, nil
+}
+
+// getRemoteCommand returns the command that starts the receiver on the other side (if config.RemoteCommand is set)
+func getRemoteCommand(config Config) ([]string, error) {
+	if config.RemoteCommand == "" {
+		return nil, nil
+	}
+
+	return GetRemoteCommand(config.RemoteCommand, config.RemoteHost, config.RemoteSyncer, getRemoteReceiverArgs(config))
+}
+
+func getTransport(config Config) (*Transport, error) {
+	return GetTransport(config.TLSCert, config.TLSKey, config.TLSCA, config.TLSPeerFingerprints, config.PSKFile)
+}
+
+// getTrash returns the Trash for the receiver of path (if config.Trash is set)
+func getTrash(path string, config Config) (*Trash, error) {
+	if !config.Trash {
+		return nil, nil
+	}
+
+	return GetTrash(path, config.TrashMaxAge, config.TrashMaxSize)
+}
+
+// startControlServer serves the control API for sender (if config.ControlAddr is set)
+func startControlServer(config Config, sender *Sender) (*ControlServer, error) {
+	if config.ControlAddr == "" {
+		return nil, nil
+	}
+
+	return GetControlServer(config.ControlAddr, config.ControlTokenFile, sender.deleteGuard)
+}
+
+// Run watches config.LocalPath and sends changes to config.RemoteHost; for a bidirectional sync it also receives the
+// other side's changes (over a second conn it makes for them)
+func Run(config Config) (func(), error) {
+	err := SetIgnoreRules(config.FoldersToIgnore, config.FilesToIgnore)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := getTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteCommand, err := getRemoteCommand(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var syncState *SyncState
+
+	if config.Bidirectional {
+		syncState, err = GetSyncState(config.LocalPath, true, config.ConflictPolicy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sender, err := GetSender(config.LocalPath, config.RemoteHost, config.RemotePath, config, syncState, transport, remoteCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, watcher, err := watch(config.LocalPath, config, sender)
+	if err != nil {
+		return nil, err
+	}
+
+	controlServer, err := startControlServer(config, sender)
+	if err != nil {
+		watcher.Close()
+		sender.Close()
+		return nil, err
+	}
+
+	sender.startVerifying(config.VerifyInterval)
+
+	var receiver *Receiver
+
+	if config.Bidirectional {
+		var trash *Trash
+
+		trash, err = getTrash(config.LocalPath, config)
+		if err == nil {
+			receiver, err = getReverseReceiver(config.LocalPath, config, syncState, trash, func() (*Conn, error) {
+				return sender.dial(true)
+			})
+		}
+
+		if err != nil {
+			if controlServer != nil {
+				controlServer.Close()
+			}
+			watcher.Close()
+			sender.Close()
+			return nil, err
+		}
+	}
+
+	return func() {
+		if controlServer != nil {
+			controlServer.Close()
+		}
+
+		if receiver != nil {
+			receiver.Close()
+		}
+
+		watcher.Close()
+		sender.Close()
+		handler.saveIndex()
+
+		if syncState != nil {
+			syncState.Save()
+		}
+	}, nil
+}
+
+// RunReceiver receives changes into config.RemotePath; for a bidirectional sync it also watches config.RemotePath and
+// sends changes back to the other side
+func RunReceiver(config Config) (func(), error) {
+	err := SetIgnoreRules(config.FoldersToIgnore, config.FilesToIgnore)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := getTransport(config)
 	if err != nil {
 		return nil, err
 	}
 
-	handler, err := GetHandler(localPath, differ)
+	trash, err := getTrash(config.RemotePath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if !config.Bidirectional {
+		receiver, err := GetReceiver(config.RemotePath, config, nil, trash, transport, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return func() {
+			receiver.Close()
+		}, nil
+	}
+
+	syncState, err := GetSyncState(config.RemotePath, false, config.ConflictPolicy)
 	if err != nil {
 		return nil, err
 	}
 
-	watcher, err := GetWatcher(localPath, rate, debounce, handler)
+	sender, err := GetSender(config.RemotePath, "", "", config, syncState, transport, nil)
 	if err != nil {
 		return nil, err
 	}
 
+	handler, watcher, err := watch(config.RemotePath, config, sender)
+	if err != nil {
+		return nil, err
+	}
+
+	sender.setOnConnect(watcher.requestUpdate)
+
+	controlServer, err := startControlServer(config, sender)
+	if err != nil {
+		watcher.Close()
+		sender.Close()
+		return nil, err
+	}
+
+	receiver, err := GetReceiver(config.RemotePath, config, syncState, trash, transport, sender)
+	if err != nil {
+		if controlServer != nil {
+			controlServer.Close()
+		}
+		watcher.Close()
+		sender.Close()
+		return nil, err
+	}
+
 	return func() {
+		if controlServer != nil {
+			controlServer.Close()
+		}
+
+		receiver.Close()
 		watcher.Close()
+		sender.Close()
+		handler.saveIndex()
+		syncState.Save()
 	}, nil
 }
+
+// RunStdioReceiver receives changes into config.RemotePath over stdin / stdout (i.e. it was started by the other side's
+// -remoteCommand) until the other side is done
+func RunStdioReceiver(config Config) error {
+	err := SetIgnoreRules(config.FoldersToIgnore, config.FilesToIgnore)
+	if err != nil {
+		return err
+	}
+
+	trash, err := getTrash(config.RemotePath, config)
+	if err != nil {
+		return err
+	}
+
+	receiver, err := getReceiver(config.RemotePath, config, nil, trash)
+	if err != nil {
+		return err
+	}
+
+	err = receiver.serveStdio()
+
+	receiver.Close()
+
+	return err
+}
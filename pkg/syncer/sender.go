@@ -0,0 +1,924 @@
+package syncer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/initialed85/syncer/internal/utils"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoPeer = errors.New("the other side hasn't connected yet")
+
+type Sender struct {
+	mu                    sync.Mutex
+	conn                  *Conn
+	transferConns         []*Conn
+	localPath, remotePath string
+	remoteHost            string
+	peerName              string
+	deltaThreshold        int64
+	chunking              bool
+	chunkThreshold        int64
+	archiveThreshold      int64
+	streamThreshold       int64
+	transferWorkers       int
+	hotPaths, coldPaths   []string
+	syncState             *SyncState
+	transport             *Transport
+	remoteCommand         []string
+	compression           Compression
+	pending               bool
+	onConnect             func()
+	localTree             *merkleTree
+	isIgnored             func(path string, isDir bool) bool
+	hashAlgorithm         HashAlgorithm
+	needsVerify           bool
+	deleteGuard           *DeleteGuard
+	wg                    sync.WaitGroup
+	stop                  chan bool
+}
+
+// GetSender returns a Sender that connects to remoteHost, or (if remoteHost is empty) one that waits for the other side
+// of a bidirectional sync to connect to us; syncState is only for bidirectional syncs and transport is optional. With a
+// remoteCommand, the receiver is started by running it (see GetRemoteCommand) rather than connected to on remoteHost.
+// Writes go out in order of config.HotPaths / config.ColdPaths (see getTransfers) over up to config.TransferWorkers
+// conns at once.
+func GetSender(
+	localPath string,
+	remoteHost string,
+	remotePath string,
+	config Config,
+	syncState *SyncState,
+	transport *Transport,
+	remoteCommand []string,
+) (*Sender, error) {
+	s := Sender{
+		localPath:        localPath,
+		remoteHost:       remoteHost,
+		remotePath:       remotePath,
+		peerName:         remoteHost,
+		deltaThreshold:   config.DeltaThreshold,
+		chunking:         config.Chunking,
+		chunkThreshold:   config.ChunkThreshold,
+		archiveThreshold: config.ArchiveThreshold,
+		streamThreshold:  config.StreamThreshold,
+		transferWorkers:  config.TransferWorkers,
+		hotPaths:         config.HotPaths,
+		coldPaths:        config.ColdPaths,
+		syncState:        syncState,
+		transport:        transport,
+		remoteCommand:    remoteCommand,
+		compression:      config.Compression,
+		stop:             make(chan bool),
+	}
+
+	return &s, nil
+}
+
+// dial connects to the receiver; a reverse conn is one the receiver sends its changes back over
+func (s *Sender) dial(reverse bool) (*Conn, error) {
+	rawConn, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := GetConn(rawConn)
+
+	response, err := conn.request(&Message{
+		Type:          MessageTypeHello,
+		Version:       protocolVersion,
+		RemotePath:    s.remotePath,
+		Compressions:  getOfferedCompressions(s.compression),
+		Bidirectional: s.syncState != nil,
+		Reverse:       reverse,
+	})
+	if err == nil {
+		err = conn.setCompression(response.Compression)
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("hello to %v failed: %v", s.remoteHost, err)
+	}
+
+	return conn, nil
+}
+
+// connect either starts the receiver (with remoteCommand) or connects to it (on remoteHost)
+func (s *Sender) connect() (io.ReadWriteCloser, error) {
+	if len(s.remoteCommand) > 0 {
+		commandConn, err := startCommand(s.remoteCommand)
+		if err != nil {
+			return nil, fmt.Errorf("attempt to run %v failed: %v", s.remoteCommand[0], err)
+		}
+
+		return commandConn, nil
+	}
+
+	rawConn, err := net.DialTimeout("tcp", s.remoteHost, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+
+	secureConn, err := s.transport.client(rawConn)
+	if err != nil {
+		_ = rawConn.Close()
+		return nil, fmt.Errorf("handshake with %v failed: %v", s.remoteHost, err)
+	}
+
+	return secureConn, nil
+}
+
+func (s *Sender) getConn() (*Conn, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	if s.remoteHost == "" {
+		return nil, errNoPeer
+	}
+
+	conn, err := s.dial(false)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("connected to %v (compression: %v)", s.remoteHost, conn.compression)
+
+	s.conn = conn
+
+	// note: whatever happened while we weren't connected (or were stopped) is found by comparing the trees; that's what
+	// the base is for in a bidirectional sync
+	s.needsVerify = s.syncState == nil
+
+	return s.conn, nil
+}
+
+// setConn is for a Sender without a remoteHost; it sends over a conn the other side made (replacing any earlier one)
+func (s *Sender) setConn(conn *Conn, peerName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeConn()
+
+	s.conn = conn
+	s.peerName = peerName
+
+	log.Printf("sending changes back to %v", peerName)
+
+	if s.pending && s.onConnect != nil { // send whatever couldn't be sent while nobody was connected
+		go s.onConnect()
+	}
+}
+
+// setLocalTree is the Handler's merkleTree (for comparing with the remote's) and its ignore rules (so that what the
+// remote has that we ignore isn't mistaken for something the remote shouldn't have)
+func (s *Sender) setLocalTree(localTree *merkleTree, hashAlgorithm HashAlgorithm, isIgnored func(path string, isDir bool) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.localTree = localTree
+	s.hashAlgorithm = hashAlgorithm
+	s.isIgnored = isIgnored
+}
+
+// setDeleteGuard has deletions that cross its threshold wait to be confirmed
+func (s *Sender) setDeleteGuard(deleteGuard *DeleteGuard) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteGuard = deleteGuard
+}
+
+func (s *Sender) setOnConnect(onConnect func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onConnect = onConnect
+}
+
+func (s *Sender) closeConn() {
+	for _, transferConn := range s.transferConns {
+		_ = transferConn.Close()
+	}
+	s.transferConns = nil
+
+	if s.conn == nil {
+		return
+	}
+
+	_ = s.conn.Close()
+	s.conn = nil
+}
+
+func (s *Sender) getRelativePath(path string) (string, error) {
+	relativePath, err := filepath.Rel(s.localPath, path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(relativePath), nil
+}
+
+// getCreateMessageType is the type of message that makes file on the other side; false if it can't be synced
+func getCreateMessageType(file *File) (MessageType, bool) {
+	if file.IsDir {
+		return MessageTypeMkdir, true
+	}
+
+	if file.IsSymlink {
+		return MessageTypeSymlink, true
+	}
+
+	if file.Mode.IsRegular() {
+		return MessageTypeWrite, true
+	}
+
+	return "", false
+}
+
+func (s *Sender) getMessages(added, removed, modified map[string]*File, moved map[string]*Move) []*Message {
+	messages := make([]*Message, 0)
+
+	movedPaths := make([]string, 0)
+	for path := range moved {
+		movedPaths = append(movedPaths, path)
+	}
+	sort.Strings(movedPaths)
+
+	// moves go first, in case the folder they were moved out of is about to be deleted
+	for _, path := range movedPaths {
+		move := moved[path]
+
+		parent, ok := moved[move.To.ParentPath]
+		if ok && parent.From.Path == move.From.ParentPath { // the parent folder is being moved, this comes with it
+			continue
+		}
+
+		relativePath, err := s.getRelativePath(move.To.Path)
+		if err != nil || relativePath == "." {
+			continue
+		}
+
+		relativeFromPath, err := s.getRelativePath(move.From.Path)
+		if err != nil || relativeFromPath == "." {
+			continue
+		}
+
+		messages = append(messages, &Message{
+			Type:     MessageTypeMove,
+			Path:     relativePath,
+			FromPath: relativeFromPath,
+			Modified: move.To.Modified,
+		})
+	}
+
+	removedFiles, _ := GetFilesFromFileByPath(removed)
+	SortFilesInPlace(removedFiles)
+
+	// children come after their parents, so walk backwards to delete the deepest things first
+	for i := len(removedFiles) - 1; i >= 0; i-- {
+		file := removedFiles[i]
+
+		parent, ok := removed[file.ParentPath]
+		if ok && parent.IsDir { // the parent folder is going anyway
+			continue
+		}
+
+		relativePath, err := s.getRelativePath(file.Path)
+		if err != nil || relativePath == "." {
+			continue
+		}
+
+		messages = append(messages, &Message{
+			Type: MessageTypeDelete,
+			Path: relativePath,
+		})
+	}
+
+	// note: a modified folder gets a mkdir too (its contents have their own entries), which carries its modified time
+	changedFiles, _ := GetFilesFromFileByPath(added)
+	for _, file := range modified {
+		changedFiles = append(changedFiles, file)
+	}
+	SortFilesInPlace(changedFiles)
+
+	for _, file := range changedFiles {
+		relativePath, err := s.getRelativePath(file.Path)
+		if err != nil || relativePath == "." {
+			continue
+		}
+
+		messageType, ok := getCreateMessageType(file)
+		if !ok {
+			if file.isSpecial() {
+				log.Printf("warning: skipping %v as it's a special file (%v)", file.Path, file.Mode.Type())
+			} else {
+				utils.DebugLog("sender", "skipped", file.Path)
+			}
+
+			continue
+		}
+
+		messages = append(messages, &Message{
+			Type: messageType,
+			Path: relativePath,
+		})
+	}
+
+	return messages
+}
+
+// getFallbackMessages covers moves that the receiver couldn't do (e.g. it didn't have the file to move) by sending
+// the moved things in full
+func (s *Sender) getFallbackMessages(moved map[string]*Move, failed []string) []*Message {
+	added := make(map[string]*File)
+
+	for _, relativePath := range failed {
+		path := filepath.Join(s.localPath, filepath.FromSlash(relativePath))
+
+		move, ok := moved[path]
+		if !ok {
+			continue
+		}
+
+		added[path] = move.To
+
+		if !move.To.IsDir {
+			continue
+		}
+
+		for otherPath, otherMove := range moved {
+			if !strings.HasPrefix(otherPath, path+"/") {
+				continue
+			}
+
+			added[otherPath] = otherMove.To
+		}
+	}
+
+	return s.getMessages(added, nil, nil, nil)
+}
+
+// getDeltaMessage asks the receiver for the signatures of its copy of a file and makes a delta against it; it returns
+// nil if there's nothing to make a delta against (e.g. the receiver doesn't have the file)
+func (s *Sender) getDeltaMessage(conn *Conn, message *Message, data []byte, sum [16]byte) (*Message, int, error) {
+	blockSize := getDeltaBlockSize(int64(len(data)))
+
+	response, err := conn.request(&Message{
+		Type:      MessageTypeSignatures,
+		Path:      message.Path,
+		BlockSize: blockSize,
+	})
+	if err != nil {
+		if response == nil { // no response means the conn is broken
+			return nil, 0, err
+		}
+
+		utils.DebugLog("sender", "no_signatures", message.Path)
+		return nil, 0, nil
+	}
+
+	ops, literalBytes := getDelta(data, blockSize, response.Signatures)
+
+	deltaMessage := Message{
+		Type:      MessageTypeDelta,
+		Path:      message.Path,
+		BlockSize: blockSize,
+		Ops:       ops,
+		Sum:       sum,
+		Mode:      message.Mode,
+		Modified:  message.Modified,
+		HasBase:   message.HasBase,
+		BaseSum:   message.BaseSum,
+	}
+
+	return &deltaMessage, literalBytes, nil
+}
+
+// getKnownChunks chunks everything that's going to be written and asks the receiver which of those chunks it already
+// has (all in one go, rather than a round trip per file); it returns nil if chunking isn't going to happen
+func (s *Sender) getKnownChunks(conn *Conn, messages []*Message) (map[ChunkID]bool, error) {
+	if !s.chunking {
+		return nil, nil
+	}
+
+	ids := make([]ChunkID, 0)
+	seen := make(map[ChunkID]bool)
+
+	for _, message := range messages {
+		if message.Type != MessageTypeWrite {
+			continue
+		}
+
+		path := filepath.Join(s.localPath, filepath.FromSlash(message.Path))
+
+		info, err := os.Stat(path)
+		if err != nil || info.Size() < s.chunkThreshold {
+			continue
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for _, chunk := range getChunks(data) {
+			if seen[chunk.ID] {
+				continue
+			}
+
+			seen[chunk.ID] = true
+			ids = append(ids, chunk.ID)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	response, err := conn.request(&Message{
+		Type:     MessageTypeChunks,
+		ChunkIDs: ids,
+	})
+	if err != nil {
+		if response == nil { // no response means the conn is broken
+			return nil, err
+		}
+
+		log.Printf("warning: not sending chunks as %v reported %v", s.peerName, err)
+		return nil, nil
+	}
+
+	for _, id := range response.Missing {
+		delete(seen, id)
+	}
+
+	return seen, nil
+}
+
+// getChunkedMessage refers to the chunks the receiver has and includes the ones it doesn't (which it'll then have)
+func (s *Sender) getChunkedMessage(message *Message, data []byte, knownChunks map[ChunkID]bool) (*Message, int) {
+	chunkedMessage := Message{
+		Type:     MessageTypeChunkedWrite,
+		Path:     message.Path,
+		ChunkIDs: make([]ChunkID, 0),
+		Chunks:   make([]ChunkData, 0),
+		Mode:     message.Mode,
+		Modified: message.Modified,
+		HasBase:  message.HasBase,
+		BaseSum:  message.BaseSum,
+	}
+
+	newBytes := 0
+
+	for _, chunk := range getChunks(data) {
+		chunkedMessage.ChunkIDs = append(chunkedMessage.ChunkIDs, chunk.ID)
+
+		if knownChunks[chunk.ID] {
+			continue
+		}
+
+		chunkedMessage.Chunks = append(chunkedMessage.Chunks, chunk)
+		knownChunks[chunk.ID] = true
+		newBytes += len(chunk.Data)
+	}
+
+	return &chunkedMessage, newBytes
+}
+
+// isArchived is true if message is small enough to go in an archive (and isn't going to be sent as chunks or a delta)
+func (s *Sender) isArchived(message *Message, chunking bool) bool {
+	if s.archiveThreshold <= 0 || !isArchivable(message) {
+		return false
+	}
+
+	if message.Type != MessageTypeWrite {
+		return true
+	}
+
+	size := int64(len(message.Data))
+
+	if chunking && size >= s.chunkThreshold {
+		return false
+	}
+
+	if s.deltaThreshold > 0 && size >= s.deltaThreshold {
+		return false
+	}
+
+	return size < s.archiveThreshold
+}
+
+// isStreamed is true if the file of info is too big to read in one go (and isn't going to be sent as chunks or a delta,
+// which need all of it)
+func (s *Sender) isStreamed(info os.FileInfo) bool {
+	if s.streamThreshold <= 0 || info == nil || info.Size() < s.streamThreshold {
+		return false
+	}
+
+	if s.chunking && info.Size() >= s.chunkThreshold {
+		return false
+	}
+
+	return !(s.deltaThreshold > 0 && info.Size() >= s.deltaThreshold)
+}
+
+// openStream opens path to be sent by sendStream; for a bidirectional sync it's read through for the sum first
+func (s *Sender) openStream(path string) (*os.File, [16]byte, error) {
+	sum := [16]byte{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, sum, err
+	}
+
+	if s.syncState != nil {
+		sum, err = getFileChecksum(f)
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+
+		if err != nil {
+			_ = f.Close()
+			return nil, sum, err
+		}
+	}
+
+	return f, sum, nil
+}
+
+func (s *Sender) sendMessages(conn *Conn, messages []*Message) (*Message, error) {
+	before := time.Now()
+
+	stats := &transferStats{}
+
+	response, err := s.sendBatch(conn, messages, stats, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logTransferStats(stats, time.Since(before))
+
+	return response, nil
+}
+
+// stagedBatch is what the sender has to remember about messages it has sent until they're committed
+type stagedBatch struct {
+	journal    syncJournal
+	deltaPaths map[string]bool
+}
+
+// rollback undoes what prepare did for staged (as the other side throws away a batch it doesn't get the commit for)
+func (s *Sender) rollback(staged []*stagedBatch) {
+	if s.syncState == nil {
+		return
+	}
+
+	// note: backwards, as a later batch's journal may have been made after an earlier one's changes
+	for i := len(staged) - 1; i >= 0; i-- {
+		s.syncState.rollback(&staged[i].journal)
+	}
+}
+
+// sendBatch sends messages (in order) and commits them, adding what was sent to stats; without deltas, changed files
+// are sent in full regardless of deltaThreshold
+func (s *Sender) sendBatch(conn *Conn, messages []*Message, stats *transferStats, deltas bool) (*Message, error) {
+	staged := &stagedBatch{}
+
+	err := s.stageBatch(conn, messages, stats, deltas, staged)
+	if err != nil {
+		s.rollback([]*stagedBatch{staged})
+		return nil, err
+	}
+
+	return s.commitBatch(conn, &Message{Type: MessageTypeCommit}, stats, []*stagedBatch{staged})
+}
+
+// stageBatch sends messages (in order) for the other side to stage until the commit, noting what it'll need to know
+// then in staged
+func (s *Sender) stageBatch(conn *Conn, messages []*Message, stats *transferStats, deltas bool, staged *stagedBatch) error {
+	var err error
+
+	if staged.deltaPaths == nil {
+		staged.deltaPaths = make(map[string]bool)
+	}
+
+	knownChunks, err := s.getKnownChunks(conn, messages)
+	if err != nil {
+		return err
+	}
+
+	archived := &archive{}
+
+	// note: an archive is sent before whatever comes after it, so that everything is still applied in order
+	sendArchive := func() error {
+		if archived.count == 0 {
+			return nil
+		}
+
+		stats.archivedFiles += archived.count
+
+		archiveMessage, err := archived.getMessage()
+		if err != nil {
+			return err
+		}
+
+		stats.archives++
+
+		utils.DebugLog("sender", string(archiveMessage.Type), fmt.Sprintf("%v bytes", len(archiveMessage.Data)))
+
+		return conn.send(archiveMessage)
+	}
+
+	for _, message := range messages {
+		path := filepath.Join(s.localPath, filepath.FromSlash(message.Path))
+
+		var info os.FileInfo
+		if message.Type == MessageTypeWrite || message.Type == MessageTypeMkdir || message.Type == MessageTypeSymlink {
+			info, _ = os.Lstat(path)
+		}
+
+		if info != nil {
+			message.Mode = info.Mode().Perm()
+			message.Modified = info.ModTime()
+		}
+
+		var streamFile *os.File
+		sum := [16]byte{}
+
+		if message.Type == MessageTypeWrite {
+			if s.isStreamed(info) {
+				streamFile, sum, err = s.openStream(path)
+			} else {
+				message.Data, err = os.ReadFile(path)
+				sum = getStrongChecksum(message.Data)
+			}
+
+			if err != nil { // this can occur if things are quickly modified then deleted- the next diff will catch it
+				log.Printf("warning: attempt to read %v caused %v", message.Path, err)
+				continue
+			}
+		}
+
+		if message.Type == MessageTypeSymlink {
+			message.Target, err = os.Readlink(path)
+			if err != nil {
+				log.Printf("warning: attempt to read the symlink %v caused %v", message.Path, err)
+				continue
+			}
+		}
+
+		if s.syncState != nil && !s.syncState.prepare(message, info, sum, &staged.journal) {
+			utils.DebugLog("sender", "unchanged", message.Path)
+			message.Data = nil
+			if streamFile != nil {
+				_ = streamFile.Close()
+			}
+			continue
+		}
+
+		stats.messages++
+
+		if streamFile == nil && s.isArchived(message, knownChunks != nil) {
+			utils.DebugLog("sender", "archived", message.Path)
+
+			err = archived.add(message)
+			if err != nil {
+				return err
+			}
+
+			stats.bytes += len(message.Data)
+			message.Data = nil
+
+			if archived.isFull() {
+				err = sendArchive()
+				if err != nil {
+					return err
+				}
+			}
+
+			continue
+		}
+
+		err = sendArchive()
+		if err != nil {
+			if streamFile != nil {
+				_ = streamFile.Close()
+			}
+			return err
+		}
+
+		send := conn.send
+		if !isCompressible(message.Path) {
+			send = conn.sendRaw
+		}
+
+		if streamFile != nil {
+			utils.DebugLog("sender", string(MessageTypeWriteStream), message.Path)
+
+			streamedBytes, err := sendStream(send, message, streamFile)
+			_ = streamFile.Close()
+			if err != nil {
+				return err
+			}
+
+			stats.bytes += streamedBytes
+			stats.streamedFiles++
+			continue
+		}
+
+		if message.Type == MessageTypeWrite {
+
+			if knownChunks != nil && int64(len(message.Data)) >= s.chunkThreshold {
+				chunkedMessage, newBytes := s.getChunkedMessage(message, message.Data, knownChunks)
+
+				utils.DebugLog("sender", string(chunkedMessage.Type), chunkedMessage.Path)
+
+				err = send(chunkedMessage)
+				if err != nil {
+					return err
+				}
+
+				stats.chunkedBytes += len(message.Data)
+				message.Data = nil
+				stats.bytes += newBytes
+				stats.newChunkedBytes += newBytes
+				stats.chunkedFiles++
+				continue
+			}
+
+			if deltas && s.deltaThreshold > 0 && int64(len(message.Data)) >= s.deltaThreshold {
+				deltaMessage, literalBytes, err := s.getDeltaMessage(conn, message, message.Data, sum)
+				if err != nil {
+					return err
+				}
+
+				if deltaMessage != nil {
+					utils.DebugLog("sender", string(deltaMessage.Type), deltaMessage.Path)
+
+					err = send(deltaMessage)
+					if err != nil {
+						return err
+					}
+
+					staged.deltaPaths[message.Path] = true
+					message.Data = nil
+					stats.bytes += literalBytes
+					stats.deltaBytes += literalBytes
+					stats.deltaFiles++
+					continue
+				}
+			}
+
+			// note: e.g. a large file that the other side doesn't have yet (so there was nothing to send a delta of)
+			if s.streamThreshold > 0 && int64(len(message.Data)) >= s.streamThreshold {
+				utils.DebugLog("sender", string(MessageTypeWriteStream), message.Path)
+
+				streamedBytes, err := sendStream(send, message, bytes.NewReader(message.Data))
+				if err != nil {
+					return err
+				}
+
+				message.Data = nil
+				stats.bytes += streamedBytes
+				stats.streamedFiles++
+				continue
+			}
+
+			stats.bytes += len(message.Data)
+		}
+
+		utils.DebugLog("sender", string(message.Type), message.Path)
+
+		err = send(message)
+		if err != nil {
+			return err
+		}
+
+		message.Data = nil
+	}
+
+	return sendArchive()
+}
+
+// commitBatch sends commit for what's been staged (as staged) and deals with what the other side says about it
+func (s *Sender) commitBatch(conn *Conn, commit *Message, stats *transferStats, staged []*stagedBatch) (*Message, error) {
+	response, err := conn.request(commit)
+	if err != nil {
+		if response == nil { // no response means the conn is broken (rather than some of the batch failing)
+			s.rollback(staged)
+			return nil, err
+		}
+
+		log.Printf("warning: %v reported %v", s.peerName, err)
+
+		if s.syncState != nil {
+			s.syncState.forgetFailed(response.Failed)
+		}
+	}
+
+	// note: a delta that the other side couldn't apply (e.g. its copy changed after it sent the signatures, so the result
+	// didn't match) is sent again in full
+	wholeMessages := make([]*Message, 0)
+	for _, relativePath := range response.Failed {
+		for _, otherStaged := range staged {
+			if otherStaged.deltaPaths[relativePath] {
+				wholeMessages = append(wholeMessages, &Message{Type: MessageTypeWrite, Path: relativePath})
+				break
+			}
+		}
+	}
+
+	for _, conflict := range response.Conflicts {
+		log.Printf("warning: %v reported a conflict: %v", s.peerName, conflict)
+	}
+
+	if s.syncState != nil {
+		s.syncState.saveIfDue()
+	}
+
+	if len(wholeMessages) > 0 {
+		log.Printf("sending %v files in full as their deltas couldn't be applied by %v", len(wholeMessages), s.peerName)
+
+		_, err = s.sendBatch(conn, wholeMessages, stats, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+func (s *Sender) send(added, removed, modified map[string]*File, moved map[string]*Move) (err error) {
+	messages := s.getMessages(added, removed, modified, moved)
+	if len(messages) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer func() {
+		s.pending = err != nil
+	}()
+
+	conn, err := s.getConn()
+	if err != nil {
+		return err
+	}
+
+	if s.needsVerify {
+		err = s.verify(conn, false)
+		if err != nil {
+			s.closeConn()
+			return err
+		}
+	}
+
+	before := time.Now()
+
+	stats := &transferStats{}
+
+	response, err := s.sendTransfers(conn, messages, stats)
+	if err != nil {
+		s.closeConn()
+		return err
+	}
+
+	s.logTransferStats(stats, time.Since(before))
+
+	fallbackMessages := s.getFallbackMessages(moved, response.Failed)
+	if len(fallbackMessages) == 0 {
+		return nil
+	}
+
+	log.Printf("sending %v moved things in full as they couldn't be moved by %v", len(fallbackMessages), s.peerName)
+
+	_, err = s.sendMessages(conn, fallbackMessages)
+	if err != nil {
+		s.closeConn()
+		return err
+	}
+
+	return nil
+}
+
+func (s *Sender) Close() {
+	close(s.stop)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeConn()
+}
@@ -0,0 +1,272 @@
+package syncer
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loopback is a Sender and a Receiver talking over loopback, like -send / -receive with scratch/local and
+// scratch/remote (but in temporary folders, and without a Watcher so each sync happens when the test says so)
+type loopback struct {
+	localPath, remotePath   string
+	localState, remoteState *SyncState
+	differ                  *Differ
+	sender                  *Sender
+	receiver                *Receiver
+}
+
+func getLoopback(t *testing.T, transferWorkers int) *loopback {
+	t.Helper()
+
+	return getLoopbackWithState(t, transferWorkers, t.TempDir(), t.TempDir(), nil, nil)
+}
+
+// getLoopbackWithState is for the local to remote half of a bidirectional sync if there's localState and remoteState
+// (the remote to local half is left out, as it's the same again the other way)
+func getLoopbackWithState(
+	t *testing.T,
+	transferWorkers int,
+	localPath string,
+	remotePath string,
+	localState *SyncState,
+	remoteState *SyncState,
+) *loopback {
+	t.Helper()
+
+	l := loopback{
+		localPath:   localPath,
+		remotePath:  remotePath,
+		localState:  localState,
+		remoteState: remoteState,
+	}
+
+	var err error
+
+	l.differ, err = GetDiffer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var remoteSender *Sender
+
+	if remoteState != nil {
+		remoteSender, err = GetSender(remotePath, "", "", Config{TransferWorkers: 1}, remoteState, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(remoteSender.Close)
+	}
+
+	l.receiver, err = GetReceiver(l.remotePath, Config{ListenAddr: "127.0.0.1:0"}, remoteState, nil, nil, remoteSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.receiver.Close)
+
+	l.sender, err = GetSender(
+		l.localPath,
+		l.receiver.listener.Addr().String(),
+		l.remotePath,
+		Config{TransferWorkers: transferWorkers},
+		localState,
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(l.sender.Close)
+
+	return &l
+}
+
+// sync walks the local folder and sends whatever changed since the last sync
+func (l *loopback) sync(t *testing.T) {
+	t.Helper()
+
+	fileByPath, _, _, err := GetFileByPathAndFolderByPathAndGitIgnoreByPathForPath(l.localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.differ.update(fileByPath)
+
+	err = l.sender.send(l.differ.diff())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// syncWithStats is sync in one batch over one conn, returning how it was sent
+func (l *loopback) syncWithStats(t *testing.T) *transferStats {
+	t.Helper()
+
+	fileByPath, _, _, err := GetFileByPathAndFolderByPathAndGitIgnoreByPathForPath(l.localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.differ.update(fileByPath)
+
+	conn, err := l.sender.getConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := &transferStats{}
+
+	_, err = l.sender.sendBatch(conn, l.sender.getMessages(l.differ.diff()), stats, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return stats
+}
+
+func writeTestFile(t *testing.T, path string, data string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte(data), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getTestTree returns what's under path (leaving out the index folder) as relative path -> content ("/" for a folder)
+func getTestTree(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	tree := make(map[string]string)
+
+	err := filepath.WalkDir(path, func(childPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(path, childPath)
+		if err != nil {
+			return err
+		}
+
+		if relativePath == "." {
+			return nil
+		}
+
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".syncer") {
+			return filepath.SkipDir
+		}
+
+		if entry.IsDir() {
+			tree[filepath.ToSlash(relativePath)] = "/"
+			return nil
+		}
+
+		data, err := os.ReadFile(childPath)
+		if err != nil {
+			return err
+		}
+
+		tree[filepath.ToSlash(relativePath)] = string(data)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+func requireSameTree(t *testing.T, localPath string, remotePath string) {
+	t.Helper()
+
+	localTree := getTestTree(t, localPath)
+	remoteTree := getTestTree(t, remotePath)
+
+	for path, data := range localTree {
+		remoteData, ok := remoteTree[path]
+		if !ok {
+			t.Errorf("%v is missing on the remote", path)
+			continue
+		}
+
+		if remoteData != data {
+			t.Errorf("%v differs on the remote (%v bytes; wanted %v)", path, len(remoteData), len(data))
+		}
+	}
+
+	for path := range remoteTree {
+		_, ok := localTree[path]
+		if !ok {
+			t.Errorf("%v is extra on the remote", path)
+		}
+	}
+}
+
+func TestSenderToReceiver(t *testing.T) {
+	for _, transferWorkers := range []int{1, DefaultTransferWorkers} {
+		l := getLoopback(t, transferWorkers)
+
+		writeTestFile(t, filepath.Join(l.localPath, "top.txt"), "top\n")
+		writeTestFile(t, filepath.Join(l.localPath, "a", "b", "c.txt"), "hi\n")
+		writeTestFile(t, filepath.Join(l.localPath, "a", "empty.txt"), "")
+		writeTestFile(t, filepath.Join(l.localPath, "big.bin"), string(bytes.Repeat([]byte("0123456789abcdef"), transferJobSize/8)))
+
+		l.sync(t)
+		requireSameTree(t, l.localPath, l.remotePath)
+
+		writeTestFile(t, filepath.Join(l.localPath, "a", "empty.txt"), "not any more\n")
+		writeTestFile(t, filepath.Join(l.localPath, "a", "d", "e.txt"), "new\n")
+
+		err := os.Remove(filepath.Join(l.localPath, "top.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.RemoveAll(filepath.Join(l.localPath, "a", "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l.sync(t)
+		requireSameTree(t, l.localPath, l.remotePath)
+	}
+}
+
+func TestSenderToReceiverWithBrokenTransferConn(t *testing.T) {
+	l := getLoopback(t, DefaultTransferWorkers)
+
+	writeTestFile(t, filepath.Join(l.localPath, "top.txt"), "top\n")
+	l.sync(t)
+
+	transferConns := l.sender.getTransferConns(DefaultTransferWorkers - 1)
+	if len(transferConns) != DefaultTransferWorkers-1 {
+		t.Fatalf("got %v transfer conns; wanted %v", len(transferConns), DefaultTransferWorkers-1)
+	}
+
+	brokenConn := transferConns[0]
+	_ = brokenConn.Close()
+
+	for i := 0; i < DefaultTransferWorkers; i++ {
+		data := bytes.Repeat([]byte{byte('a' + i)}, transferJobSize)
+		writeTestFile(t, filepath.Join(l.localPath, "big", string(rune('a'+i))+".bin"), string(data))
+	}
+
+	l.sync(t)
+	requireSameTree(t, l.localPath, l.remotePath)
+
+	for _, transferConn := range l.sender.transferConns {
+		if transferConn == brokenConn {
+			t.Errorf("the broken transfer conn was kept")
+		}
+	}
+}
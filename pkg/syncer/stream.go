@@ -0,0 +1,219 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+)
+
+const (
+	DefaultStreamThreshold = 16 * 1024 * 1024
+	streamPartSize         = 1024 * 1024
+	// streamReadAhead is how many parts are read ahead of the one being sent
+	streamReadAhead = 2
+)
+
+type streamPart struct {
+	data []byte
+	err  error
+}
+
+// readParts reads reader in parts (ahead of them being sent) until it runs out or done is closed
+func readParts(reader io.Reader, done chan bool) chan streamPart {
+	parts := make(chan streamPart, streamReadAhead)
+
+	go func() {
+		defer close(parts)
+
+		for {
+			data := make([]byte, streamPartSize)
+
+			n, err := io.ReadFull(reader, data)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = nil
+				if n == 0 {
+					return
+				}
+			}
+
+			select {
+			case parts <- streamPart{data: data[:n], err: err}:
+			case <-done:
+				return
+			}
+
+			if err != nil || n < streamPartSize {
+				return
+			}
+		}
+	}()
+
+	return parts
+}
+
+// sendStream sends message (a write) with its content from reader as a MessageTypeWriteStream per part, so that
+// neither side ever has all of it in memory at once; it returns how many bytes were sent (and only fails if sending
+// does, as the other side is told if reading does)
+func sendStream(send func(*Message) error, message *Message, reader io.Reader) (int, error) {
+	done := make(chan bool)
+	defer close(done)
+
+	sentBytes := 0
+
+	part := &Message{
+		Type:     MessageTypeWriteStream,
+		Path:     message.Path,
+		Mode:     message.Mode,
+		Modified: message.Modified,
+		HasBase:  message.HasBase,
+		BaseSum:  message.BaseSum,
+	}
+
+	for nextPart := range readParts(reader, done) {
+		if nextPart.err != nil {
+			// note: the other side throws away what it has so far
+			part.Error = nextPart.err.Error()
+			break
+		}
+
+		if part.Data != nil {
+			part.More = true
+
+			err := send(part)
+			if err != nil {
+				return sentBytes, err
+			}
+
+			sentBytes += len(part.Data)
+
+			part = &Message{
+				Type: MessageTypeWriteStream,
+				Path: message.Path,
+			}
+		}
+
+		part.Data = nextPart.data
+	}
+
+	part.More = false
+
+	err := send(part)
+	if err != nil {
+		return sentBytes, err
+	}
+
+	sentBytes += len(part.Data)
+
+	if part.Error != "" {
+		log.Printf("warning: attempt to read %v caused %v", message.Path, part.Error)
+	}
+
+	return sentBytes, nil
+}
+
+// getFileChecksum is getStrongChecksum for a file that's too big to read in one go (from wherever f is up to)
+func getFileChecksum(f *os.File) ([16]byte, error) {
+	sum := [16]byte{}
+
+	h := sha256.New()
+
+	_, err := io.Copy(h, f)
+	if err != nil {
+		return sum, err
+	}
+
+	copy(sum[:], h.Sum(nil))
+
+	return sum, nil
+}
+
+// stagedStream is a MessageTypeWriteStream that's still coming in (straight into its temp file)
+type stagedStream struct {
+	change *stagedChange
+	file   *os.File
+	hash   hash.Hash
+	err    error
+}
+
+// discard removes the temp file of a stream that isn't going to be finished
+func (s *stagedStream) discard() {
+	if s.file == nil {
+		return
+	}
+
+	_ = s.file.Close()
+	_ = os.Remove(s.file.Name())
+	s.file = nil
+}
+
+// stageStream writes a part of a large file to its temp file; once the last part is in, it's staged like a write
+func (r *Receiver) stageStream(b *batch, message *Message) error {
+	if b.stream != nil && b.stream.change.message.Path != message.Path {
+		b.stream.discard()
+		b.addError(b.stream.change.message, fmt.Errorf("it was cut short by %v", message.Path))
+		b.stream = nil
+	}
+
+	if b.stream == nil {
+		change := stagedChange{
+			message: message,
+			path:    r.getPath(message.Path),
+		}
+
+		b.keepFolderTime(change.path)
+
+		b.stream = &stagedStream{
+			change: &change,
+			hash:   sha256.New(),
+		}
+
+		b.stream.file, b.stream.err = createTempFile(r.getTempFolderPath(b, change.path), change.path)
+	}
+
+	s := b.stream
+
+	if s.err == nil && message.Error == "" {
+		_, s.err = s.file.Write(message.Data)
+		_, _ = s.hash.Write(message.Data)
+	}
+
+	message.Data = nil
+
+	if message.More {
+		if s.err != nil {
+			s.discard()
+		}
+
+		return nil
+	}
+
+	b.stream = nil
+
+	if message.Error != "" && s.err == nil {
+		s.err = fmt.Errorf("the other side couldn't finish sending it: %v", message.Error)
+	}
+
+	if s.err != nil {
+		s.discard()
+		return s.err
+	}
+
+	// note: it's a write like any other now that it's all in the temp file
+	s.change.message.Type = MessageTypeWrite
+	copy(s.change.sum[:], s.hash.Sum(nil))
+
+	tempPath, err := r.finishTempFile(s.file, s.change.message)
+	s.file = nil
+	if err != nil {
+		return err
+	}
+
+	s.change.tempPath = tempPath
+
+	b.changes = append(b.changes, s.change)
+
+	return nil
+}
@@ -0,0 +1,730 @@
+package syncer
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyNewest keeps whichever version was modified last
+	ConflictPolicyNewest ConflictPolicy = "newest"
+	// ConflictPolicyLocal keeps the version from the -send side (the one with the localPath)
+	ConflictPolicyLocal ConflictPolicy = "local"
+	// ConflictPolicyBoth keeps the -send side's version and puts the other next to it with a .conflict suffix
+	ConflictPolicyBoth ConflictPolicy = "both"
+)
+
+var ConflictPolicies = []ConflictPolicy{
+	ConflictPolicyNewest,
+	ConflictPolicyLocal,
+	ConflictPolicyBoth,
+}
+
+const (
+	conflictSuffix   = ".conflict"
+	baseVersion      = 1
+	baseFileName     = "base"
+	baseSaveInterval = time.Second * 10
+)
+
+var errStopWalk = errors.New("stop walk")
+
+// SyncRecord is a path as of the last time both sides agreed on it; Sum is the same on both sides but the rest is
+// this side's copy (so that a diff against it shows what has changed here since)
+type SyncRecord struct {
+	IsDir    bool
+	Sum      [16]byte
+	Size     int64
+	Modified time.Time
+	Mode     fs.FileMode
+	Inode    uint64
+}
+
+func getSyncRecord(sum [16]byte, info fs.FileInfo) *SyncRecord {
+	record := SyncRecord{
+		Sum: sum,
+	}
+
+	if info != nil {
+		record.IsDir = info.IsDir()
+		record.Size = info.Size()
+		record.Modified = info.ModTime()
+		record.Mode = info.Mode()
+		record.Inode = getInode(info)
+	}
+
+	return &record
+}
+
+// SyncState is what both sides of a bidirectional sync agree on; it's how each side tells its own changes apart from
+// the ones it was sent (so they aren't sent straight back) and from changes the other side didn't know about when it
+// sent something (which are conflicts); it's kept in .syncer/base between runs, so that changes made while either side
+// was stopped (deletes in particular) are still picked up
+type SyncState struct {
+	mu             sync.Mutex
+	path           string
+	recordByPath   map[string]*SyncRecord
+	initiator      bool
+	conflictPolicy ConflictPolicy
+	conflicts      int
+	changed        bool
+	lastSaved      time.Time
+}
+
+type syncBase struct {
+	Version      int
+	Path         string
+	RecordByPath map[string]*SyncRecord
+}
+
+func getBasePath(path string) string {
+	return filepath.Join(path, indexFolderName, baseFileName)
+}
+
+func loadBase(path string) (map[string]*SyncRecord, error) {
+	f, err := os.Open(getBasePath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	base := syncBase{}
+
+	err = gob.NewDecoder(f).Decode(&base)
+	if err != nil {
+		return nil, err
+	}
+
+	if base.Version != baseVersion {
+		return nil, fmt.Errorf("expected base version %v but got %v", baseVersion, base.Version)
+	}
+
+	if base.Path != path {
+		return nil, fmt.Errorf("expected base for %#+v but got %#+v", path, base.Path)
+	}
+
+	return base.RecordByPath, nil
+}
+
+func saveBase(path string, recordByPath map[string]*SyncRecord) error {
+	base := syncBase{
+		Version:      baseVersion,
+		Path:         path,
+		RecordByPath: recordByPath,
+	}
+
+	basePath := getBasePath(path)
+
+	err := os.MkdirAll(filepath.Dir(basePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(basePath), baseFileName+".*")
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(f).Encode(&base)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), basePath)
+}
+
+func GetSyncState(path string, initiator bool, conflictPolicy ConflictPolicy) (*SyncState, error) {
+	supported := false
+	for _, otherConflictPolicy := range ConflictPolicies {
+		if conflictPolicy == otherConflictPolicy {
+			supported = true
+			break
+		}
+	}
+
+	if !supported {
+		return nil, fmt.Errorf("unsupported conflict policy %#+v; must be one of %v", conflictPolicy, ConflictPolicies)
+	}
+
+	recordByPath, err := loadBase(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("warning: attempt to load sync base for %v caused %v; everything will be treated as new", path, err)
+		}
+
+		recordByPath = make(map[string]*SyncRecord)
+	}
+
+	s := SyncState{
+		path:           path,
+		recordByPath:   recordByPath,
+		initiator:      initiator,
+		conflictPolicy: conflictPolicy,
+		lastSaved:      time.Now(),
+	}
+
+	return &s, nil
+}
+
+func isUnderRelativePath(relativePath string, otherRelativePath string) bool {
+	return relativePath == otherRelativePath || strings.HasPrefix(relativePath, otherRelativePath+"/")
+}
+
+func (s *SyncState) get(relativePath string) (*SyncRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.recordByPath[relativePath]
+	return record, ok
+}
+
+func (s *SyncState) set(relativePath string, record *SyncRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recordByPath[relativePath] = record
+	s.changed = true
+}
+
+func (s *SyncState) hasUnder(relativePath string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for otherRelativePath := range s.recordByPath {
+		if isUnderRelativePath(otherRelativePath, relativePath) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getUnder returns the paths with records at or under relativePath
+func (s *SyncState) getUnder(relativePath string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	relativePaths := make([]string, 0)
+	for otherRelativePath := range s.recordByPath {
+		if isUnderRelativePath(otherRelativePath, relativePath) {
+			relativePaths = append(relativePaths, otherRelativePath)
+		}
+	}
+
+	return relativePaths
+}
+
+// forget drops the records for relativePath and everything under it
+func (s *SyncState) forget(relativePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for otherRelativePath := range s.recordByPath {
+		if isUnderRelativePath(otherRelativePath, relativePath) {
+			delete(s.recordByPath, otherRelativePath)
+			s.changed = true
+		}
+	}
+}
+
+func (s *SyncState) move(fromRelativePath string, toRelativePath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for otherRelativePath, record := range s.recordByPath {
+		if !isUnderRelativePath(otherRelativePath, fromRelativePath) {
+			continue
+		}
+
+		delete(s.recordByPath, otherRelativePath)
+		s.recordByPath[toRelativePath+strings.TrimPrefix(otherRelativePath, fromRelativePath)] = record
+		s.changed = true
+	}
+}
+
+// syncJournal is the records as they were before prepare changed them for a batch, so that they can be put back if the
+// batch doesn't make it to the other side (otherwise the change would look like it had already been sent)
+type syncJournal struct {
+	recordByPath map[string]*SyncRecord // note: a nil record is a path that didn't have one
+}
+
+// keep notes the records for relativePath (and everything under it, if under) in journal, unless they already are
+func (s *SyncState) keep(journal *syncJournal, relativePath string, under bool) {
+	if journal == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if journal.recordByPath == nil {
+		journal.recordByPath = make(map[string]*SyncRecord)
+	}
+
+	_, ok := journal.recordByPath[relativePath]
+	if !ok {
+		journal.recordByPath[relativePath] = s.recordByPath[relativePath]
+	}
+
+	if !under {
+		return
+	}
+
+	for otherRelativePath, record := range s.recordByPath {
+		if !isUnderRelativePath(otherRelativePath, relativePath) {
+			continue
+		}
+
+		_, ok = journal.recordByPath[otherRelativePath]
+		if !ok {
+			journal.recordByPath[otherRelativePath] = record
+		}
+	}
+}
+
+// rollback puts back the records noted in journal
+func (s *SyncState) rollback(journal *syncJournal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for relativePath, record := range journal.recordByPath {
+		if record == nil {
+			delete(s.recordByPath, relativePath)
+		} else {
+			s.recordByPath[relativePath] = record
+		}
+	}
+
+	if len(journal.recordByPath) > 0 {
+		s.changed = true
+	}
+
+	journal.recordByPath = nil
+}
+
+// prepare is called by the sender for each message (with info for the local copy of anything being written and sum
+// for its content); it returns false for things the other side already has (mostly the changes it sent us coming back
+// around) and otherwise says what the sender thinks the other side has (the base); whatever it changes is noted in
+// journal, to be rolled back if the batch isn't committed
+func (s *SyncState) prepare(message *Message, info fs.FileInfo, sum [16]byte, journal *syncJournal) bool {
+	switch message.Type {
+
+	case MessageTypeMkdir:
+		record, ok := s.get(message.Path)
+		if ok && record.IsDir && (info == nil || record.Modified.Equal(info.ModTime()) && record.Mode.Perm() == info.Mode().Perm()) {
+			return false
+		}
+
+		s.keep(journal, message.Path, false)
+		s.set(message.Path, getSyncRecord([16]byte{}, info))
+
+	case MessageTypeWrite, MessageTypeSymlink:
+		if message.Type == MessageTypeSymlink {
+			sum = getStrongChecksum([]byte(message.Target))
+		}
+
+		record, ok := s.get(message.Path)
+
+		s.keep(journal, message.Path, false)
+		s.set(message.Path, getSyncRecord(sum, info)) // note: even if it's unchanged, as it might have been touched
+
+		if ok && !record.IsDir {
+			if record.Sum == sum && (info == nil || record.Mode.Perm() == info.Mode().Perm()) {
+				return false
+			}
+
+			message.HasBase = true
+			message.BaseSum = record.Sum
+		}
+
+	case MessageTypeDelete:
+		if !s.hasUnder(message.Path) { // never synced or the other side deleted it first
+			return false
+		}
+
+		record, ok := s.get(message.Path)
+		if ok && !record.IsDir {
+			message.HasBase = true
+			message.BaseSum = record.Sum
+		}
+
+		s.keep(journal, message.Path, true)
+		s.forget(message.Path)
+
+	case MessageTypeMove:
+		if s.hasUnder(message.Path) && !s.hasUnder(message.FromPath) { // the other side did this move
+			return false
+		}
+
+		record, ok := s.get(message.Path)
+		if ok && !record.IsDir { // note: what it's being moved over, if anything
+			message.HasBase = true
+			message.BaseSum = record.Sum
+		}
+
+		s.keep(journal, message.FromPath, true)
+		s.keep(journal, message.Path, true)
+		for _, relativePath := range s.getUnder(message.FromPath) { // note: where they're going might not exist yet
+			s.keep(journal, message.Path+strings.TrimPrefix(relativePath, message.FromPath), false)
+		}
+		s.move(message.FromPath, message.Path)
+
+	}
+
+	return true
+}
+
+// forgetFailed drops the records for things the other side couldn't apply, so we don't assume it has them
+func (s *SyncState) forgetFailed(failed []string) {
+	for _, relativePath := range failed {
+		s.forget(relativePath)
+	}
+}
+
+// isDirty is true if the file at path has changed (on this side) since it was last synced
+func (s *SyncState) isDirty(relativePath string, path string) (bool, [16]byte, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, [16]byte{}, err
+	}
+
+	var sum [16]byte
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		sum, err = getSymlinkSum(path)
+	} else {
+		var data []byte
+
+		data, err = os.ReadFile(path)
+		sum = getStrongChecksum(data)
+	}
+
+	if err != nil {
+		return false, [16]byte{}, err
+	}
+
+	record, ok := s.get(relativePath)
+
+	return !ok || record.IsDir || record.Sum != sum, sum, nil
+}
+
+// isBaseStale is true if the other side didn't know what this side had when it sent the message (i.e. it sent it
+// before our change to the same path reached it)
+func (s *SyncState) isBaseStale(message *Message) bool {
+	record, ok := s.get(message.Path)
+	if !ok || record.IsDir {
+		return message.HasBase
+	}
+
+	return !message.HasBase || message.BaseSum != record.Sum
+}
+
+func (s *SyncState) getSideName(incoming bool) string {
+	if s.initiator != incoming {
+		return "local"
+	}
+
+	return "remote"
+}
+
+type syncConflict struct {
+	keepIncoming bool
+	keepBoth     bool
+	reason       string
+}
+
+// resolve picks a version the same way on both sides, so they end up agreeing without having to talk about it
+func (s *SyncState) resolve(incomingModified time.Time, localModified time.Time) *syncConflict {
+	conflict := syncConflict{
+		keepIncoming: !s.initiator,
+		reason:       "the local side wins",
+	}
+
+	switch s.conflictPolicy {
+
+	case ConflictPolicyNewest:
+		if incomingModified.After(localModified) {
+			conflict.keepIncoming = true
+			conflict.reason = "it's newer"
+		} else if incomingModified.Before(localModified) {
+			conflict.keepIncoming = false
+			conflict.reason = "it's newer"
+		} else {
+			conflict.reason = "both have the same modified time and the local side wins ties"
+		}
+
+	case ConflictPolicyBoth:
+		conflict.keepBoth = true
+
+	}
+
+	return &conflict
+}
+
+// checkWrite returns a conflict if the file at path has changed on this side since the last sync (or since what the
+// other side last heard from us) and the incoming content (with incomingSum) is something else again
+func (s *SyncState) checkWrite(path string, message *Message, incomingSum [16]byte) (*syncConflict, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) { // note: if we deleted it and they changed it, the change wins
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return nil, fmt.Errorf("%v is a folder", path)
+	}
+
+	dirty, sum, err := s.isDirty(message.Path, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if sum == incomingSum { // same either way
+		return nil, nil
+	}
+
+	if !dirty && !s.isBaseStale(message) {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	s.conflicts++
+	s.mu.Unlock()
+
+	return s.resolve(message.Modified, info.ModTime()), nil
+}
+
+// checkDelete returns true if the thing at path has changed on this side since the last sync, in which case it's kept
+// (changes always win over deletes, whatever the conflict policy)
+func (s *SyncState) checkDelete(path string, message *Message) (bool, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if !info.IsDir() {
+		dirty, _, err := s.isDirty(message.Path, path)
+		if err != nil {
+			return false, err
+		}
+
+		if !dirty && !s.isBaseStale(message) {
+			return false, nil
+		}
+
+		s.mu.Lock()
+		s.conflicts++
+		s.mu.Unlock()
+
+		return true, nil
+	}
+
+	changed := false
+
+	err = filepath.WalkDir(path, func(otherPath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() && d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(path, otherPath)
+		if err != nil {
+			return nil
+		}
+
+		relativePath = message.Path + "/" + filepath.ToSlash(relativePath)
+
+		_, ok := s.get(relativePath)
+		if !ok { // note: never synced (probably ignored), so the other side can't have meant to keep it
+			return nil
+		}
+
+		dirty, _, err := s.isDirty(relativePath, otherPath)
+		if err != nil || !dirty {
+			return nil
+		}
+
+		changed = true
+
+		return errStopWalk
+	})
+	if err != nil && err != errStopWalk {
+		return false, err
+	}
+
+	if changed {
+		s.mu.Lock()
+		s.conflicts++
+		s.mu.Unlock()
+	}
+
+	return changed, nil
+}
+
+// checkMove returns a conflict if something is being moved (from fromPath) over the thing at path and that has changed
+// on this side since the last sync (or since what the other side last heard from us)
+func (s *SyncState) checkMove(path string, fromPath string, message *Message) (*syncConflict, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	fromInfo, err := os.Lstat(fromPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if os.SameFile(info, fromInfo) {
+		return nil, nil
+	}
+
+	if !info.IsDir() && !fromInfo.IsDir() {
+		_, fromSum, err := s.isDirty(message.FromPath, fromPath)
+		if err != nil {
+			return nil, err
+		}
+
+		return s.checkWrite(path, message, fromSum)
+	}
+
+	// note: with a folder on either side, it's whatever checkDelete would keep if the thing at path were deleted
+	changed, err := s.checkDelete(path, message)
+	if err != nil || !changed {
+		return nil, err
+	}
+
+	return s.resolve(message.Modified, info.ModTime()), nil
+}
+
+// getFileByPath is the base as Files under path, for the Differ to start from (so its first diff is everything that
+// has changed on this side since the last sync); folders with anything recorded under them are included, so that
+// deleting one is seen as deleting the folder rather than everything in it
+func (s *SyncState) getFileByPath(path string) map[string]*File {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fileByPath := make(map[string]*File)
+
+	for relativePath, record := range s.recordByPath {
+		file := GetFileWithoutInfo(filepath.Join(path, filepath.FromSlash(relativePath)))
+		file.HasInfo = true
+		file.IsDir = record.IsDir
+		file.Size = record.Size
+		file.Modified = record.Modified
+		file.Mode = record.Mode
+		file.Inode = record.Inode
+
+		fileByPath[file.Path] = file
+
+		for folderPath := file.ParentPath; strings.HasPrefix(folderPath, path+"/"); folderPath = filepath.Dir(folderPath) {
+			_, ok := fileByPath[folderPath]
+			if ok {
+				break
+			}
+
+			folder := GetFileWithoutInfo(folderPath)
+			folder.HasInfo = true
+			folder.IsDir = true
+			folder.Mode = fs.ModeDir | 0755
+
+			fileByPath[folderPath] = folder
+		}
+	}
+
+	return fileByPath
+}
+
+func (s *SyncState) save() error {
+	s.mu.Lock()
+	recordByPath := make(map[string]*SyncRecord, len(s.recordByPath))
+	for relativePath, record := range s.recordByPath {
+		recordByPath[relativePath] = record
+	}
+	s.changed = false
+	s.lastSaved = time.Now()
+	s.mu.Unlock()
+
+	return saveBase(s.path, recordByPath)
+}
+
+// saveIfDue saves the base if it has changed and hasn't been saved for a while (it's saved on the way out too, this is
+// in case we don't get to do that)
+func (s *SyncState) saveIfDue() {
+	s.mu.Lock()
+	due := s.changed && time.Since(s.lastSaved) > baseSaveInterval
+	s.mu.Unlock()
+
+	if !due {
+		return
+	}
+
+	err := s.save()
+	if err != nil {
+		log.Printf("warning: attempt to save sync base for %v caused %v", s.path, err)
+	}
+}
+
+// Save writes the base to .syncer/base
+func (s *SyncState) Save() {
+	err := s.save()
+	if err != nil {
+		log.Printf("warning: attempt to save sync base for %v caused %v", s.path, err)
+		return
+	}
+
+	log.Printf("saved sync base for %v", s.path)
+}
+
+// Conflicts is the number of conflicts this side has resolved
+func (s *SyncState) Conflicts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conflicts
+}
+
+// getConflictPath is where the losing version goes for ConflictPolicyBoth; both sides pick the same one as long as they
+// agree on what's there
+func getConflictPath(path string) string {
+	conflictPath := path + conflictSuffix
+
+	for i := 2; ; i++ {
+		_, err := os.Lstat(conflictPath)
+		if err != nil {
+			return conflictPath
+		}
+
+		conflictPath = fmt.Sprintf("%v%v.%v", path, conflictSuffix, i)
+	}
+}
@@ -0,0 +1,388 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getBidirectionalLoopback(t *testing.T, conflictPolicy ConflictPolicy) *loopback {
+	t.Helper()
+
+	localPath := t.TempDir()
+	remotePath := t.TempDir()
+
+	localState, err := GetSyncState(localPath, true, conflictPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remoteState, err := GetSyncState(remotePath, false, conflictPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return getLoopbackWithState(t, 1, localPath, remotePath, localState, remoteState)
+}
+
+func writeTestFileModified(t *testing.T, path string, data string, modified time.Time) {
+	t.Helper()
+
+	writeTestFile(t, path, data)
+
+	err := os.Chtimes(path, modified, modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(data)
+}
+
+func TestConflictPolicies(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name           string
+		conflictPolicy ConflictPolicy
+		localModified  time.Time
+		remoteModified time.Time
+		remoteEdit     bool
+		want           string
+		wantConflict   string
+		wantConflicts  int
+	}{
+		{
+			name:           "no conflict",
+			conflictPolicy: ConflictPolicyNewest,
+			localModified:  now.Add(-time.Hour),
+			want:           "local edit",
+		},
+		{
+			name:           "local wins",
+			conflictPolicy: ConflictPolicyLocal,
+			localModified:  now.Add(-time.Hour),
+			remoteModified: now,
+			remoteEdit:     true,
+			want:           "local edit",
+			wantConflicts:  1,
+		},
+		{
+			name:           "newest wins (the local edit)",
+			conflictPolicy: ConflictPolicyNewest,
+			localModified:  now,
+			remoteModified: now.Add(-time.Hour),
+			remoteEdit:     true,
+			want:           "local edit",
+			wantConflicts:  1,
+		},
+		{
+			name:           "newest wins (the remote edit)",
+			conflictPolicy: ConflictPolicyNewest,
+			localModified:  now.Add(-time.Hour),
+			remoteModified: now,
+			remoteEdit:     true,
+			want:           "remote edit",
+			wantConflicts:  1,
+		},
+		{
+			name:           "newest with a tie (the local side wins)",
+			conflictPolicy: ConflictPolicyNewest,
+			localModified:  now,
+			remoteModified: now,
+			remoteEdit:     true,
+			want:           "local edit",
+			wantConflicts:  1,
+		},
+		{
+			name:           "keep both",
+			conflictPolicy: ConflictPolicyBoth,
+			localModified:  now.Add(-time.Hour),
+			remoteModified: now,
+			remoteEdit:     true,
+			want:           "local edit",
+			wantConflict:   "remote edit",
+			wantConflicts:  1,
+		},
+	}
+
+	for _, test := range tests {
+		l := getBidirectionalLoopback(t, test.conflictPolicy)
+
+		localFilePath := filepath.Join(l.localPath, "a.txt")
+		remoteFilePath := filepath.Join(l.remotePath, "a.txt")
+
+		writeTestFileModified(t, localFilePath, "base", now.Add(-time.Hour*2))
+		l.sync(t)
+
+		if readTestFile(t, remoteFilePath) != "base" {
+			t.Fatalf("%v: the base didn't make it to the remote", test.name)
+		}
+
+		// note: the remote edit is one that hasn't made it back to the local side yet
+		if test.remoteEdit {
+			writeTestFileModified(t, remoteFilePath, "remote edit", test.remoteModified)
+		}
+
+		writeTestFileModified(t, localFilePath, "local edit", test.localModified)
+		l.sync(t)
+
+		got := readTestFile(t, remoteFilePath)
+		if got != test.want {
+			t.Errorf("%v: the remote has %q; wanted %q", test.name, got, test.want)
+		}
+
+		gotConflict := readTestFile(t, remoteFilePath+conflictSuffix)
+		if gotConflict != test.wantConflict {
+			t.Errorf("%v: the remote has %q as the conflict; wanted %q", test.name, gotConflict, test.wantConflict)
+		}
+
+		if l.remoteState.Conflicts() != test.wantConflicts {
+			t.Errorf("%v: the remote had %v conflicts; wanted %v", test.name, l.remoteState.Conflicts(), test.wantConflicts)
+		}
+	}
+}
+
+func TestConflictChangeWinsOverDelete(t *testing.T) {
+	l := getBidirectionalLoopback(t, ConflictPolicyLocal)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.txt"), "base")
+	writeTestFile(t, filepath.Join(l.localPath, "folder", "b.txt"), "base")
+	writeTestFile(t, filepath.Join(l.localPath, "c.txt"), "base")
+	l.sync(t)
+
+	writeTestFile(t, filepath.Join(l.remotePath, "a.txt"), "remote edit")
+	writeTestFile(t, filepath.Join(l.remotePath, "folder", "b.txt"), "remote edit")
+
+	for _, name := range []string{"a.txt", "folder", "c.txt"} {
+		err := os.RemoveAll(filepath.Join(l.localPath, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.sync(t)
+
+	if readTestFile(t, filepath.Join(l.remotePath, "a.txt")) != "remote edit" {
+		t.Errorf("a.txt was changed on the remote but deleted anyway")
+	}
+
+	if readTestFile(t, filepath.Join(l.remotePath, "folder", "b.txt")) != "remote edit" {
+		t.Errorf("folder/b.txt was changed on the remote but its folder was deleted anyway")
+	}
+
+	_, err := os.Lstat(filepath.Join(l.remotePath, "c.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("c.txt wasn't changed on the remote but wasn't deleted (%v)", err)
+	}
+
+	if l.remoteState.Conflicts() != 2 {
+		t.Errorf("the remote had %v conflicts; wanted 2", l.remoteState.Conflicts())
+	}
+}
+
+func TestSyncStateRollback(t *testing.T) {
+	s, err := GetSyncState(t.TempDir(), true, ConflictPolicyNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.set("a.txt", &SyncRecord{Sum: [16]byte{1}})
+	s.set("folder", &SyncRecord{IsDir: true})
+	s.set("folder/b.txt", &SyncRecord{Sum: [16]byte{2}})
+
+	journal := &syncJournal{}
+
+	s.prepare(&Message{Type: MessageTypeWrite, Path: "a.txt"}, nil, [16]byte{3}, journal)
+	s.prepare(&Message{Type: MessageTypeWrite, Path: "new.txt"}, nil, [16]byte{4}, journal)
+	s.prepare(&Message{Type: MessageTypeMove, Path: "moved", FromPath: "folder"}, nil, [16]byte{}, journal)
+
+	record, _ := s.get("a.txt")
+	if record.Sum != [16]byte{3} {
+		t.Fatalf("prepare didn't change a.txt")
+	}
+
+	s.rollback(journal)
+
+	record, ok := s.get("a.txt")
+	if !ok || record.Sum != [16]byte{1} {
+		t.Errorf("a.txt wasn't put back")
+	}
+
+	_, ok = s.get("new.txt")
+	if ok {
+		t.Errorf("new.txt wasn't forgotten")
+	}
+
+	record, ok = s.get("folder/b.txt")
+	if !ok || record.Sum != [16]byte{2} {
+		t.Errorf("folder/b.txt wasn't moved back")
+	}
+
+	if len(s.getUnder("moved")) != 0 {
+		t.Errorf("%v were left where they were moved to", s.getUnder("moved"))
+	}
+}
+
+func TestSyncStateAcrossRestarts(t *testing.T) {
+	l := getBidirectionalLoopback(t, ConflictPolicyNewest)
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(l.localPath, "folder", "b.txt"), "b")
+	l.sync(t)
+
+	l.localState.Save()
+	l.remoteState.Save()
+
+	// note: these happen while both sides are stopped
+	err := os.Remove(filepath.Join(l.localPath, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(l.localPath, "c.txt"), "c")
+	writeTestFile(t, filepath.Join(l.remotePath, "d.txt"), "d")
+
+	localState, err := GetSyncState(l.localPath, true, ConflictPolicyNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remoteState, err := GetSyncState(l.remotePath, false, ConflictPolicyNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, relativePath := range []string{"a.txt", "folder", "folder/b.txt"} {
+		_, ok := localState.get(relativePath)
+		if !ok {
+			t.Errorf("%v wasn't in the local base after a restart", relativePath)
+		}
+
+		_, ok = remoteState.get(relativePath)
+		if !ok {
+			t.Errorf("%v wasn't in the remote base after a restart", relativePath)
+		}
+	}
+
+	restarted := getLoopbackWithState(t, 1, l.localPath, l.remotePath, localState, remoteState)
+	restarted.differ.setBase(localState.getFileByPath(l.localPath))
+
+	fileByPath, _, _, err := GetFileByPathAndFolderByPathAndGitIgnoreByPathForPath(l.localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted.differ.update(fileByPath)
+
+	// note: only what changed while stopped, rather than everything being new
+	added, removed, modified, moved := restarted.differ.diff()
+	delete(added, l.localPath) // note: the base is only what's under the top
+
+	if len(added) != 1 || added[filepath.Join(l.localPath, "c.txt")] == nil {
+		t.Errorf("%v were added; wanted just c.txt", len(added))
+	}
+
+	if len(removed) != 1 || removed[filepath.Join(l.localPath, "a.txt")] == nil {
+		t.Errorf("%v were removed; wanted just a.txt", len(removed))
+	}
+
+	if len(modified) != 0 || len(moved) != 0 {
+		t.Errorf("%v were modified and %v were moved; wanted none", len(modified), len(moved))
+	}
+
+	err = restarted.sender.send(added, removed, modified, moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// note: d.txt was created on the remote (rather than deleted here), so it stays
+	for relativePath, want := range map[string]string{"a.txt": "", "folder/b.txt": "b", "c.txt": "c", "d.txt": "d"} {
+		got := readTestFile(t, filepath.Join(l.remotePath, filepath.FromSlash(relativePath)))
+		if got != want {
+			t.Errorf("%v is %q on the remote; wanted %q", relativePath, got, want)
+		}
+	}
+}
+
+func TestConflictMoveOverAChange(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	tests := []struct {
+		name           string
+		conflictPolicy ConflictPolicy
+		remoteModified time.Time
+		want           string
+		wantConflict   string
+	}{
+		{
+			name:           "keep both",
+			conflictPolicy: ConflictPolicyBoth,
+			remoteModified: now,
+			want:           "a",
+			wantConflict:   "remote b",
+		},
+		{
+			name:           "newest wins (the remote one)",
+			conflictPolicy: ConflictPolicyNewest,
+			remoteModified: now,
+			want:           "remote b",
+		},
+		{
+			name:           "newest wins (the moved one)",
+			conflictPolicy: ConflictPolicyNewest,
+			remoteModified: now.Add(-time.Hour * 2),
+			want:           "a",
+		},
+	}
+
+	for _, test := range tests {
+		l := getBidirectionalLoopback(t, test.conflictPolicy)
+
+		writeTestFileModified(t, filepath.Join(l.localPath, "a.txt"), "a", now.Add(-time.Hour))
+		l.sync(t)
+
+		// note: b.txt is new on the remote and hasn't made it to the local side yet
+		writeTestFileModified(t, filepath.Join(l.remotePath, "b.txt"), "remote b", test.remoteModified)
+
+		err := os.Rename(filepath.Join(l.localPath, "a.txt"), filepath.Join(l.localPath, "b.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l.sync(t)
+
+		got := readTestFile(t, filepath.Join(l.remotePath, "b.txt"))
+		if got != test.want {
+			t.Errorf("%v: the remote has %q; wanted %q", test.name, got, test.want)
+		}
+
+		gotConflict := readTestFile(t, filepath.Join(l.remotePath, "b.txt"+conflictSuffix))
+		if gotConflict != test.wantConflict {
+			t.Errorf("%v: the remote has %q as the conflict; wanted %q", test.name, gotConflict, test.wantConflict)
+		}
+
+		// note: whichever wins, the other side doesn't have it where it was any more
+		_, err = os.Lstat(filepath.Join(l.remotePath, "a.txt"))
+		if !os.IsNotExist(err) {
+			t.Errorf("%v: a.txt was left on the remote (%v)", test.name, err)
+		}
+
+		if l.remoteState.Conflicts() != 1 {
+			t.Errorf("%v: the remote had %v conflicts; wanted 1", test.name, l.remoteState.Conflicts())
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package syncer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/initialed85/syncer/internal/utils"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTransferWorkers = 4
+	// transferJobSize is how much goes in one transfer job; small files share a job, anything bigger gets its own
+	transferJobSize = 4 * 1024 * 1024
+)
+
+const (
+	tierHot = iota
+	tierNormal
+	tierCold
+)
+
+// transferStats is how much was sent (and how) across however many batches
+type transferStats struct {
+	messages        int
+	bytes           int
+	deltaFiles      int
+	deltaBytes      int
+	chunkedFiles    int
+	chunkedBytes    int
+	newChunkedBytes int
+	archives        int
+	archivedFiles   int
+	streamedFiles   int
+}
+
+func (t *transferStats) add(other *transferStats) {
+	t.messages += other.messages
+	t.bytes += other.bytes
+	t.deltaFiles += other.deltaFiles
+	t.deltaBytes += other.deltaBytes
+	t.chunkedFiles += other.chunkedFiles
+	t.chunkedBytes += other.chunkedBytes
+	t.newChunkedBytes += other.newChunkedBytes
+	t.archives += other.archives
+	t.archivedFiles += other.archivedFiles
+	t.streamedFiles += other.streamedFiles
+}
+
+func (s *Sender) logTransferStats(stats *transferStats, took time.Duration) {
+	log.Printf("sent %v changes (%v bytes) to %v in %v", stats.messages, stats.bytes, s.peerName, took)
+
+	if stats.archives > 0 {
+		log.Printf("sent %v files in %v archives", stats.archivedFiles, stats.archives)
+	}
+
+	if stats.streamedFiles > 0 {
+		log.Printf("sent %v files as streams", stats.streamedFiles)
+	}
+
+	if stats.chunkedFiles > 0 {
+		log.Printf("sent %v files as chunks (%v of %v bytes were new to %v)", stats.chunkedFiles, stats.newChunkedBytes, stats.chunkedBytes, s.peerName)
+	}
+
+	if stats.deltaFiles > 0 {
+		log.Printf("sent %v files as deltas (%v literal bytes)", stats.deltaFiles, stats.deltaBytes)
+	}
+}
+
+// splitWrites splits messages into the writes and everything else (which stays in order)
+func splitWrites(messages []*Message) ([]*Message, []*Message) {
+	orderedMessages := make([]*Message, 0)
+	writeMessages := make([]*Message, 0)
+
+	for _, message := range messages {
+		if message.Type == MessageTypeWrite {
+			writeMessages = append(writeMessages, message)
+			continue
+		}
+
+		orderedMessages = append(orderedMessages, message)
+	}
+
+	return orderedMessages, writeMessages
+}
+
+// isUnderPath is true if relativePath is folderPath or anything in it
+func isUnderPath(relativePath string, folderPath string) bool {
+	folderPath = strings.Trim(filepath.ToSlash(folderPath), "/")
+	if folderPath == "" {
+		return false
+	}
+
+	return relativePath == folderPath || strings.HasPrefix(relativePath, folderPath+"/")
+}
+
+func (s *Sender) getTier(relativePath string) int {
+	for _, hotPath := range s.hotPaths {
+		if isUnderPath(relativePath, hotPath) {
+			return tierHot
+		}
+	}
+
+	for _, coldPath := range s.coldPaths {
+		if isUnderPath(relativePath, coldPath) {
+			return tierCold
+		}
+	}
+
+	return tierNormal
+}
+
+// transfer is a write along with what it's prioritised by
+type transfer struct {
+	message  *Message
+	tier     int
+	size     int64
+	modified time.Time
+}
+
+// getTransfers returns the writes in the order they should be sent in; hot paths before everything else (and cold
+// paths after it), then small files before large ones, then the most recently modified first
+func (s *Sender) getTransfers(messages []*Message) []*transfer {
+	transfers := make([]*transfer, 0, len(messages))
+
+	for _, message := range messages {
+		t := transfer{
+			message: message,
+			tier:    s.getTier(message.Path),
+		}
+
+		// note: if it's gone by now, it's skipped when it's read
+		info, err := os.Lstat(filepath.Join(s.localPath, filepath.FromSlash(message.Path)))
+		if err == nil {
+			t.size = info.Size()
+			t.modified = info.ModTime()
+		}
+
+		transfers = append(transfers, &t)
+	}
+
+	sort.SliceStable(transfers, func(i, j int) bool {
+		a, b := transfers[i], transfers[j]
+
+		if a.tier != b.tier {
+			return a.tier < b.tier
+		}
+
+		aLarge, bLarge := a.size >= transferJobSize, b.size >= transferJobSize
+		if aLarge != bLarge {
+			return bLarge
+		}
+
+		if !a.modified.Equal(b.modified) {
+			return a.modified.After(b.modified)
+		}
+
+		return a.size < b.size
+	})
+
+	return transfers
+}
+
+// getTransferJobs groups transfers (in order) into jobs, each of which is sent and committed as its own batch
+func getTransferJobs(transfers []*transfer) [][]*Message {
+	jobs := make([][]*Message, 0)
+
+	job := make([]*Message, 0)
+	jobSize := int64(0)
+
+	for _, t := range transfers {
+		if t.size >= transferJobSize {
+			if len(job) > 0 {
+				jobs = append(jobs, job)
+				job = make([]*Message, 0)
+				jobSize = 0
+			}
+
+			jobs = append(jobs, []*Message{t.message})
+			continue
+		}
+
+		job = append(job, t.message)
+		jobSize += t.size
+
+		if jobSize >= transferJobSize {
+			jobs = append(jobs, job)
+			job = make([]*Message, 0)
+			jobSize = 0
+		}
+	}
+
+	if len(job) > 0 {
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+// pinTransfers returns the writes (out of transfers) to things at or under something that a move or delete in
+// orderedMessages touches, as those have to be staged after it on the same conn (see batch.affects), and the rest
+func pinTransfers(orderedMessages []*Message, transfers []*transfer) ([]*Message, []*transfer) {
+	touchedPaths := make([]string, 0)
+	for _, message := range orderedMessages {
+		switch message.Type {
+		case MessageTypeDelete:
+			touchedPaths = append(touchedPaths, message.Path)
+		case MessageTypeMove:
+			touchedPaths = append(touchedPaths, message.Path, message.FromPath)
+		}
+	}
+
+	pinnedMessages := make([]*Message, 0)
+	otherTransfers := make([]*transfer, 0, len(transfers))
+
+	for _, t := range transfers {
+		pinned := false
+		for _, touchedPath := range touchedPaths {
+			if isUnderRelativePath(t.message.Path, touchedPath) {
+				pinned = true
+				break
+			}
+		}
+
+		if pinned {
+			pinnedMessages = append(pinnedMessages, t.message)
+		} else {
+			otherTransfers = append(otherTransfers, t)
+		}
+	}
+
+	return pinnedMessages, otherTransfers
+}
+
+// transferQueue is the jobs still to be sent in a window (most important first)
+type transferQueue struct {
+	mu   sync.Mutex
+	jobs [][]*Message
+}
+
+func (q *transferQueue) take() ([]*Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.jobs) == 0 {
+		return nil, false
+	}
+
+	job := q.jobs[0]
+	q.jobs = q.jobs[1:]
+
+	return job, true
+}
+
+// putBack is for the jobs of a conn that failed (they go to the front, as they were taken first)
+func (q *transferQueue) putBack(jobs [][]*Message) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs = append(append(make([][]*Message, 0, len(jobs)+len(q.jobs)), jobs...), q.jobs...)
+}
+
+// getTransferConns returns up to count more conns to the receiver (on top of s.conn), dialling any it doesn't have yet;
+// they can only be dialled to a receiver that's listening, so it's none for anything else
+func (s *Sender) getTransferConns(count int) []*Conn {
+	if s.remoteHost == "" || len(s.remoteCommand) > 0 { // note: a command would start another receiver entirely
+		return nil
+	}
+
+	for len(s.transferConns) < count {
+		conn, err := s.dial(false)
+		if err != nil {
+			log.Printf("warning: attempt to connect another transfer worker to %v caused %v", s.remoteHost, err)
+			break
+		}
+
+		s.transferConns = append(s.transferConns, conn)
+	}
+
+	if len(s.transferConns) < count {
+		return s.transferConns
+	}
+
+	return s.transferConns[:count]
+}
+
+// dropTransferConn closes a transfer conn that has failed (so that it isn't used again)
+func (s *Sender) dropTransferConn(conn *Conn) {
+	_ = conn.Close()
+
+	for i, transferConn := range s.transferConns {
+		if transferConn == conn {
+			s.transferConns = append(s.transferConns[:i], s.transferConns[i+1:]...)
+			return
+		}
+	}
+}
+
+func getWindow() (string, error) {
+	window := make([]byte, 8)
+
+	_, err := rand.Read(window)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(window), nil
+}
+
+// sendTransfers sends messages (one debounce window's worth) and commits them in one go; the writes go last, in order
+// of priority (see getTransfers), and if there's more than one job's worth they're shared out over up to
+// transferWorkers conns, so that e.g. a file that was just saved doesn't wait behind a large one
+func (s *Sender) sendTransfers(conn *Conn, messages []*Message, stats *transferStats) (*Message, error) {
+	orderedMessages, writeMessages := splitWrites(messages)
+
+	pinnedMessages, transfers := pinTransfers(orderedMessages, s.getTransfers(writeMessages))
+	orderedMessages = append(orderedMessages, pinnedMessages...)
+
+	jobs := getTransferJobs(transfers)
+
+	workers := s.transferWorkers
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	var transferConns []*Conn
+	if workers > 1 {
+		transferConns = s.getTransferConns(workers - 1)
+	}
+
+	if len(transferConns) == 0 {
+		for _, job := range jobs {
+			orderedMessages = append(orderedMessages, job...)
+		}
+
+		return s.sendBatch(conn, orderedMessages, stats, true)
+	}
+
+	return s.sendWindow(conn, transferConns, orderedMessages, jobs, stats)
+}
+
+// sendWindow stages orderedMessages and then jobs on conn, with the jobs shared out over transferConns too (which hand
+// what they've staged off to the commit on conn); it's all applied at that commit, just as if it went over one conn
+func (s *Sender) sendWindow(
+	conn *Conn,
+	transferConns []*Conn,
+	orderedMessages []*Message,
+	jobs [][]*Message,
+	stats *transferStats,
+) (*Message, error) {
+	window, err := getWindow()
+	if err != nil {
+		return nil, err
+	}
+
+	utils.DebugLog("sender", "window", fmt.Sprintf("%v jobs over %v conns", len(jobs), len(transferConns)+1))
+
+	queue := &transferQueue{jobs: jobs}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	staged := make([]*stagedBatch, 0)
+	failedConns := make([]*Conn, 0)
+	handOffs := 0
+
+	for _, transferConn := range transferConns {
+		wg.Add(1)
+		go func(transferConn *Conn) {
+			defer wg.Done()
+
+			workerStaged := &stagedBatch{}
+			workerStats := &transferStats{}
+			takenJobs := make([][]*Message, 0)
+
+			var err error
+
+			for {
+				job, ok := queue.take()
+				if !ok {
+					break
+				}
+
+				takenJobs = append(takenJobs, job)
+
+				err = s.stageBatch(transferConn, job, workerStats, true, workerStaged)
+				if err != nil {
+					break
+				}
+			}
+
+			if err == nil && len(takenJobs) > 0 {
+				_, err = transferConn.request(&Message{Type: MessageTypeHandOff, Window: window})
+			}
+
+			// note: the other side throws away what this conn staged, so it's all sent again over the others
+			if err != nil {
+				log.Printf("warning: transfer conn to %v caused %v; sending its %v jobs over the others", s.peerName, err, len(takenJobs))
+
+				_ = transferConn.Close()
+				s.rollback([]*stagedBatch{workerStaged})
+				queue.putBack(takenJobs)
+
+				mu.Lock()
+				failedConns = append(failedConns, transferConn)
+				mu.Unlock()
+
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			stats.add(workerStats)
+
+			if len(takenJobs) > 0 {
+				staged = append(staged, workerStaged)
+				handOffs++
+			}
+		}(transferConn)
+	}
+
+	connStaged := &stagedBatch{}
+	connStats := &transferStats{}
+
+	err = s.stageBatch(conn, orderedMessages, connStats, true, connStaged)
+
+	takeJobs := func() {
+		for err == nil {
+			job, ok := queue.take()
+			if !ok {
+				return
+			}
+
+			err = s.stageBatch(conn, job, connStats, true, connStaged)
+		}
+	}
+
+	takeJobs()
+	wg.Wait()
+	takeJobs() // note: for the jobs of any transfer conn that failed after the queue ran dry
+
+	for _, failedConn := range failedConns {
+		s.dropTransferConn(failedConn)
+	}
+
+	stats.add(connStats)
+	staged = append([]*stagedBatch{connStaged}, staged...)
+
+	if err != nil {
+		s.rollback(staged)
+		return nil, err
+	}
+
+	return s.commitBatch(
+		conn,
+		&Message{Type: MessageTypeCommit, Window: window, HandOffs: handOffs},
+		stats,
+		staged,
+	)
+}
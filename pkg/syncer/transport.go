@@ -0,0 +1,380 @@
+package syncer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	transportHandshakeTimeout = time.Second * 10
+	DefaultKeyPairValidFor    = time.Hour * 24 * 365 * 10
+	pskLabel                  = "EXPORTER-syncer-psk"
+	pskSize                   = 32
+	minPSKSize                = 16
+)
+
+// Transport secures the conns between the two sides with TLS; each side proves who it is with either a certificate
+// (checked against a CA and / or pinned fingerprints) or a pre-shared key (or both). A nil Transport leaves conns as
+// they are.
+type Transport struct {
+	certificate  tls.Certificate
+	caPool       *x509.CertPool
+	fingerprints map[string]bool
+	psk          []byte
+}
+
+// GetTransport returns a Transport for the flags given, or nil if none were; with only a pskPath, the certificate is
+// made up on the spot (it's only for the encryption, as the key is what's checked)
+func GetTransport(certPath string, keyPath string, caPath string, fingerprints []string, pskPath string) (*Transport, error) {
+	if certPath == "" && keyPath == "" && caPath == "" && len(fingerprints) == 0 && pskPath == "" {
+		return nil, nil
+	}
+
+	t := Transport{
+		fingerprints: make(map[string]bool),
+	}
+
+	for _, fingerprint := range fingerprints {
+		normalisedFingerprint, err := normaliseFingerprint(fingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		t.fingerprints[normalisedFingerprint] = true
+	}
+
+	if caPath != "" {
+		caPEM, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+
+		t.caPool = x509.NewCertPool()
+		if !t.caPool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("there are no certificates in %v", caPath)
+		}
+	}
+
+	if pskPath != "" {
+		psk, err := os.ReadFile(pskPath)
+		if err != nil {
+			return nil, err
+		}
+
+		t.psk = []byte(strings.TrimSpace(string(psk)))
+		if len(t.psk) < minPSKSize {
+			return nil, fmt.Errorf("the pre-shared key in %v is too short (it needs at least %v characters)", pskPath, minPSKSize)
+		}
+	}
+
+	var err error
+
+	if certPath != "" || keyPath != "" {
+		t.certificate, err = tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.caPool == nil && len(t.fingerprints) == 0 && t.psk == nil {
+			return nil, fmt.Errorf("there's nothing to check the other side's certificate against (a CA or a fingerprint to pin)")
+		}
+
+		log.Printf("using the certificate in %v (fingerprint %v)", certPath, getFingerprint(t.certificate.Certificate[0]))
+	} else {
+		if t.caPool != nil || len(t.fingerprints) > 0 {
+			return nil, fmt.Errorf("the other side's certificate can only be checked if this side has one too")
+		}
+
+		certPEM, keyPEM, err := generateKeyPair("syncer", DefaultKeyPairValidFor)
+		if err != nil {
+			return nil, err
+		}
+
+		t.certificate, err = tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+func getFingerprint(rawCert []byte) string {
+	fingerprint := sha256.Sum256(rawCert)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// normaliseFingerprint allows for the usual ways of writing a SHA-256 fingerprint (e.g. AB:CD:... or abcd...)
+func normaliseFingerprint(fingerprint string) (string, error) {
+	normalisedFingerprint := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+
+	rawFingerprint, err := hex.DecodeString(normalisedFingerprint)
+	if err != nil || len(rawFingerprint) != sha256.Size {
+		return "", fmt.Errorf("%#+v isn't a SHA-256 fingerprint", fingerprint)
+	}
+
+	return normalisedFingerprint, nil
+}
+
+// verifyPeer is instead of the usual checks (which go by hostnames, and there's no telling what the other side will be
+// reached as); the certificate has to be signed by the CA and / or pinned, whichever are set
+func (t *Transport) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("the other side has no certificate")
+	}
+
+	fingerprint := getFingerprint(rawCerts[0])
+
+	if len(t.fingerprints) > 0 && !t.fingerprints[fingerprint] {
+		return fmt.Errorf("the other side's certificate (fingerprint %v) isn't pinned", fingerprint)
+	}
+
+	if t.caPool == nil {
+		return nil
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         t.caPool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return fmt.Errorf("the other side's certificate (fingerprint %v) isn't signed by the CA: %v", fingerprint, err)
+	}
+
+	return nil
+}
+
+func (t *Transport) getTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates:          []tls.Certificate{t.certificate},
+		MinVersion:            tls.VersionTLS13,
+		InsecureSkipVerify:    true, // note: see verifyPeer
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: t.verifyPeer,
+	}
+}
+
+// getPSKProof is the proof that whoever is on the side called role knows the pre-shared key; it's tied to the TLS
+// session, so it's no good to anybody in the middle (who'd have a different session with each side)
+func (t *Transport) getPSKProof(tlsConn *tls.Conn, role string) ([]byte, error) {
+	state := tlsConn.ConnectionState()
+
+	keyingMaterial, err := state.ExportKeyingMaterial(pskLabel, nil, pskSize)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, t.psk)
+	_, _ = mac.Write([]byte(role))
+	_, _ = mac.Write(keyingMaterial)
+
+	return mac.Sum(nil), nil
+}
+
+// checkPSK has the client prove it knows the pre-shared key first, so the server gives nothing away to a client that
+// doesn't
+func (t *Transport) checkPSK(tlsConn *tls.Conn, isClient bool) error {
+	clientProof, err := t.getPSKProof(tlsConn, "client")
+	if err != nil {
+		return err
+	}
+
+	serverProof, err := t.getPSKProof(tlsConn, "server")
+	if err != nil {
+		return err
+	}
+
+	ownProof, otherProof := serverProof, clientProof
+	if isClient {
+		ownProof, otherProof = clientProof, serverProof
+	}
+
+	if isClient {
+		_, err = tlsConn.Write(ownProof)
+		if err != nil {
+			return err
+		}
+	}
+
+	proof := make([]byte, len(otherProof))
+
+	_, err = io.ReadFull(tlsConn, proof)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(proof, otherProof) {
+		return fmt.Errorf("the other side doesn't have the same pre-shared key")
+	}
+
+	if !isClient {
+		_, err = tlsConn.Write(ownProof)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Transport) secure(conn net.Conn, isClient bool) (net.Conn, error) {
+	if t == nil {
+		return conn, nil
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(transportHandshakeTimeout))
+
+	var tlsConn *tls.Conn
+	if isClient {
+		tlsConn = tls.Client(conn, t.getTLSConfig())
+	} else {
+		tlsConn = tls.Server(conn, t.getTLSConfig())
+	}
+
+	err := tlsConn.Handshake()
+	if err == nil && t.psk != nil {
+		err = t.checkPSK(tlsConn, isClient)
+	}
+
+	if err != nil {
+		_ = tlsConn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+// client secures a conn this side made
+func (t *Transport) client(conn net.Conn) (net.Conn, error) {
+	return t.secure(conn, true)
+}
+
+// server secures a conn the other side made
+func (t *Transport) server(conn net.Conn) (net.Conn, error) {
+	return t.secure(conn, false)
+}
+
+func generateKeyPair(commonName string, validFor time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-time.Hour), // note: in case the clocks don't quite agree
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true, // note: so it can be given as the other side's -tlsCA too
+	}
+
+	rawCert, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCert})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rawKey})
+
+	return certPEM, keyPEM, nil
+}
+
+// writeNewFile is for keys and so on, which shouldn't ever be overwritten by accident
+func writeNewFile(path string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// GenerateKeyPair writes a new self-signed certificate and its key (for -tlsCert and -tlsKey) and returns the
+// certificate's fingerprint (for the other side's -tlsPeerFingerprint)
+func GenerateKeyPair(certPath string, keyPath string, commonName string, validFor time.Duration) (string, error) {
+	certPEM, keyPEM, err := generateKeyPair(commonName, validFor)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeNewFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeNewFile(certPath, certPEM, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode(certPEM)
+
+	return getFingerprint(block.Bytes), nil
+}
+
+// GeneratePSK writes a new random pre-shared key (for -pskFile)
+func GeneratePSK(path string) error {
+	psk := make([]byte, pskSize)
+
+	_, err := rand.Read(psk)
+	if err != nil {
+		return err
+	}
+
+	return writeNewFile(path, []byte(hex.EncodeToString(psk)+"\n"), 0600)
+}
@@ -0,0 +1,332 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/initialed85/syncer/internal/utils"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTrashMaxAge  = 7 * 24 * time.Hour
+	DefaultTrashMaxSize = 1024 * 1024 * 1024
+	trashFolderName     = ".syncer-trash"
+	// note: UTC and fixed width, so the names sort by time
+	trashTimeFormat = "20060102-150405.000000000"
+)
+
+// Trash is where the receiver puts anything it deletes or overwrites (rather than destroying it), in a folder per
+// commit named for when it happened; e.g. a server-only edit that somebody forgot about can be had back with Restore.
+// The oldest folders are thrown away once they're older than maxAge or the trash gets bigger than maxSize.
+type Trash struct {
+	mu       sync.Mutex
+	rootPath string
+	path     string
+	maxAge   time.Duration
+	maxSize  int64
+	size     int64
+}
+
+// GetTrash returns the Trash for the tree at rootPath; a maxAge or maxSize of 0 doesn't limit it
+func GetTrash(rootPath string, maxAge time.Duration, maxSize int64) (*Trash, error) {
+	t := Trash{
+		rootPath: rootPath,
+		path:     filepath.Join(rootPath, trashFolderName),
+		maxAge:   maxAge,
+		maxSize:  maxSize,
+	}
+
+	err := os.MkdirAll(t.path, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	t.size = getSizeUnder(t.path)
+
+	t.prune()
+
+	return &t, nil
+}
+
+func getTrashName(trashed time.Time) string {
+	return trashed.UTC().Format(trashTimeFormat)
+}
+
+// getSizeUnder is the size of path and (if it's a folder) everything under it
+func getSizeUnder(path string) int64 {
+	size := int64(0)
+
+	_ = filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		size += info.Size()
+
+		return nil
+	})
+
+	return size
+}
+
+// put moves path (and everything under it) into the trash folder trashName; if that already has something at the same
+// path (i.e. it's been replaced more than once in the same commit), the earlier version is the one that's kept
+func (t *Trash) put(trashName string, path string) error {
+	relativePath, err := filepath.Rel(t.rootPath, path)
+	if err != nil {
+		return err
+	}
+
+	trashPath := filepath.Join(t.path, trashName, relativePath)
+
+	_, err = os.Lstat(trashPath)
+	if err == nil {
+		return os.RemoveAll(path)
+	}
+
+	size := getSizeUnder(path)
+
+	err = os.MkdirAll(filepath.Dir(trashPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path, trashPath)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.size += size
+	t.mu.Unlock()
+
+	utils.DebugLog("trash", "put", fmt.Sprintf("%v -> %v", path, trashPath))
+
+	return nil
+}
+
+// keep puts a copy of the file (or symlink) at path in the trash folder trashName while leaving it where it is (so it
+// can be replaced by a rename, which is atomic, rather than being moved out of the way first)
+func (t *Trash) keep(trashName string, path string) error {
+	relativePath, err := filepath.Rel(t.rootPath, path)
+	if err != nil {
+		return err
+	}
+
+	trashPath := filepath.Join(t.path, trashName, relativePath)
+
+	_, err = os.Lstat(trashPath)
+	if err == nil {
+		return nil
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(trashPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	// note: a hard link is enough as whatever replaces the file is always a new one (see writeTempFile)
+	err = os.Link(path, trashPath)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.size += info.Size()
+	t.mu.Unlock()
+
+	utils.DebugLog("trash", "keep", fmt.Sprintf("%v -> %v", path, trashPath))
+
+	return nil
+}
+
+// getTrashedTimes returns when each of the folders in the trash was made (oldest first)
+func (t *Trash) getTrashedTimes() []time.Time {
+	entries, err := os.ReadDir(t.path)
+	if err != nil {
+		return nil
+	}
+
+	trashedTimes := make([]time.Time, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		trashed, err := time.Parse(trashTimeFormat, entry.Name())
+		if err != nil { // note: not one of ours
+			continue
+		}
+
+		trashedTimes = append(trashedTimes, trashed)
+	}
+
+	sort.Slice(trashedTimes, func(i, j int) bool {
+		return trashedTimes[i].Before(trashedTimes[j])
+	})
+
+	return trashedTimes
+}
+
+// prune throws away the oldest folders in the trash until none are older than maxAge and it's no bigger than maxSize
+func (t *Trash) prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pruned := 0
+
+	for _, trashed := range t.getTrashedTimes() {
+		tooOld := t.maxAge > 0 && time.Since(trashed) > t.maxAge
+		tooBig := t.maxSize > 0 && t.size > t.maxSize
+
+		if !tooOld && !tooBig {
+			break
+		}
+
+		path := filepath.Join(t.path, getTrashName(trashed))
+		size := getSizeUnder(path)
+
+		err := os.RemoveAll(path)
+		if err != nil {
+			log.Printf("warning: attempt to prune %v caused %v", path, err)
+			continue
+		}
+
+		t.size -= size
+		pruned++
+	}
+
+	if pruned > 0 {
+		log.Printf("pruned %v folders from %v to keep it under %v old and %v bytes", pruned, t.path, t.maxAge, t.maxSize)
+	}
+}
+
+// getVersions returns when each version of relativePath in the trash was trashed (oldest first)
+func (t *Trash) getVersions(relativePath string) []time.Time {
+	versions := make([]time.Time, 0)
+
+	for _, trashed := range t.getTrashedTimes() {
+		_, err := os.Lstat(filepath.Join(t.path, getTrashName(trashed), relativePath))
+		if err != nil {
+			continue
+		}
+
+		versions = append(versions, trashed)
+	}
+
+	return versions
+}
+
+// findTrashRoot returns the closest folder at or above path that has a trash
+func findTrashRoot(path string) (string, error) {
+	for folderPath := path; ; folderPath = filepath.Dir(folderPath) {
+		info, err := os.Stat(filepath.Join(folderPath, trashFolderName))
+		if err == nil && info.IsDir() {
+			return folderPath, nil
+		}
+
+		if filepath.Dir(folderPath) == folderPath {
+			return "", fmt.Errorf("there's no %v folder at or above %v", trashFolderName, path)
+		}
+	}
+}
+
+// Restore puts back the version of path that was there at the time at (i.e. the first version trashed after it), or
+// the last version trashed if at is zero; it goes to toPath if that's set. Whatever's in the way is trashed first, so
+// a restore can be undone the same way.
+func Restore(path string, at time.Time, toPath string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	rootPath, err := findTrashRoot(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+
+	t, err := GetTrash(rootPath, 0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	relativePath, err := filepath.Rel(rootPath, path)
+	if err != nil {
+		return "", err
+	}
+
+	versions := t.getVersions(relativePath)
+	if len(versions) == 0 {
+		return "", fmt.Errorf("there's no version of %v in %v", relativePath, t.path)
+	}
+
+	version := versions[len(versions)-1]
+	if !at.IsZero() {
+		i := sort.Search(len(versions), func(i int) bool {
+			return versions[i].After(at)
+		})
+
+		if i == len(versions) {
+			return "", fmt.Errorf("%v hasn't been trashed since %v (the last version was trashed at %v)", relativePath, at, versions[len(versions)-1].Local())
+		}
+
+		version = versions[i]
+	}
+
+	if toPath == "" {
+		toPath = path
+	}
+
+	toPath, err = filepath.Abs(toPath)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = os.Lstat(toPath)
+	if err == nil {
+		if !isUnderAnyPath(toPath, []string{rootPath}) {
+			return "", fmt.Errorf("%v is in the way", toPath)
+		}
+
+		err = t.put(getTrashName(time.Now()), toPath)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(toPath), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	trashPath := filepath.Join(t.path, getTrashName(version), relativePath)
+
+	err = os.Rename(trashPath, toPath)
+	if err != nil {
+		return "", err
+	}
+
+	// note: tidy up the folders it was in (only the empty ones can be removed)
+	for folderPath := filepath.Dir(trashPath); folderPath != t.path; folderPath = filepath.Dir(folderPath) {
+		if os.Remove(folderPath) != nil {
+			break
+		}
+	}
+
+	return fmt.Sprintf("restored the version of %v trashed at %v to %v", relativePath, version.Local(), toPath), nil
+}
@@ -0,0 +1,47 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReceiverLeavesFilesWhenTheTrashFails(t *testing.T) {
+	l := getLoopback(t, 1)
+
+	var err error
+
+	l.receiver.trash, err = GetTrash(l.remotePath, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.txt"), "a")
+	writeTestFile(t, filepath.Join(l.localPath, "b.txt"), "b")
+	l.sync(t)
+
+	// note: a file where the trash folder should be, so nothing can be put in it
+	err = os.RemoveAll(l.receiver.trash.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, l.receiver.trash.path, "")
+
+	writeTestFile(t, filepath.Join(l.localPath, "a.txt"), "a edit")
+
+	err = os.Remove(filepath.Join(l.localPath, "b.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.sync(t)
+
+	if readTestFile(t, filepath.Join(l.remotePath, "a.txt")) != "a" {
+		t.Errorf("a.txt was overwritten without a copy in the trash")
+	}
+
+	if readTestFile(t, filepath.Join(l.remotePath, "b.txt")) != "b" {
+		t.Errorf("b.txt was deleted without a copy in the trash")
+	}
+}
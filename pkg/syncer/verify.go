@@ -0,0 +1,301 @@
+package syncer
+
+import (
+	"github.com/initialed85/syncer/internal/utils"
+	"log"
+	"path"
+	"sort"
+	"time"
+)
+
+// maxDigestPaths bounds how many folders are asked about in one go
+const maxDigestPaths = 1024
+
+type treeDifferences struct {
+	changed    []string // files that are on both sides but differ
+	localOnly  []string // things (and everything under them) that the remote doesn't have
+	remoteOnly []string // things (and everything under them) that the remote shouldn't have
+	folders    int      // folders compared
+}
+
+func (d *treeDifferences) count() int {
+	return len(d.changed) + len(d.localOnly) + len(d.remoteOnly)
+}
+
+func joinRelativePath(relativePath string, name string) string {
+	if relativePath == "." {
+		return name
+	}
+
+	return path.Join(relativePath, name)
+}
+
+// compareListings adds the differences between the local and remote versions of a folder to differences and returns
+// the subfolders that need comparing; anything only the remote has that isIgnored is left out, as the remote may well
+// have been started with different ignore rules (and it's not ours to delete)
+func compareListings(
+	local MerkleListing,
+	remote MerkleListing,
+	differences *treeDifferences,
+	isIgnored func(relativePath string, isDir bool) bool,
+) []string {
+	differences.folders++
+
+	if local.Digest == remote.Digest {
+		return nil
+	}
+
+	remoteEntryByName := make(map[string]MerkleEntry)
+	for _, entry := range remote.Entries {
+		remoteEntryByName[entry.Name] = entry
+	}
+
+	folders := make([]string, 0)
+
+	for _, entry := range local.Entries {
+		relativePath := joinRelativePath(local.Path, entry.Name)
+
+		remoteEntry, ok := remoteEntryByName[entry.Name]
+		delete(remoteEntryByName, entry.Name)
+
+		if !ok {
+			differences.localOnly = append(differences.localOnly, relativePath)
+			continue
+		}
+
+		if entry.IsDir != remoteEntry.IsDir {
+			differences.remoteOnly = append(differences.remoteOnly, relativePath)
+			differences.localOnly = append(differences.localOnly, relativePath)
+			continue
+		}
+
+		if entry.Digest == remoteEntry.Digest {
+			continue
+		}
+
+		if entry.IsDir {
+			folders = append(folders, relativePath)
+			continue
+		}
+
+		differences.changed = append(differences.changed, relativePath)
+	}
+
+	for name, remoteEntry := range remoteEntryByName {
+		relativePath := joinRelativePath(remote.Path, name)
+
+		if isIgnored(relativePath, remoteEntry.IsDir) {
+			utils.DebugLog("verify", "ignored", relativePath)
+			continue
+		}
+
+		differences.remoteOnly = append(differences.remoteOnly, relativePath)
+	}
+
+	return folders
+}
+
+// compareTrees compares the local tree with the remote one a level at a time, only going into folders whose digests
+// differ (so it's a round trip per level and the work is in proportion to what's different, not to the size); if
+// rewalk is set, the remote walks its tree again first
+func (s *Sender) compareTrees(conn *Conn, rewalk bool) (*treeDifferences, error) {
+	differences := treeDifferences{}
+
+	folders := []string{"."}
+
+	for len(folders) > 0 {
+		paths := folders
+		if len(paths) > maxDigestPaths {
+			paths = paths[:maxDigestPaths]
+		}
+		folders = folders[len(paths):]
+
+		response, err := conn.request(&Message{
+			Type:          MessageTypeDigests,
+			Paths:         paths,
+			HashAlgorithm: s.hashAlgorithm,
+			Rewalk:        rewalk && paths[0] == ".",
+		})
+		if err != nil {
+			if response == nil { // no response means the conn is broken
+				return nil, err
+			}
+
+			log.Printf("warning: not verifying as %v reported %v", s.peerName, err)
+			return nil, nil
+		}
+
+		for _, remote := range response.Listings {
+			local := s.localTree.getListing(remote.Path)
+
+			if !local.Found || !remote.Found { // note: it changed on one side while we were comparing; the diff will catch it
+				continue
+			}
+
+			folders = append(folders, compareListings(local, remote, &differences, s.isIgnoredRelativePath)...)
+		}
+	}
+
+	sort.Strings(differences.changed)
+	sort.Strings(differences.localOnly)
+	sort.Strings(differences.remoteOnly)
+
+	return &differences, nil
+}
+
+func (s *Sender) isIgnoredRelativePath(relativePath string, isDir bool) bool {
+	return s.isIgnored != nil && s.isIgnored(s.localTree.getPath(relativePath), isDir)
+}
+
+// getRepairMessages makes the remote match the local tree (deletes first, then parents before their children)
+func (s *Sender) getRepairMessages(differences *treeDifferences) []*Message {
+	messages := make([]*Message, 0)
+
+	for _, relativePath := range differences.remoteOnly {
+		messages = append(messages, &Message{
+			Type: MessageTypeDelete,
+			Path: relativePath,
+		})
+	}
+
+	changedMessages := make([]*Message, 0)
+
+	// note: a changed file is just the one thing, so it's made again the same way as something that's missing
+	for _, relativePath := range append(differences.changed, differences.localOnly...) {
+		for _, file := range s.localTree.getFilesUnder(relativePath) {
+			fileRelativePath, err := s.getRelativePath(file.Path)
+			if err != nil {
+				continue
+			}
+
+			messageType, ok := getCreateMessageType(file)
+			if !ok {
+				continue
+			}
+
+			changedMessages = append(changedMessages, &Message{
+				Type: messageType,
+				Path: fileRelativePath,
+			})
+		}
+	}
+
+	sort.SliceStable(changedMessages, func(i, j int) bool {
+		return changedMessages[i].Path < changedMessages[j].Path
+	})
+
+	return append(messages, changedMessages...)
+}
+
+// verify compares the trees and (for a one way sync) sends whatever it takes to make the remote match; for a
+// bidirectional sync it only reports, as there's no telling which side is right; rewalk is for a drift check (see
+// compareTrees), otherwise the remote tree is only what's been synced to it
+func (s *Sender) verify(conn *Conn, rewalk bool) error {
+	s.needsVerify = false
+
+	if s.localTree == nil {
+		return nil
+	}
+
+	before := time.Now()
+
+	differences, err := s.compareTrees(conn, rewalk)
+	if err != nil || differences == nil {
+		return err
+	}
+
+	if differences.count() == 0 {
+		s.deleteGuard.resume(deleteSourceVerify)
+		log.Printf("verified %v matches (compared %v folders in %v)", s.peerName, differences.folders, time.Since(before))
+		return nil
+	}
+
+	log.Printf(
+		"found %v changed, %v missing and %v extra on %v (compared %v folders in %v)",
+		len(differences.changed), len(differences.localOnly), len(differences.remoteOnly), s.peerName, differences.folders, time.Since(before),
+	)
+
+	for _, relativePath := range differences.changed {
+		utils.DebugLog("verify", "changed", relativePath)
+	}
+
+	for _, relativePath := range differences.localOnly {
+		utils.DebugLog("verify", "missing", relativePath)
+	}
+
+	for _, relativePath := range differences.remoteOnly {
+		utils.DebugLog("verify", "extra", relativePath)
+	}
+
+	if s.syncState != nil {
+		log.Printf("warning: not repairing differences with %v as this is a bidirectional sync", s.peerName)
+		return nil
+	}
+
+	if s.deleteGuard.isPaused(deleteSourceDiff) { // note: it'd only be asking about the same deletion again
+		return nil
+	}
+
+	// note: an extra thing might be a whole folder, so this is a lower bound on how many files would be deleted
+	remoteOnlyPaths := make([]string, 0, len(differences.remoteOnly))
+	for _, relativePath := range differences.remoteOnly {
+		remoteOnlyPaths = append(remoteOnlyPaths, s.localTree.getPath(relativePath))
+	}
+
+	if !s.deleteGuard.allow(deleteSourceVerify, remoteOnlyPaths, s.localTree.countFiles()+len(remoteOnlyPaths)) {
+		s.needsVerify = true // note: so that it's looked at again with the next change (e.g. it may have come back)
+		return nil
+	}
+
+	_, err = s.sendMessages(conn, s.getRepairMessages(differences))
+
+	return err
+}
+
+func (s *Sender) verifyNow(rewalk bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn, err := s.getConn()
+	if err != nil {
+		log.Printf("warning: attempt to verify caused %v; will try again on the next connect", err)
+		return
+	}
+
+	err = s.verify(conn, rewalk)
+	if err != nil {
+		log.Printf("warning: attempt to verify caused %v; will try again on the next connect", err)
+		s.closeConn()
+		return
+	}
+}
+
+// startVerifying compares the trees straight away (for a one way sync) and then every interval (if it's not 0) to catch
+// anything that has drifted, e.g. changes made directly to the remote
+func (s *Sender) startVerifying(interval time.Duration) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		// note: for a bidirectional sync the first diff is still on its way, so it'd only report what that's about to fix
+		if s.syncState == nil {
+			s.verifyNow(true)
+		}
+
+		if interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.verifyNow(true)
+			}
+		}
+	}()
+}
@@ -3,21 +3,44 @@ package syncer
 import (
 	"fmt"
 	"github.com/MichaelTJones/walk"
-	"github.com/kalafut/imohash"
-	ignore "github.com/sabhiram/go-gitignore"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
-	"strings"
 	"sync"
 )
 
-func GetFilesAndGitIgnoreByPath(path string) ([]*File, map[string]*ignore.GitIgnore, error) {
+func GetFilesAndGitIgnoreByPath(path string) ([]*File, map[string]*GitIgnore, error) {
+	return getFilesAndGitIgnoreByPath(path, nil)
+}
+
+// getFilesAndGitIgnoreByPath walks path; if limiter is given it's waited on for every entry (to keep background walks
+// from hogging the disk and the CPU)
+func getFilesAndGitIgnoreByPath(path string, limiter *rateLimiter) ([]*File, map[string]*GitIgnore, error) {
 	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
 
 	files := make([]*File, 0)
-	gitIgnoreByPath := make(map[string]*ignore.GitIgnore)
+	gitIgnoreByPath := make(map[string]*GitIgnore)
+
+	// note: compilation is done in goroutines so walk.Walk can go fast
+	compileGitIgnore := func(folderPath string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			gitIgnore, compileErr := compileIgnoreFiles(folderPath)
+			if compileErr != nil {
+				log.Printf("warning: attempt to parse ignore files in %v caused %v", folderPath, compileErr)
+				return
+			}
+
+			mu.Lock()
+			gitIgnoreByPath[folderPath] = gitIgnore
+			mu.Unlock()
+		}()
+		runtime.Gosched()
+	}
 
 	// note: walk.Walk makes uses goroutines to walk as fast as possible (so it's heavy)
 	err := walk.Walk(
@@ -30,8 +53,20 @@ func GetFilesAndGitIgnoreByPath(path string) ([]*File, map[string]*ignore.GitIgn
 				return walkErr
 			}
 
+			if limiter != nil {
+				walkErr = limiter.wait()
+				if walkErr != nil {
+					return walkErr
+				}
+			}
+
 			// apply the folder regex while we're here for efficiency
 			if folderIgnoreExp.MatchString(path) {
+				// note: .git is always ignored, but it means the folder it's in has repo-wide ignore rules
+				if info.Name() == ".git" && !folderIgnoreExp.MatchString(filepath.Dir(path)) {
+					compileGitIgnore(filepath.Dir(path))
+				}
+
 				return nil
 			}
 
@@ -45,42 +80,11 @@ func GetFilesAndGitIgnoreByPath(path string) ([]*File, map[string]*ignore.GitIgn
 				return walkErr
 			}
 
-			// build GitIgnores while we're here for efficiency; note: compilation is done in goroutines so walk.Walk can go fast
-			if !file.IsDir && file.Name == ".gitignore" {
-				wg.Add(1)
-				go func(gitIgnoreFile *File) {
-					defer wg.Done()
-
-					gitIgnore, compileErr := ignore.CompileIgnoreFile(gitIgnoreFile.Path)
-					if compileErr != nil {
-						log.Printf("warning: attempt to parse %v caused %v", gitIgnoreFile.Path, walkErr)
-						return
-					}
-
-					mu.Lock()
-					gitIgnoreByPath[gitIgnoreFile.ParentPath] = gitIgnore
-					mu.Unlock()
-				}(file)
-				runtime.Gosched()
+			// build GitIgnores while we're here for efficiency
+			if !file.IsDir && isIgnoreFileName(file.Name) {
+				compileGitIgnore(file.ParentPath)
 			}
 
-			_ = imohash.SumFile
-			// TODO
-			// if !(file.IsDir || file.IsSymlink) {
-			// 	wg.Add(1)
-			// 	go func(sumFile *File) {
-			// 		defer wg.Done()
-			//
-			// 		Sum, err := imohash.SumFile(file.Path)
-			// 		if err != nil {
-			// 			log.Printf("warning: attempt to imohash.SumFile %v returned %v", sumFile.Path, err)
-			// 		}
-			//
-			// 		file.Sum = Sum
-			// 	}(file)
-			// 	runtime.Gosched()
-			// }
-
 			mu.Lock()
 			files = append(files, file)
 			mu.Unlock()
@@ -100,34 +104,21 @@ func GetFilesAndGitIgnoreByPath(path string) ([]*File, map[string]*ignore.GitIgn
 	return files, gitIgnoreByPath, nil
 }
 
-func FilterFiles(files []*File, gitIgnoreByPath map[string]*ignore.GitIgnore) ([]*File, error) {
+func FilterFiles(files []*File, gitIgnoreByPath map[string]*GitIgnore) ([]*File, error) {
 	wg := sync.WaitGroup{}
 	mu := sync.Mutex{}
 
 	gitIgnoreFilteredFiles := make([]*File, 0)
 
+	matcher := getGitIgnoreMatcher(gitIgnoreByPath)
+
 	for _, file := range files {
 		wg.Add(1)
 
 		go func(f *File) {
 			defer wg.Done()
 
-			gitIgnored := false
-
-			for gitIgnorePath, gitIgnore := range gitIgnoreByPath {
-				if !strings.HasPrefix(f.Path, gitIgnorePath) {
-					continue
-				}
-
-				if !gitIgnore.MatchesPath(f.Path) {
-					continue
-				}
-
-				gitIgnored = true
-				break
-			}
-
-			if gitIgnored {
+			if matcher.isIgnored(f.Path, f.IsDir) {
 				return
 			}
 
@@ -171,8 +162,12 @@ func GetFileByPathFromFiles(files []*File) (map[string]*File, error) {
 	return fileByPath, nil
 }
 
-func GetFileByPathAndFolderByPathAndGitIgnoreByPathForPath(path string) (map[string]*File, map[string]*File, map[string]*ignore.GitIgnore, error) {
-	allFiles, gitIgnoreByPath, err := GetFilesAndGitIgnoreByPath(path)
+func GetFileByPathAndFolderByPathAndGitIgnoreByPathForPath(path string) (map[string]*File, map[string]*File, map[string]*GitIgnore, error) {
+	return getFileByPathAndFolderByPathAndGitIgnoreByPathForPath(path, nil)
+}
+
+func getFileByPathAndFolderByPathAndGitIgnoreByPathForPath(path string, limiter *rateLimiter) (map[string]*File, map[string]*File, map[string]*GitIgnore, error) {
+	allFiles, gitIgnoreByPath, err := getFilesAndGitIgnoreByPath(path, limiter)
 	if err != nil {
 		return nil, nil, nil, err
 	}
@@ -0,0 +1,266 @@
+package syncer
+
+import (
+	"fmt"
+	"github.com/rjeczalik/notify"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const notifyBackendBufferSize = 65536
+
+type WatchBackendName string
+
+const (
+	WatchBackendNotify   WatchBackendName = "notify"
+	WatchBackendPolling  WatchBackendName = "polling"
+	WatchBackendINotify  WatchBackendName = "inotify"
+	WatchBackendFANotify WatchBackendName = "fanotify"
+)
+
+var WatchBackendNames = []WatchBackendName{
+	WatchBackendNotify,
+	WatchBackendPolling,
+	WatchBackendINotify,
+	WatchBackendFANotify,
+}
+
+// WatchBackend is a source of filesystem events for the Watcher; if a backend knows it has lost events (e.g. the
+// OS queue overflowed) it asks for the affected path to be walked again by sending it to rescans
+type WatchBackend interface {
+	Watch(path string, fsEvents chan<- notify.EventInfo, rescans chan<- string) error
+	Stop()
+}
+
+func GetWatchBackend(name WatchBackendName, pollInterval time.Duration) (WatchBackend, error) {
+	switch name {
+
+	case WatchBackendNotify:
+		return &notifyBackend{}, nil
+
+	case WatchBackendPolling:
+		if pollInterval <= 0 {
+			return nil, fmt.Errorf("poll interval must be positive, got %v", pollInterval)
+		}
+
+		return &pollingBackend{interval: pollInterval}, nil
+
+	case WatchBackendINotify:
+		return getINotifyBackend()
+
+	case WatchBackendFANotify:
+		return getFANotifyBackend()
+
+	}
+
+	return nil, fmt.Errorf("unsupported watch backend %#+v", name)
+}
+
+// notifyBackend is a recursive watch courtesy of rjeczalik/notify (FSEvents on macOS, one inotify watch per folder on Linux)
+type notifyBackend struct {
+	path     string
+	events   chan notify.EventInfo
+	fsEvents chan<- notify.EventInfo
+	rescans  chan<- string
+	stop     chan bool
+	stopped  chan bool
+}
+
+func (b *notifyBackend) Watch(path string, fsEvents chan<- notify.EventInfo, rescans chan<- string) error {
+	b.path = path
+	b.events = make(chan notify.EventInfo, notifyBackendBufferSize)
+	b.fsEvents = fsEvents
+	b.rescans = rescans
+	b.stop = make(chan bool)
+	b.stopped = make(chan bool)
+
+	err := notify.Watch(
+		fmt.Sprintf("%v/...", strings.TrimRight(path, "/")),
+		b.events,
+		notify.Create, notify.Remove, notify.Write, notify.Rename,
+	)
+	if err != nil {
+		return err
+	}
+
+	go b.run()
+
+	return nil
+}
+
+// note: notify silently drops events if our channel is full (and it swallows IN_Q_OVERFLOW / the FSEvents dropped
+// flags), so the best we can do is notice when our channel gets full and assume the worst
+func (b *notifyBackend) run() {
+	defer close(b.stopped)
+
+	overflowing := false
+
+	for {
+		select {
+
+		case <-b.stop:
+			return
+
+		case event := <-b.events:
+			if len(b.events) >= cap(b.events)-1 {
+				if !overflowing {
+					log.Printf("warning: notify buffer is full; events may have been lost")
+					overflowing = true
+				}
+			} else if overflowing && len(b.events) == 0 { // the rescan has to come after whatever got through
+				overflowing = false
+
+				select {
+				case b.rescans <- b.path:
+				case <-b.stop:
+					return
+				}
+			}
+
+			select {
+			case b.fsEvents <- event:
+			case <-b.stop:
+				return
+			}
+		}
+	}
+}
+
+func (b *notifyBackend) Stop() {
+	if b.events == nil {
+		return
+	}
+
+	notify.Stop(b.events)
+	close(b.stop)
+	<-b.stopped
+}
+
+type polledFile struct {
+	isDir    bool
+	size     int64
+	modified time.Time
+}
+
+// pollingBackend walks the whole tree every interval and makes up events for the differences; it's slow for big trees
+// but it works anywhere (e.g. network filesystems that don't support any kind of notification)
+type pollingBackend struct {
+	mu       sync.Mutex
+	interval time.Duration
+	stop     chan bool
+	stopped  chan bool
+}
+
+func (b *pollingBackend) poll(path string) (map[string]*polledFile, error) {
+	files, _, err := GetFilesAndGitIgnoreByPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	polledFileByPath := make(map[string]*polledFile)
+	for _, file := range files {
+		polledFileByPath[file.Path] = &polledFile{
+			isDir:    file.IsDir,
+			size:     file.Size,
+			modified: file.Modified,
+		}
+	}
+
+	return polledFileByPath, nil
+}
+
+func (b *pollingBackend) Watch(path string, fsEvents chan<- notify.EventInfo, rescans chan<- string) error {
+	lastPolledFileByPath, err := b.poll(path)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.stop = make(chan bool)
+	b.stopped = make(chan bool)
+	b.mu.Unlock()
+
+	stop := b.stop
+
+	// note: don't block Stop if the Watcher has stopped reading
+	emit := func(event notify.Event, path string) {
+		select {
+		case fsEvents <- FakeEventInfo{event: event, path: path}:
+		case <-stop:
+		}
+	}
+
+	go func() {
+		defer close(b.stopped)
+
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+
+			case <-stop:
+				return
+
+			case <-ticker.C:
+				polledFileByPath, err := b.poll(path)
+				if err != nil {
+					log.Printf("warning: attempt to poll %v caused %v", path, err)
+					continue
+				}
+
+				for polledPath, polledFile := range polledFileByPath {
+					lastPolledFile, ok := lastPolledFileByPath[polledPath]
+					if !ok {
+						emit(notify.Create, polledPath)
+						continue
+					}
+
+					if polledFile.isDir != lastPolledFile.isDir {
+						emit(notify.Remove, polledPath)
+						emit(notify.Create, polledPath)
+						continue
+					}
+
+					if polledFile.isDir { // folder modified times only change because of their contents, which have their own events
+						continue
+					}
+
+					if polledFile.size == lastPolledFile.size && polledFile.modified.Equal(lastPolledFile.modified) {
+						continue
+					}
+
+					emit(notify.Write, polledPath)
+				}
+
+				for lastPolledPath := range lastPolledFileByPath {
+					_, ok := polledFileByPath[lastPolledPath]
+					if ok {
+						continue
+					}
+
+					emit(notify.Remove, lastPolledPath)
+				}
+
+				lastPolledFileByPath = polledFileByPath
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *pollingBackend) Stop() {
+	b.mu.Lock()
+	stop, stopped := b.stop, b.stopped
+	b.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-stopped
+}
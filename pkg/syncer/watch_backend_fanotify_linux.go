@@ -0,0 +1,259 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/initialed85/syncer/internal/utils"
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+const fanotifyMask = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MODIFY | unix.FAN_MOVED_FROM | unix.FAN_MOVED_TO |
+	unix.FAN_ONDIR
+
+// fanotifyBackend is one filesystem-wide fanotify mark (so no per-folder watches at all); it needs CAP_SYS_ADMIN and
+// Linux 5.9+ (for FAN_REPORT_DFID_NAME) and events for paths outside of what we're watching are thrown away
+type fanotifyBackend struct {
+	f           *os.File
+	mountFd     int
+	path        string
+	fsEvents    chan<- notify.EventInfo
+	rescans     chan<- string
+	stop        chan bool
+	stopped     chan bool
+	overflowing bool
+}
+
+func getFANotifyBackend() (WatchBackend, error) {
+	return &fanotifyBackend{}, nil
+}
+
+func (b *fanotifyBackend) Watch(path string, fsEvents chan<- notify.EventInfo, rescans chan<- string) error {
+	fd, err := unix.FanotifyInit(
+		unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK|unix.FAN_REPORT_DFID_NAME,
+		unix.O_RDONLY|unix.O_CLOEXEC,
+	)
+	if err != nil {
+		if errors.Is(err, unix.EPERM) {
+			return fmt.Errorf("%v (fanotify needs CAP_SYS_ADMIN)", err)
+		}
+
+		if errors.Is(err, unix.EINVAL) {
+			return fmt.Errorf("%v (fanotify with FAN_REPORT_DFID_NAME needs Linux 5.9+)", err)
+		}
+
+		return err
+	}
+
+	err = unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, fanotifyMask, unix.AT_FDCWD, path)
+	if err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+
+	// file handles get resolved relative to any fd on the same filesystem
+	mountFd, err := unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		_ = unix.Close(fd)
+		return err
+	}
+
+	// note: as for inotifyBackend, os.NewFile on a non-blocking fd means Close unblocks Read
+	b.f = os.NewFile(uintptr(fd), "fanotify")
+	b.mountFd = mountFd
+	b.path = path
+	b.fsEvents = fsEvents
+	b.rescans = rescans
+	b.stop = make(chan bool)
+	b.stopped = make(chan bool)
+
+	go b.run()
+
+	return nil
+}
+
+func (b *fanotifyBackend) resolve(handleType int32, handle []byte) (string, error) {
+	fd, err := unix.OpenByHandleAt(b.mountFd, unix.NewFileHandle(handleType, handle), unix.O_PATH)
+	if err != nil { // e.g. ESTALE if the folder is gone already
+		return "", err
+	}
+
+	defer func() {
+		_ = unix.Close(fd)
+	}()
+
+	return os.Readlink(fmt.Sprintf("/proc/self/fd/%v", fd))
+}
+
+func (b *fanotifyBackend) handleEvent(mask uint64, path string) {
+	if path != b.path && !strings.HasPrefix(path, b.path+"/") {
+		return
+	}
+
+	if folderIgnoreExp.MatchString(path) {
+		return
+	}
+
+	utils.DebugLog("fanotify", fmt.Sprintf("%#x", mask), path)
+
+	event := notify.Event(0)
+
+	if mask&unix.FAN_CREATE != 0 {
+		event = notify.Create
+	} else if mask&unix.FAN_DELETE != 0 {
+		event = notify.Remove
+	} else if mask&unix.FAN_MODIFY != 0 {
+		event = notify.Write
+	} else if mask&(unix.FAN_MOVED_FROM|unix.FAN_MOVED_TO) != 0 {
+		event = notify.Rename
+	}
+
+	if event == 0 {
+		return
+	}
+
+	select { // note: don't block Stop if the Watcher has stopped reading
+	case b.fsEvents <- FakeEventInfo{event: event, path: path}:
+	case <-b.stop:
+	}
+}
+
+// parseInfo pulls the folder file handle and the name out of a FAN_EVENT_INFO_TYPE_DFID_NAME record, which looks like
+// (header, fsid, file_handle (bytes, type, handle), name\0)
+func (b *fanotifyBackend) parseInfo(info []byte) (int32, []byte, string, bool) {
+	if len(info) < 4+8+8 {
+		return 0, nil, "", false
+	}
+
+	if info[0] != unix.FAN_EVENT_INFO_TYPE_DFID_NAME && info[0] != unix.FAN_EVENT_INFO_TYPE_DFID {
+		return 0, nil, "", false
+	}
+
+	fileHandle := info[4+8:]
+	handleBytes := int(*(*uint32)(unsafe.Pointer(&fileHandle[0])))
+	handleType := *(*int32)(unsafe.Pointer(&fileHandle[4]))
+
+	if 8+handleBytes > len(fileHandle) {
+		return 0, nil, "", false
+	}
+
+	handle := fileHandle[8 : 8+handleBytes]
+
+	name := ""
+	if info[0] == unix.FAN_EVENT_INFO_TYPE_DFID_NAME {
+		rawName := fileHandle[8+handleBytes:]
+		for i, c := range rawName {
+			if c == 0 {
+				rawName = rawName[:i]
+				break
+			}
+		}
+
+		name = string(rawName)
+	}
+
+	return handleType, handle, name, true
+}
+
+func (b *fanotifyBackend) run() {
+	defer close(b.stopped)
+
+	metadataSize := int(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, err := b.f.Read(buf)
+		if err != nil { // the fd has been closed
+			return
+		}
+
+		// note: if a folder can't be resolved, what happened in it isn't known, so everything is walked again (once for
+		// however many of those there are in what was read)
+		unresolved := false
+
+		offset := 0
+		for offset+metadataSize <= n {
+			metadata := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[offset]))
+
+			if metadata.Vers != unix.FANOTIFY_METADATA_VERSION {
+				log.Printf("warning: fanotify metadata version %v is unsupported; giving up", metadata.Vers)
+				return
+			}
+
+			if metadata.Fd >= 0 { // note: shouldn't happen with FAN_REPORT_DFID_NAME, but don't leak it if it does
+				_ = unix.Close(int(metadata.Fd))
+			}
+
+			end := offset + int(metadata.Event_len)
+			if end > n {
+				break
+			}
+
+			if metadata.Mask&unix.FAN_Q_OVERFLOW != 0 {
+				if !b.overflowing {
+					log.Printf("warning: fanotify queue overflowed; events have been lost")
+					b.overflowing = true
+				}
+
+				select {
+				case b.rescans <- b.path:
+				case <-b.stop:
+				}
+			} else {
+				b.overflowing = false
+
+				infoOffset := offset + int(metadata.Metadata_len)
+				for infoOffset+4 <= end {
+					infoLen := int(*(*uint16)(unsafe.Pointer(&buf[infoOffset+2])))
+					if infoLen == 0 || infoOffset+infoLen > end {
+						break
+					}
+
+					handleType, handle, name, ok := b.parseInfo(buf[infoOffset : infoOffset+infoLen])
+					if ok {
+						folderPath, err := b.resolve(handleType, handle)
+						if err != nil {
+							utils.DebugLog("fanotify", "resolve", err.Error())
+							unresolved = true
+						} else {
+							path := folderPath
+							if name != "" && name != "." {
+								path = filepath.Join(folderPath, name)
+							}
+
+							b.handleEvent(metadata.Mask, path)
+						}
+					}
+
+					infoOffset += infoLen
+				}
+			}
+
+			offset = end
+		}
+
+		if unresolved {
+			select {
+			case b.rescans <- b.path:
+			case <-b.stop:
+			}
+		}
+	}
+}
+
+func (b *fanotifyBackend) Stop() {
+	if b.f == nil {
+		return
+	}
+
+	close(b.stop)
+	_ = b.f.Close()
+	<-b.stopped
+	_ = unix.Close(b.mountFd)
+}
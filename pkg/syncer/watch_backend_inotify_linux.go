@@ -0,0 +1,300 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/initialed85/syncer/internal/utils"
+	"github.com/rjeczalik/notify"
+	"golang.org/x/sys/unix"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE |
+		unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF | unix.IN_ONLYDIR
+	// inotifyRetryInterval is how often watching the folders that couldn't be watched (e.g. for want of watches) is tried
+	// again
+	inotifyRetryInterval = time.Second * 10
+)
+
+// inotifyBackend is a plain inotify watch per (non-ignored) folder; unlike notify it handles IN_Q_OVERFLOW (by asking
+// for a rescan) and skips the folders we ignore anyway, which saves on max_user_watches
+type inotifyBackend struct {
+	mu          sync.Mutex
+	fd          int
+	f           *os.File
+	pathByWd    map[int]string
+	path        string
+	fsEvents    chan<- notify.EventInfo
+	rescans     chan<- string
+	stop        chan bool
+	stopped     chan bool
+	retried     chan bool
+	overflowing bool
+	// unwatchedPaths are the folders that addWatches failed for, which are tried again every inotifyRetryInterval
+	unwatchedPaths map[string]bool
+}
+
+func getINotifyBackend() (WatchBackend, error) {
+	b := inotifyBackend{
+		pathByWd:       make(map[int]string),
+		unwatchedPaths: make(map[string]bool),
+	}
+
+	return &b, nil
+}
+
+func (b *inotifyBackend) addWatches(path string) error {
+	return filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) { // this can occur if things are quickly added then deleted
+				return nil
+			}
+
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		if folderIgnoreExp.MatchString(path) {
+			return filepath.SkipDir
+		}
+
+		wd, err := unix.InotifyAddWatch(b.fd, path, inotifyMask)
+		if err != nil {
+			if errors.Is(err, unix.ENOSPC) {
+				return fmt.Errorf("%v (consider raising fs.inotify.max_user_watches or using the fanotify / polling backends)", err)
+			}
+
+			if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+				return nil
+			}
+
+			return err
+		}
+
+		b.mu.Lock()
+		b.pathByWd[wd] = path
+		b.mu.Unlock()
+
+		return nil
+	})
+}
+
+func (b *inotifyBackend) removeWatch(wd int) {
+	b.mu.Lock()
+	delete(b.pathByWd, wd)
+	b.mu.Unlock()
+}
+
+func (b *inotifyBackend) Watch(path string, fsEvents chan<- notify.EventInfo, rescans chan<- string) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+
+	// note: a non-blocking fd via os.NewFile goes through the runtime poller, so Close unblocks Read (as long as
+	// nobody calls Fd(), which flips it back to blocking)
+	b.fd = fd
+	b.f = os.NewFile(uintptr(fd), "inotify")
+	b.path = path
+	b.fsEvents = fsEvents
+	b.rescans = rescans
+	b.stop = make(chan bool)
+	b.stopped = make(chan bool)
+	b.retried = make(chan bool)
+
+	err = b.addWatches(path)
+	if err != nil {
+		_ = b.f.Close()
+		return err
+	}
+
+	go b.run()
+	go b.retry()
+
+	return nil
+}
+
+// rescan asks for path to be walked again (as events for it may have been missed)
+func (b *inotifyBackend) rescan(path string) {
+	select {
+	case b.rescans <- path:
+	case <-b.stop:
+	}
+}
+
+// watchNewFolder adds watches for a folder that's just turned up; if that fails, it's tried again later (see retry) and
+// it's walked again in the meantime, so that what's already in it isn't missed
+func (b *inotifyBackend) watchNewFolder(path string) {
+	err := b.addWatches(path)
+	if err == nil {
+		return
+	}
+
+	log.Printf("warning: attempt to watch %v caused %v; trying again every %v", path, err, inotifyRetryInterval)
+
+	b.mu.Lock()
+	b.unwatchedPaths[path] = true
+	b.mu.Unlock()
+
+	b.rescan(path)
+}
+
+// retry tries to watch the unwatchedPaths again every inotifyRetryInterval until stopped, asking for each one that
+// works to be walked again (as whatever happened in it in the meantime has no events)
+func (b *inotifyBackend) retry() {
+	defer close(b.retried)
+
+	ticker := time.NewTicker(inotifyRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+
+		b.mu.Lock()
+		paths := make([]string, 0, len(b.unwatchedPaths))
+		for path := range b.unwatchedPaths {
+			paths = append(paths, path)
+		}
+		b.mu.Unlock()
+
+		for _, path := range paths {
+			err := b.addWatches(path)
+			if err != nil {
+				continue
+			}
+
+			log.Printf("watching %v now", path)
+
+			b.mu.Lock()
+			delete(b.unwatchedPaths, path)
+			b.mu.Unlock()
+
+			b.rescan(path)
+		}
+	}
+}
+
+func (b *inotifyBackend) handleEvent(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		if !b.overflowing {
+			log.Printf("warning: inotify queue overflowed; events have been lost")
+			b.overflowing = true
+		}
+
+		b.rescan(b.path)
+
+		return
+	}
+
+	b.overflowing = false
+
+	b.mu.Lock()
+	folderPath, ok := b.pathByWd[wd]
+	b.mu.Unlock()
+
+	if mask&unix.IN_IGNORED != 0 { // the watch is gone (e.g. the folder was deleted)
+		b.removeWatch(wd)
+		return
+	}
+
+	if !ok {
+		return
+	}
+
+	path := folderPath
+	if name != "" {
+		path = filepath.Join(folderPath, name)
+	}
+
+	utils.DebugLog("inotify", fmt.Sprintf("%#x", mask), path)
+
+	if mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF) != 0 {
+		// note: the parent folder's watch gets an IN_DELETE / IN_MOVED_FROM for this, so there's nothing to emit
+		return
+	}
+
+	if mask&unix.IN_ISDIR != 0 && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+		b.watchNewFolder(path)
+	}
+
+	event := notify.Event(0)
+
+	if mask&unix.IN_CREATE != 0 {
+		event = notify.Create
+	} else if mask&unix.IN_DELETE != 0 {
+		event = notify.Remove
+	} else if mask&(unix.IN_MODIFY|unix.IN_CLOSE_WRITE) != 0 {
+		event = notify.Write
+	} else if mask&(unix.IN_MOVED_FROM|unix.IN_MOVED_TO) != 0 {
+		event = notify.Rename
+	}
+
+	if event == 0 {
+		return
+	}
+
+	select { // note: don't block Stop if the Watcher has stopped reading
+	case b.fsEvents <- FakeEventInfo{event: event, path: path}:
+	case <-b.stop:
+	}
+}
+
+func (b *inotifyBackend) run() {
+	defer close(b.stopped)
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, err := b.f.Read(buf)
+		if err != nil { // the fd has been closed
+			return
+		}
+
+		offset := 0
+		for offset+unix.SizeofInotifyEvent <= n {
+			rawEvent := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+
+			name := ""
+			if rawEvent.Len > 0 {
+				rawName := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(rawEvent.Len)]
+				for i, c := range rawName { // note: names are padded with NULs
+					if c == 0 {
+						rawName = rawName[:i]
+						break
+					}
+				}
+
+				name = string(rawName)
+			}
+
+			b.handleEvent(int(rawEvent.Wd), rawEvent.Mask, name)
+
+			offset += unix.SizeofInotifyEvent + int(rawEvent.Len)
+		}
+	}
+}
+
+func (b *inotifyBackend) Stop() {
+	if b.f == nil {
+		return
+	}
+
+	close(b.stop)
+	<-b.retried // note: before the fd is closed, as it might be adding watches with it
+	_ = b.f.Close()
+	<-b.stopped
+}
@@ -0,0 +1,34 @@
+package syncer
+
+import (
+	"testing"
+)
+
+func TestINotifyBackendRescansWhatItCantWatch(t *testing.T) {
+	path := t.TempDir()
+
+	rescans := make(chan string, 1)
+
+	b := inotifyBackend{
+		fd:             -1, // note: so adding a watch fails, as it would for want of watches
+		pathByWd:       make(map[int]string),
+		unwatchedPaths: make(map[string]bool),
+		rescans:        rescans,
+		stop:           make(chan bool),
+	}
+
+	b.watchNewFolder(path)
+
+	select {
+	case rescan := <-rescans:
+		if rescan != path {
+			t.Errorf("got a rescan of %v; wanted %v", rescan, path)
+		}
+	default:
+		t.Errorf("got no rescan")
+	}
+
+	if !b.unwatchedPaths[path] {
+		t.Errorf("%v wasn't kept to be tried again", path)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package syncer
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func getINotifyBackend() (WatchBackend, error) {
+	return nil, fmt.Errorf("the %v watch backend is only supported on Linux (not %v)", WatchBackendINotify, runtime.GOOS)
+}
+
+func getFANotifyBackend() (WatchBackend, error) {
+	return nil, fmt.Errorf("the %v watch backend is only supported on Linux (not %v)", WatchBackendFANotify, runtime.GOOS)
+}
@@ -5,8 +5,6 @@ import (
 	"github.com/initialed85/syncer/internal/utils"
 	"github.com/rjeczalik/notify"
 	"log"
-	"sort"
-	"strings"
 	"sync"
 	"time"
 )
@@ -15,17 +13,37 @@ type Watcher struct {
 	mu                     sync.Mutex
 	fsEvents               chan notify.EventInfo
 	bufferedFsEvents       []notify.EventInfo
+	rescans                chan string
+	dirtyPaths             map[string]bool
+	updateRequested        bool
+	resyncs                int
 	lastFsEvent            time.Time
 	errors                 chan error
 	started, stop, stopped chan bool
 	handler                *Handler
+	backend                WatchBackend
 	ticker                 *time.Ticker
 	watching               map[string]*File
 	path                   string
 	rate, debounce         time.Duration
+	reconcileInterval      time.Duration
+	reconcileRate          int
+	reconciled             chan map[string]*File
 }
 
-func GetWatcher(path string, rate time.Duration, debounce time.Duration, handler *Handler) (*Watcher, error) {
+func GetWatcher(
+	path string,
+	rate time.Duration,
+	debounce time.Duration,
+	handler *Handler,
+	backend WatchBackend,
+	reconcileInterval time.Duration,
+	reconcileRate int,
+) (*Watcher, error) {
+	if reconcileInterval > 0 && reconcileRate < 1 {
+		return nil, fmt.Errorf("reconcile rate must be at least 1, got %v", reconcileRate)
+	}
+
 	w := Watcher{
 		errors:   make(chan error),
 		started:  make(chan bool),
@@ -36,6 +54,10 @@ func GetWatcher(path string, rate time.Duration, debounce time.Duration, handler
 		rate:     rate,
 		debounce: debounce,
 		handler:  handler,
+		backend:  backend,
+
+		reconcileInterval: reconcileInterval,
+		reconcileRate:     reconcileRate,
 	}
 
 	handler.setWatcher(&w)
@@ -58,6 +80,26 @@ func (w *Watcher) bufferFsEvent(fsEvent notify.EventInfo) {
 	w.lastFsEvent = time.Now()
 }
 
+func (w *Watcher) bufferRescan(path string) {
+	utils.DebugLog("rescan", "requested", path)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dirtyPaths[path] = true
+	w.lastFsEvent = time.Now()
+}
+
+// requestUpdate has the handler diff (and send) again even if nothing has changed on the filesystem, e.g. because the
+// last send failed and there's now somewhere to send to
+func (w *Watcher) requestUpdate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.updateRequested = true
+	w.lastFsEvent = time.Now()
+}
+
 func (w *Watcher) handleFsEvent(fsEvent notify.EventInfo) {
 	utils.DebugLog("fs_event", fsEvent.Event().String(), fsEvent.Path())
 
@@ -108,48 +150,41 @@ func (w *Watcher) handleBufferedFsEvents() {
 	w.mu.Lock()
 	bufferedFsEvents := w.bufferedFsEvents
 	w.bufferedFsEvents = nil
+	dirtyPaths := w.dirtyPaths
+	w.dirtyPaths = make(map[string]bool)
+	updateRequested := w.updateRequested
+	w.updateRequested = false
+	h := w.handler
 	w.mu.Unlock()
 
-	if len(bufferedFsEvents) == 0 {
+	if len(bufferedFsEvents) == 0 && len(dirtyPaths) == 0 && !updateRequested {
 		return
 	}
 
-	// TODO: only works for macOS
-	// sort the events by ID so the order is as sane as possible
-	sort.SliceStable(
-		bufferedFsEvents,
-		func(i, j int) bool {
-			fsEventA := bufferedFsEvents[i]
-			fsEventB := bufferedFsEvents[j]
+	sortFsEvents(bufferedFsEvents)
 
-			rawSysA := fsEventA.Sys()
-			rawSysB := fsEventB.Sys()
+	outermostDirtyPaths := getOutermostPaths(dirtyPaths)
 
-			if rawSysA == nil || rawSysB == nil { // will be nil for OSes other than macOS
-				return false
-			}
+	for _, fsEvent := range bufferedFsEvents {
+		if isUnderAnyPath(fsEvent.Path(), outermostDirtyPaths) { // the resync is going to cover it anyway
+			continue
+		}
 
-			sysA, ok := rawSysA.(*notify.FSEvent)
-			if !ok {
-				return false
-			}
+		w.handleFsEvent(fsEvent)
+	}
 
-			sysB, ok := rawSysB.(*notify.FSEvent)
-			if !ok {
-				return false
-			}
+	for _, path := range outermostDirtyPaths {
+		before := time.Now()
 
-			return sysA.ID < sysB.ID
-		},
-	)
+		h.rescan(path)
 
-	for _, fsEvent := range bufferedFsEvents {
-		w.handleFsEvent(fsEvent)
-	}
+		w.mu.Lock()
+		w.resyncs++
+		resyncs := w.resyncs
+		w.mu.Unlock()
 
-	w.mu.Lock()
-	h := w.handler
-	w.mu.Unlock()
+		log.Printf("resynced %v in %v as events may have been lost (%v resyncs so far)", path, time.Since(before), resyncs)
+	}
 
 	h.updateDiffer()
 }
@@ -165,13 +200,11 @@ func (w *Watcher) run() {
 
 	w.fsEvents = make(chan notify.EventInfo, 65536) // should be more than enough to ensure we don't block the OS
 	w.bufferedFsEvents = make([]notify.EventInfo, 0)
+	w.rescans = make(chan string, 1024)
+	w.dirtyPaths = make(map[string]bool)
+	w.reconciled = make(chan map[string]*File, 1)
 
-	path := fmt.Sprintf(
-		"%v/...",
-		strings.TrimRight(w.path, "/"),
-	)
-
-	err = notify.Watch(path, w.fsEvents, notify.Create, notify.Remove, notify.Write, notify.Rename)
+	err = w.backend.Watch(w.path, w.fsEvents, w.rescans)
 
 	w.errors <- err
 
@@ -179,8 +212,23 @@ func (w *Watcher) run() {
 		return
 	}
 
+	// note: a nil channel never fires, so this does nothing if reconciliation is disabled
+	var reconcileTicks <-chan time.Time
+	if w.reconcileInterval > 0 {
+		reconcileTicker := time.NewTicker(w.reconcileInterval)
+		defer reconcileTicker.Stop()
+		reconcileTicks = reconcileTicker.C
+	}
+
+	var limiter *rateLimiter
+
 	defer func() {
-		notify.Stop(w.fsEvents)
+		if limiter != nil { // give up on any reconciliation walk that's still going
+			limiter.close()
+			<-w.reconciled
+		}
+
+		w.backend.Stop()
 		w.stopped <- true
 	}()
 
@@ -197,12 +245,40 @@ func (w *Watcher) run() {
 		case fsEvent := <-w.fsEvents:
 			w.bufferFsEvent(fsEvent)
 
+		case path := <-w.rescans:
+			w.bufferRescan(path)
+
 		case <-w.ticker.C:
 			w.handleBufferedFsEvents()
+
+		case <-reconcileTicks:
+			if limiter != nil { // the last one is still going
+				continue
+			}
+
+			limiter, err = getRateLimiter(w.reconcileRate)
+			if err != nil {
+				log.Printf("warning: attempt to reconcile caused %v", err)
+				continue
+			}
+
+			go w.reconcile(limiter)
+
+		case fileByPath := <-w.reconciled:
+			limiter = nil
+			w.handleReconciled(fileByPath)
 		}
 	}
 }
 
+// Resyncs is the number of times a subtree has been walked again because events for it may have been lost
+func (w *Watcher) Resyncs() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.resyncs
+}
+
 func (w *Watcher) start() error {
 	log.Printf("starting...")
 	go w.run()
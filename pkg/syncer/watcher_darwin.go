@@ -0,0 +1,36 @@
+package syncer
+
+import (
+	"github.com/rjeczalik/notify"
+	"sort"
+)
+
+// sort the events by ID so the order is as sane as possible
+func sortFsEvents(fsEvents []notify.EventInfo) {
+	sort.SliceStable(
+		fsEvents,
+		func(i, j int) bool {
+			fsEventA := fsEvents[i]
+			fsEventB := fsEvents[j]
+
+			rawSysA := fsEventA.Sys()
+			rawSysB := fsEventB.Sys()
+
+			if rawSysA == nil || rawSysB == nil {
+				return false
+			}
+
+			sysA, ok := rawSysA.(*notify.FSEvent)
+			if !ok {
+				return false
+			}
+
+			sysB, ok := rawSysB.(*notify.FSEvent)
+			if !ok {
+				return false
+			}
+
+			return sysA.ID < sysB.ID
+		},
+	)
+}
@@ -0,0 +1,11 @@
+//go:build !darwin
+
+package syncer
+
+import (
+	"github.com/rjeczalik/notify"
+)
+
+// note: only FSEvents (macOS) gives us IDs to sort on; other OSes deliver events in order
+func sortFsEvents(fsEvents []notify.EventInfo) {
+}